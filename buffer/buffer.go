@@ -132,10 +132,13 @@ func CondSetter(condition bool, setter optSetter) optSetter {
 // Attempts() - limits the amount of retry attempts
 // ResponseCode() - returns http response code
 // IsNetworkError() - tests if response code is related to networking error
+// IsTimeoutError() - tests if the forwarder reported an upstream timeout
+// TimeoutPhase() - returns the phase of the upstream timeout, e.g. "dial" or "response_header", empty without timeout
 //
 // Example of the predicate:
 //
 // `Attempts() <= 2 && ResponseCode() == 502`
+// `Attempts() <= 2 && TimeoutPhase() == "dial"`
 //
 func Retry(predicate string) optSetter {
 	return func(b *Buffer) error {
@@ -278,7 +281,8 @@ func (b *Buffer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		}
 		defer bw.Close()
 
-		b.next.ServeHTTP(bw, outreq)
+		attemptReq, record := utils.WithErrorRecord(outreq)
+		b.next.ServeHTTP(bw, attemptReq)
 		if bw.hijacked {
 			b.log.Debugf("vulcand/oxy/buffer: connection was hijacked downstream. Not taking any action in buffer.")
 			return
@@ -297,7 +301,7 @@ func (b *Buffer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		}
 
 		if (b.retryPredicate == nil || attempt > DefaultMaxRetryAttempts) ||
-			!b.retryPredicate(&context{r: req, attempt: attempt, responseCode: bw.code}) {
+			!b.retryPredicate(&context{r: req, attempt: attempt, responseCode: bw.code, err: record.Err()}) {
 			utils.CopyHeaders(w.Header(), bw.Header())
 			w.WriteHeader(bw.code)
 			if reader != nil {
@@ -3,7 +3,9 @@ package buffer
 import (
 	"net/http"
 	"net/http/httptest"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -72,6 +74,36 @@ func TestRetryExceedAttempts(t *testing.T) {
 	assert.Equal(t, http.StatusBadGateway, re.StatusCode)
 }
 
+func TestRetryOnTimeout(t *testing.T) {
+	var calls int32
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			time.Sleep(200 * time.Millisecond)
+		}
+		w.Write([]byte("hello"))
+	})
+	defer srv.Close()
+
+	fwd, err := forward.New(forward.ResponseHeaderTimeout(50 * time.Millisecond))
+	require.NoError(t, err)
+
+	lb, err := roundrobin.New(fwd)
+	require.NoError(t, err)
+	require.NoError(t, lb.UpsertServer(testutils.ParseURI(srv.URL)))
+
+	st, err := New(lb, Retry(`TimeoutPhase() == "response_header" && Attempts() <= 2`))
+	require.NoError(t, err)
+
+	proxy := httptest.NewServer(st)
+	defer proxy.Close()
+
+	re, body, err := testutils.Get(proxy.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, "hello", string(body))
+	assert.EqualValues(t, 2, atomic.LoadInt32(&calls))
+}
+
 func newBufferMiddleware(t *testing.T, p string) (*roundrobin.RoundRobin, *Buffer) {
 	// forwarder will proxy the request to whatever destination
 	fwd, err := forward.New()
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"net/http"
 
+	"github.com/vulcand/oxy/utils"
 	"github.com/vulcand/predicate"
 )
 
@@ -17,6 +18,7 @@ type context struct {
 	r            *http.Request
 	attempt      int
 	responseCode int
+	err          error
 }
 
 type hpredicate func(*context) bool
@@ -39,6 +41,8 @@ func parseExpression(in string) (hpredicate, error) {
 			"IsNetworkError": isNetworkError,
 			"Attempts":       attempts,
 			"ResponseCode":   responseCode,
+			"IsTimeoutError": isTimeoutError,
+			"TimeoutPhase":   timeoutPhase,
 		},
 	})
 	if err != nil {
@@ -86,6 +90,20 @@ func isNetworkError() hpredicate {
 	}
 }
 
+// IsTimeoutError returns a predicate that returns true if last attempt ended with an upstream timeout.
+func isTimeoutError() hpredicate {
+	return func(c *context) bool {
+		return utils.UpstreamTimeoutPhase(c.err) != ""
+	}
+}
+
+// TimeoutPhase returns mapper of the request to the phase of the upstream timeout of the last attempt, empty if there was none.
+func timeoutPhase() toString {
+	return func(c *context) string {
+		return string(utils.UpstreamTimeoutPhase(c.err))
+	}
+}
+
 // and returns predicate by joining the passed predicates with logical 'and'
 func and(fns ...hpredicate) hpredicate {
 	return func(c *context) bool {
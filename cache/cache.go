@@ -0,0 +1,707 @@
+/*
+Package cache provides http.Handler middleware that caches responses, as a shared cache following RFC 7234
+
+The cacheable responses of GET requests are stored according to their Cache-Control, Expires, Vary,
+ETag and Last-Modified headers, and served while they are fresh. Stale responses are revalidated
+with conditional requests to the next handler, and may be served while they are revalidated in the background
+(stale-while-revalidate) or when the revalidation fails (stale-if-error), see RFC 5861.
+Responses are stored in memory or on disk, within a maximum size enforced by evicting the least recently used entries.
+The stored responses are purged by URL or by surrogate key, and invalidated by the unsafe requests to their URL.
+
+Examples of a cache middleware:
+
+  // sample HTTP handler
+  handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+    w.Header().Set("Cache-Control", "max-age=60")
+    w.Write([]byte("hello"))
+  })
+
+  // Cache up to 64MB of responses in memory
+  cache.New(handler)
+
+  // Cache up to 1GB of responses on disk, serving stale responses for up to a minute if the backend fails
+  storage, _ := cache.NewDiskStorage("/var/cache/oxy", 1024 * 1024 * 1024)
+  cache.New(handler, cache.WithStorage(storage), cache.StaleIfError(time.Minute))
+
+*/
+package cache
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mailgun/timetools"
+	log "github.com/sirupsen/logrus"
+	"github.com/vulcand/oxy/utils"
+)
+
+const (
+	// DefaultMaxSize Store up to 64MB of responses in memory by default
+	DefaultMaxSize = 64 * 1024 * 1024
+	// DefaultMaxEntrySize Store the responses up to 1MB by default
+	DefaultMaxEntrySize = 1024 * 1024
+	// DefaultSurrogateKeyHeader Header listing the space separated surrogate keys of a response
+	DefaultSurrogateKeyHeader = "Surrogate-Key"
+)
+
+// XCache is the header reporting how the cache served a response
+const XCache = "X-Cache"
+
+// Cache states reported in the X-Cache header
+const (
+	// StateHit the response was served from the cache
+	StateHit = "HIT"
+	// StateMiss the response was fetched from the next handler
+	StateMiss = "MISS"
+	// StateRevalidated the stored response was revalidated with the next handler
+	StateRevalidated = "REVALIDATED"
+	// StateStale the stored response was served stale
+	StateStale = "STALE"
+)
+
+// Warnings of the stale responses, RFC 7234 section 5.5
+const (
+	warningStale              = `110 - "Response is Stale"`
+	warningRevalidationFailed = `111 - "Revalidation Failed"`
+)
+
+// hopHeaders are the hop-by-hop headers, they are not stored
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// conditionalHeaders are the headers of the conditional requests
+var conditionalHeaders = []string{
+	"If-Match",
+	"If-None-Match",
+	"If-Modified-Since",
+	"If-Unmodified-Since",
+	"If-Range",
+}
+
+// Cache is responsible for caching responses
+type Cache struct {
+	next    http.Handler
+	storage Storage
+
+	maxEntrySize         int64
+	surrogateKeyHeader   string
+	staleWhileRevalidate time.Duration
+	staleIfError         time.Duration
+
+	mutex        sync.Mutex
+	revalidating map[string]bool
+
+	clock timetools.TimeProvider
+	log   *log.Logger
+}
+
+// New returns a new cache middleware. New() function supports optional functional arguments
+func New(next http.Handler, setters ...optSetter) (*Cache, error) {
+	c := &Cache{
+		next: next,
+
+		maxEntrySize:       DefaultMaxEntrySize,
+		surrogateKeyHeader: DefaultSurrogateKeyHeader,
+
+		revalidating: make(map[string]bool),
+
+		log: log.StandardLogger(),
+	}
+	for _, s := range setters {
+		if err := s(c); err != nil {
+			return nil, err
+		}
+	}
+	if c.storage == nil {
+		c.storage = NewMemoryStorage(DefaultMaxSize)
+	}
+	if c.clock == nil {
+		c.clock = &timetools.RealTime{}
+	}
+	return c, nil
+}
+
+// Logger defines the logger the cache will use.
+//
+// It defaults to logrus.StandardLogger(), the global logger used by logrus.
+func Logger(l *log.Logger) optSetter {
+	return func(c *Cache) error {
+		c.log = l
+		return nil
+	}
+}
+
+// WithStorage sets the storage of the responses, a MemoryStorage of DefaultMaxSize by default
+func WithStorage(s Storage) optSetter {
+	return func(c *Cache) error {
+		c.storage = s
+		return nil
+	}
+}
+
+// MaxEntrySize sets the maximum size of the bodies of the stored responses, in bytes
+func MaxEntrySize(size int64) optSetter {
+	return func(c *Cache) error {
+		if size < 0 {
+			return fmt.Errorf("max entry size should be >= 0")
+		}
+		c.maxEntrySize = size
+		return nil
+	}
+}
+
+// SurrogateKeyHeader sets the response header listing the space separated surrogate keys of the responses,
+// the header is removed from the responses sent to the clients
+func SurrogateKeyHeader(name string) optSetter {
+	return func(c *Cache) error {
+		c.surrogateKeyHeader = http.CanonicalHeaderKey(name)
+		return nil
+	}
+}
+
+// StaleWhileRevalidate sets how long stale responses are served while they are revalidated in the background,
+// for the responses without the stale-while-revalidate directive
+func StaleWhileRevalidate(d time.Duration) optSetter {
+	return func(c *Cache) error {
+		c.staleWhileRevalidate = d
+		return nil
+	}
+}
+
+// StaleIfError sets how long stale responses are served when their revalidation fails with a server error,
+// for the responses without the stale-if-error directive
+func StaleIfError(d time.Duration) optSetter {
+	return func(c *Cache) error {
+		c.staleIfError = d
+		return nil
+	}
+}
+
+// Clock sets the clock of the cache, it is used to compute the age of the responses
+func Clock(clock timetools.TimeProvider) optSetter {
+	return func(c *Cache) error {
+		c.clock = clock
+		return nil
+	}
+}
+
+type optSetter func(c *Cache) error
+
+// Wrap sets the next handler to be called by cache handler.
+func (c *Cache) Wrap(next http.Handler) error {
+	c.next = next
+	return nil
+}
+
+func (c *Cache) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if c.log.Level >= log.DebugLevel {
+		logEntry := c.log.WithField("Request", utils.DumpHttpRequest(req))
+		logEntry.Debug("vulcand/oxy/cache: begin ServeHttp on request")
+		defer logEntry.Debug("vulcand/oxy/cache: completed ServeHttp on request")
+	}
+
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		c.serveUnsafe(w, req)
+		return
+	}
+
+	reqCC := parseCacheControl(req.Header)
+	if reqCC.has(directiveNoStore) || req.Header.Get("Range") != "" || req.Header.Get("Upgrade") != "" {
+		c.next.ServeHTTP(w, req)
+		return
+	}
+
+	e := c.lookup(req)
+	if e == nil {
+		if reqCC.has(directiveOnlyIfCached) {
+			w.WriteHeader(http.StatusGatewayTimeout)
+			return
+		}
+		c.fetch(w, req)
+		return
+	}
+
+	age := currentAge(e, c.clock.UtcNow())
+	lifetime := freshnessLifetime(e)
+	respCC := parseCacheControl(e.Header)
+
+	if fresh(reqCC, respCC, age, lifetime) {
+		c.serveEntry(w, req, e, age, StateHit, "")
+		return
+	}
+
+	if reqCC.has(directiveOnlyIfCached) {
+		w.WriteHeader(http.StatusGatewayTimeout)
+		return
+	}
+
+	if c.staleAllowed(reqCC, respCC, directiveStaleWhileRevalidate, c.staleWhileRevalidate, age-lifetime) {
+		c.revalidateInBackground(req, e)
+		c.serveEntry(w, req, e, age, StateStale, warningStale)
+		return
+	}
+
+	c.revalidate(w, req, e, c.staleAllowed(reqCC, respCC, directiveStaleIfError, c.staleIfError, age-lifetime))
+}
+
+// PurgeURL removes the stored responses of the URL, all their variants included, and returns their number
+func (c *Cache) PurgeURL(rawURL string) (int, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return 0, err
+	}
+	if u.Scheme == "" {
+		u.Scheme = "http"
+	}
+	target := u.Scheme + "://" + strings.ToLower(u.Host) + u.RequestURI()
+	return c.purge(func(e *Entry) bool { return e.URL == target }), nil
+}
+
+// PurgeTag removes the stored responses with the surrogate key and returns their number
+func (c *Cache) PurgeTag(tag string) int {
+	return c.purge(func(e *Entry) bool { return e.hasTag(tag) })
+}
+
+func (c *Cache) purge(match func(e *Entry) bool) int {
+	var keys []string
+	count := 0
+	c.storage.Range(func(key string, e *Entry) bool {
+		if match(e) {
+			keys = append(keys, key)
+			// the records of the Vary headers are not responses
+			if len(e.Vary) == 0 {
+				count++
+			}
+		}
+		return true
+	})
+
+	for _, key := range keys {
+		c.storage.Delete(key)
+	}
+	return count
+}
+
+// lookup returns the stored response matching the request, nil if none
+func (c *Cache) lookup(req *http.Request) *Entry {
+	key := primaryKey(req)
+	e, ok := c.storage.Get(key)
+	if !ok {
+		return nil
+	}
+	if len(e.Vary) == 0 {
+		return e
+	}
+
+	e, ok = c.storage.Get(variantKey(key, e.Vary, req.Header))
+	if !ok {
+		return nil
+	}
+	return e
+}
+
+// fetch forwards the request to the next handler and stores the response when it is cacheable
+func (c *Cache) fetch(w http.ResponseWriter, req *http.Request) {
+	requestTime := c.clock.UtcNow()
+	rw := newResponseWriter(w, c.maxEntrySize)
+
+	var stored *Entry
+	rw.onHeader = func(h http.Header) {
+		stored = c.newEntry(req, rw.code, h, requestTime)
+		h.Del(c.surrogateKeyHeader)
+		h.Set(XCache, StateMiss)
+	}
+
+	c.next.ServeHTTP(rw, req)
+	if !rw.wroteHeader {
+		rw.WriteHeader(http.StatusOK)
+	}
+
+	if stored == nil || rw.overflow || req.Method != http.MethodGet || !storable(req, rw.statusCode(), stored.Header) {
+		return
+	}
+	stored.Body = rw.body
+	stored.ResponseTime = c.clock.UtcNow()
+	c.store(req, stored)
+}
+
+// revalidate sends a conditional request for the stored response to the next handler,
+// the stored response is served if it is still valid, or if the revalidation fails and stale is true
+func (c *Cache) revalidate(w http.ResponseWriter, req *http.Request, e *Entry, stale bool) {
+	outReq := conditionalRequest(req.Context(), req, e)
+	requestTime := c.clock.UtcNow()
+
+	rw := newResponseWriter(w, c.maxEntrySize)
+	rw.intercept = func(code int) bool {
+		return code == http.StatusNotModified || (stale && code >= http.StatusInternalServerError)
+	}
+
+	var stored *Entry
+	rw.onHeader = func(h http.Header) {
+		stored = c.newEntry(outReq, rw.code, h, requestTime)
+		h.Del(c.surrogateKeyHeader)
+		h.Set(XCache, StateMiss)
+	}
+
+	c.next.ServeHTTP(rw, outReq)
+	if !rw.wroteHeader {
+		rw.WriteHeader(http.StatusOK)
+	}
+	responseTime := c.clock.UtcNow()
+
+	var header http.Header
+	if rw.intercepted {
+		// the intercepted response wrote its headers to the client ones
+		header = rw.header.Clone()
+		for name := range w.Header() {
+			delete(w.Header(), name)
+		}
+	}
+
+	switch {
+	case rw.intercepted && rw.code == http.StatusNotModified:
+		updated := c.updateEntry(e, header, requestTime, responseTime)
+		c.store(outReq, updated)
+		c.serveEntry(w, req, updated, currentAge(updated, responseTime), StateRevalidated, "")
+	case rw.intercepted:
+		c.log.Warnf("vulcand/oxy/cache: revalidation of %v failed with status %d, serving the stale response", e.URL, rw.code)
+		c.serveEntry(w, req, e, currentAge(e, responseTime), StateStale, warningRevalidationFailed)
+	case stored != nil && !rw.overflow && storable(outReq, rw.statusCode(), stored.Header):
+		stored.Body = rw.body
+		stored.ResponseTime = responseTime
+		c.store(outReq, stored)
+	}
+}
+
+// revalidateInBackground revalidates the stored response, once at a time per URL and variant
+func (c *Cache) revalidateInBackground(req *http.Request, e *Entry) {
+	key := primaryKey(req)
+	if names := varyNames(e.Header); len(names) > 0 {
+		key = variantKey(key, names, req.Header)
+	}
+
+	c.mutex.Lock()
+	if c.revalidating[key] {
+		c.mutex.Unlock()
+		return
+	}
+	c.revalidating[key] = true
+	c.mutex.Unlock()
+
+	outReq := conditionalRequest(context.Background(), req, e)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				c.log.Errorf("vulcand/oxy/cache: background revalidation of %v panicked: %v", e.URL, r)
+			}
+			c.mutex.Lock()
+			delete(c.revalidating, key)
+			c.mutex.Unlock()
+		}()
+
+		requestTime := c.clock.UtcNow()
+		rw := newResponseWriter(nil, c.maxEntrySize)
+		c.next.ServeHTTP(rw, outReq)
+		responseTime := c.clock.UtcNow()
+
+		switch code := rw.statusCode(); {
+		case code == http.StatusNotModified:
+			c.store(outReq, c.updateEntry(e, rw.header, requestTime, responseTime))
+		case !rw.overflow && storable(outReq, code, rw.header):
+			stored := c.newEntry(outReq, code, rw.header, requestTime)
+			stored.Body = rw.body
+			stored.ResponseTime = responseTime
+			c.store(outReq, stored)
+		}
+	}()
+}
+
+// serveUnsafe forwards the requests with unsafe methods, their successful responses invalidate the stored responses
+// of the request URL, and of the Location and Content-Location URLs of the same host, RFC 7234 section 4.4
+func (c *Cache) serveUnsafe(w http.ResponseWriter, req *http.Request) {
+	pw := utils.NewProxyWriterWithLogger(w, c.log)
+	c.next.ServeHTTP(pw, req)
+
+	if req.Method == http.MethodOptions || req.Method == http.MethodTrace {
+		return
+	}
+	if code := pw.StatusCode(); code < http.StatusOK || code >= http.StatusBadRequest {
+		return
+	}
+
+	key := primaryKey(req)
+	c.purge(func(e *Entry) bool { return e.URL == key })
+
+	base, err := url.Parse(key)
+	if err != nil {
+		return
+	}
+	for _, name := range []string{"Location", "Content-Location"} {
+		ref, err := url.Parse(pw.Header().Get(name))
+		if err != nil || pw.Header().Get(name) == "" {
+			continue
+		}
+		u := base.ResolveReference(ref)
+		if strings.EqualFold(u.Host, base.Host) {
+			target := u.Scheme + "://" + strings.ToLower(u.Host) + u.RequestURI()
+			c.purge(func(e *Entry) bool { return e.URL == target })
+		}
+	}
+}
+
+// newEntry returns the entry of the response to store, without body
+func (c *Cache) newEntry(req *http.Request, code int, h http.Header, requestTime time.Time) *Entry {
+	header := h.Clone()
+	utils.RemoveConnectionHeaders(header)
+	for _, name := range hopHeaders {
+		header.Del(name)
+	}
+	header.Del(XCache)
+	header.Del(c.surrogateKeyHeader)
+
+	return &Entry{
+		URL:          primaryKey(req),
+		StatusCode:   code,
+		Header:       header,
+		RequestTime:  requestTime,
+		ResponseTime: requestTime,
+		Tags:         strings.Fields(strings.Join(h[c.surrogateKeyHeader], " ")),
+	}
+}
+
+// updateEntry returns a copy of the stored response updated with the headers of a 304 response, RFC 7234 section 4.3.4
+func (c *Cache) updateEntry(e *Entry, h http.Header, requestTime, responseTime time.Time) *Entry {
+	updated := *e
+	updated.Header = e.Header.Clone()
+	updated.RequestTime = requestTime
+	updated.ResponseTime = responseTime
+
+	for name, values := range h {
+		switch name {
+		case "Content-Length", "Content-Type", "Content-Encoding", XCache:
+			continue
+		case c.surrogateKeyHeader:
+			updated.Tags = strings.Fields(strings.Join(values, " "))
+			continue
+		}
+		updated.Header[name] = values
+	}
+	for _, name := range hopHeaders {
+		updated.Header.Del(name)
+	}
+	return &updated
+}
+
+// store stores the response, and the Vary headers selecting it if any
+func (c *Cache) store(req *http.Request, e *Entry) {
+	if len(e.Body) > 0 && int64(len(e.Body)) > c.maxEntrySize {
+		return
+	}
+
+	if freshnessLifetime(e) == 0 && e.Header.Get("Etag") == "" && e.Header.Get("Last-Modified") == "" {
+		// the response could neither be served fresh nor revalidated
+		return
+	}
+
+	if e.Header.Get("Date") == "" {
+		e.Header.Set("Date", e.ResponseTime.UTC().Format(http.TimeFormat))
+	}
+
+	key := primaryKey(req)
+	if names := varyNames(e.Header); len(names) > 0 {
+		if err := c.storage.Set(key, &Entry{URL: e.URL, Tags: e.Tags, Vary: names, ResponseTime: e.ResponseTime}); err != nil {
+			c.log.Errorf("vulcand/oxy/cache: failed to store the Vary headers of %v: %v", e.URL, err)
+			return
+		}
+		key = variantKey(key, names, req.Header)
+	}
+
+	if err := c.storage.Set(key, e); err != nil {
+		c.log.Errorf("vulcand/oxy/cache: failed to store the response of %v: %v", e.URL, err)
+	}
+}
+
+// serveEntry writes the stored response, or a 304 response if it matches the conditional headers of the request
+func (c *Cache) serveEntry(w http.ResponseWriter, req *http.Request, e *Entry, age time.Duration, state, warning string) {
+	h := w.Header()
+	for name, values := range e.Header {
+		h[name] = append([]string(nil), values...)
+	}
+	h.Set("Age", strconv.FormatInt(int64(age/time.Second), 10))
+	h.Set(XCache, state)
+	if warning != "" {
+		h.Add("Warning", warning)
+	}
+
+	if notModified(req, e) {
+		h.Del("Content-Length")
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	if e.StatusCode != http.StatusNoContent {
+		h.Set("Content-Length", strconv.Itoa(len(e.Body)))
+	}
+	w.WriteHeader(e.StatusCode)
+	if req.Method != http.MethodHead {
+		w.Write(e.Body)
+	}
+}
+
+// fresh reports whether the stored response can be served without revalidation, RFC 7234 section 4.2
+func fresh(reqCC, respCC cacheControl, age, lifetime time.Duration) bool {
+	if reqCC.has(directiveNoCache) || respCC.has(directiveNoCache) {
+		return false
+	}
+	if maxAge, ok := reqCC.seconds(directiveMaxAge); ok && age > maxAge {
+		return false
+	}
+	if minFresh, ok := reqCC.seconds(directiveMinFresh); ok && lifetime-age < minFresh {
+		return false
+	}
+	if age < lifetime {
+		return true
+	}
+
+	// the client accepts stale responses
+	if !reqCC.has(directiveMaxStale) || mustRevalidate(respCC) {
+		return false
+	}
+	maxStale, ok := reqCC.seconds(directiveMaxStale)
+	return !ok || age-lifetime <= maxStale
+}
+
+// staleAllowed reports whether the stale response can be served for the extension directive, RFC 5861
+func (c *Cache) staleAllowed(reqCC, respCC cacheControl, directive string, defaultWindow, staleness time.Duration) bool {
+	if staleness < 0 || reqCC.has(directiveNoCache) || respCC.has(directiveNoCache) || mustRevalidate(respCC) {
+		return false
+	}
+
+	window := defaultWindow
+	if d, ok := respCC.seconds(directive); ok {
+		window = d
+	}
+	if d, ok := reqCC.seconds(directive); ok && directive == directiveStaleIfError {
+		window = d
+	}
+	return staleness <= window && window > 0
+}
+
+// mustRevalidate reports whether the stale response must not be served without revalidation
+func mustRevalidate(respCC cacheControl) bool {
+	return respCC.has(directiveMustRevalidate) || respCC.has(directiveProxyRevalidate) || respCC.has(directiveSMaxAge)
+}
+
+// notModified evaluates the conditional headers of the request against the stored response, RFC 7232 section 6
+func notModified(req *http.Request, e *Entry) bool {
+	if e.StatusCode != http.StatusOK {
+		return false
+	}
+
+	if inm := req.Header.Get("If-None-Match"); inm != "" {
+		etag := strings.TrimPrefix(e.Header.Get("Etag"), "W/")
+		if etag == "" {
+			return false
+		}
+		for _, candidate := range strings.Split(inm, ",") {
+			candidate = strings.TrimSpace(candidate)
+			if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+				return true
+			}
+		}
+		return false
+	}
+
+	ims, err := http.ParseTime(req.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	lastModified, err := http.ParseTime(e.Header.Get("Last-Modified"))
+	if err != nil {
+		lastModified = e.date()
+	}
+	return !lastModified.After(ims)
+}
+
+// conditionalRequest returns the request revalidating the stored response with its validators
+func conditionalRequest(ctx context.Context, req *http.Request, e *Entry) *http.Request {
+	outReq := req.Clone(ctx)
+	// the response of the revalidation is stored, it has to be complete
+	outReq.Method = http.MethodGet
+	for _, name := range conditionalHeaders {
+		outReq.Header.Del(name)
+	}
+
+	if etag := e.Header.Get("Etag"); etag != "" {
+		outReq.Header.Set("If-None-Match", etag)
+	}
+	if lastModified := e.Header.Get("Last-Modified"); lastModified != "" {
+		outReq.Header.Set("If-Modified-Since", lastModified)
+	}
+	return outReq
+}
+
+// primaryKey returns the effective URL of the request, the primary cache key
+func primaryKey(req *http.Request) string {
+	scheme := req.URL.Scheme
+	if scheme == "" {
+		scheme = "http"
+		if req.TLS != nil {
+			scheme = "https"
+		}
+	}
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	return scheme + "://" + strings.ToLower(host) + req.URL.RequestURI()
+}
+
+// variantKey returns the key of the variant of the URL selected by the request headers
+func variantKey(key string, names []string, h http.Header) string {
+	var b strings.Builder
+	b.WriteString(key)
+	for _, name := range names {
+		values := make([]string, 0, len(h[name]))
+		for _, value := range h[name] {
+			values = append(values, strings.Join(strings.Fields(value), " "))
+		}
+		b.WriteString("\x00")
+		b.WriteString(name)
+		b.WriteString(":")
+		b.WriteString(strings.Join(values, ","))
+	}
+	return b.String()
+}
+
+// varyNames returns the canonical names of the request headers listed by the Vary headers, sorted
+func varyNames(h http.Header) []string {
+	var names []string
+	seen := make(map[string]bool)
+	for _, value := range h["Vary"] {
+		for _, name := range strings.Split(value, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			if name != "" && !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
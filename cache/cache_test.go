@@ -0,0 +1,414 @@
+package cache
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/forward"
+	"github.com/vulcand/oxy/testutils"
+)
+
+func TestCacheHitMiss(t *testing.T) {
+	var calls int32
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		n := atomic.AddInt32(&calls, 1)
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Surrogate-Key", "a b")
+		w.Write([]byte("hello " + strconv.Itoa(int(n))))
+	})
+
+	clock := testutils.GetClock()
+	c, err := New(handler, Clock(clock))
+	require.NoError(t, err)
+
+	rw := serve(c, http.MethodGet, "/", nil)
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, StateMiss, rw.Header().Get(XCache))
+	assert.Empty(t, rw.Header().Get("Surrogate-Key"))
+	assert.Equal(t, "hello 1", rw.Body.String())
+
+	clock.CurrentTime = clock.CurrentTime.Add(30 * time.Second)
+	rw = serve(c, http.MethodGet, "/", nil)
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, StateHit, rw.Header().Get(XCache))
+	assert.Equal(t, "30", rw.Header().Get("Age"))
+	assert.Empty(t, rw.Header().Get("Surrogate-Key"))
+	assert.Equal(t, "hello 1", rw.Body.String())
+
+	rw = serve(c, http.MethodHead, "/", nil)
+	assert.Equal(t, StateHit, rw.Header().Get(XCache))
+	assert.Equal(t, "7", rw.Header().Get("Content-Length"))
+	assert.Empty(t, rw.Body.String())
+
+	clock.CurrentTime = clock.CurrentTime.Add(31 * time.Second)
+	rw = serve(c, http.MethodGet, "/", nil)
+	assert.Equal(t, StateMiss, rw.Header().Get(XCache))
+	assert.Equal(t, "hello 2", rw.Body.String())
+	assert.EqualValues(t, 2, atomic.LoadInt32(&calls))
+}
+
+func TestCacheNotStored(t *testing.T) {
+	testCases := []struct {
+		desc          string
+		method        string
+		requestHeader http.Header
+		header        http.Header
+		code          int
+	}{
+		{
+			desc:   "no-store",
+			header: http.Header{"Cache-Control": {"no-store"}},
+		},
+		{
+			desc:   "private",
+			header: http.Header{"Cache-Control": {"private, max-age=60"}},
+		},
+		{
+			desc:   "set cookie",
+			header: http.Header{"Cache-Control": {"max-age=60"}, "Set-Cookie": {"a=b"}},
+		},
+		{
+			desc:   "no freshness",
+			header: http.Header{},
+		},
+		{
+			desc:   "not cacheable by default",
+			header: http.Header{"Last-Modified": {"Sun, 04 Mar 2012 04:06:07 GMT"}},
+			code:   http.StatusInternalServerError,
+		},
+		{
+			desc:          "request no-store",
+			requestHeader: http.Header{"Cache-Control": {"no-store"}},
+			header:        http.Header{"Cache-Control": {"max-age=60"}},
+		},
+		{
+			desc:          "authorization",
+			requestHeader: http.Header{"Authorization": {"Basic YTpi"}},
+			header:        http.Header{"Cache-Control": {"max-age=60"}},
+		},
+		{
+			desc:   "post",
+			method: http.MethodPost,
+			header: http.Header{"Cache-Control": {"max-age=60"}},
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			var calls int32
+			handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				atomic.AddInt32(&calls, 1)
+				for name, values := range test.header {
+					w.Header()[name] = values
+				}
+				if test.code != 0 {
+					w.WriteHeader(test.code)
+				}
+				w.Write([]byte("hello"))
+			})
+
+			c, err := New(handler, Clock(testutils.GetClock()))
+			require.NoError(t, err)
+
+			method := test.method
+			if method == "" {
+				method = http.MethodGet
+			}
+			serve(c, method, "/", test.requestHeader)
+			rw := serve(c, method, "/", test.requestHeader)
+			assert.NotEqual(t, StateHit, rw.Header().Get(XCache))
+			assert.Equal(t, "hello", rw.Body.String())
+			assert.EqualValues(t, 2, atomic.LoadInt32(&calls))
+		})
+	}
+}
+
+func TestCacheVary(t *testing.T) {
+	var calls int32
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Vary", "Accept-Language")
+		w.Write([]byte("hello " + req.Header.Get("Accept-Language")))
+	})
+
+	c, err := New(handler, Clock(testutils.GetClock()))
+	require.NoError(t, err)
+
+	for i := 0; i < 2; i++ {
+		rw := serve(c, http.MethodGet, "/", http.Header{"Accept-Language": {"en"}})
+		assert.Equal(t, "hello en", rw.Body.String())
+		rw = serve(c, http.MethodGet, "/", http.Header{"Accept-Language": {"fr"}})
+		assert.Equal(t, "hello fr", rw.Body.String())
+	}
+	assert.EqualValues(t, 2, atomic.LoadInt32(&calls))
+
+	count, err := c.PurgeURL("http://example.com/")
+	require.NoError(t, err)
+	assert.Equal(t, 2, count)
+}
+
+func TestCacheRevalidate(t *testing.T) {
+	clock := testutils.GetClock()
+
+	var calls, notModified int32
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.Header().Set("Date", clock.UtcNow().Format(http.TimeFormat))
+		w.Header().Set("Cache-Control", "max-age=10")
+		w.Header().Set("Etag", `"v1"`)
+		if req.Header.Get("If-None-Match") == `"v1"` {
+			atomic.AddInt32(&notModified, 1)
+			w.Header().Set("Cache-Control", "max-age=20")
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Write([]byte("hello"))
+	})
+
+	c, err := New(handler, Clock(clock))
+	require.NoError(t, err)
+
+	serve(c, http.MethodGet, "/", nil)
+
+	clock.CurrentTime = clock.CurrentTime.Add(15 * time.Second)
+	rw := serve(c, http.MethodGet, "/", nil)
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, StateRevalidated, rw.Header().Get(XCache))
+	assert.Equal(t, "max-age=20", rw.Header().Get("Cache-Control"))
+	assert.Equal(t, "hello", rw.Body.String())
+
+	clock.CurrentTime = clock.CurrentTime.Add(15 * time.Second)
+	rw = serve(c, http.MethodGet, "/", nil)
+	assert.Equal(t, StateHit, rw.Header().Get(XCache))
+	assert.Equal(t, "hello", rw.Body.String())
+
+	rw = serve(c, http.MethodGet, "/", http.Header{"If-None-Match": {`W/"v1"`}})
+	assert.Equal(t, http.StatusNotModified, rw.Code)
+	assert.Empty(t, rw.Body.String())
+
+	rw = serve(c, http.MethodGet, "/", http.Header{"Cache-Control": {"no-cache"}})
+	assert.Equal(t, StateRevalidated, rw.Header().Get(XCache))
+
+	assert.EqualValues(t, 3, atomic.LoadInt32(&calls))
+	assert.EqualValues(t, 2, atomic.LoadInt32(&notModified))
+}
+
+func TestCacheStaleWhileRevalidate(t *testing.T) {
+	var calls int32
+	revalidated := make(chan struct{}, 1)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		n := atomic.AddInt32(&calls, 1)
+		w.Header().Set("Cache-Control", "max-age=10, stale-while-revalidate=30")
+		w.Write([]byte("hello " + strconv.Itoa(int(n))))
+		if n > 1 {
+			select {
+			case revalidated <- struct{}{}:
+			default:
+			}
+		}
+	})
+
+	clock := testutils.GetClock()
+	c, err := New(handler, Clock(clock))
+	require.NoError(t, err)
+
+	serve(c, http.MethodGet, "/", nil)
+
+	clock.CurrentTime = clock.CurrentTime.Add(20 * time.Second)
+	rw := serve(c, http.MethodGet, "/", nil)
+	assert.Equal(t, StateStale, rw.Header().Get(XCache))
+	assert.Equal(t, `110 - "Response is Stale"`, rw.Header().Get("Warning"))
+	assert.Equal(t, "hello 1", rw.Body.String())
+
+	select {
+	case <-revalidated:
+	case <-time.After(time.Second):
+		t.Fatal("the response was not revalidated")
+	}
+
+	assert.Eventually(t, func() bool {
+		rw = serve(c, http.MethodGet, "/", nil)
+		return rw.Header().Get(XCache) == StateHit
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, "hello 2", rw.Body.String())
+}
+
+func TestCacheStaleIfError(t *testing.T) {
+	var fail int32
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if atomic.LoadInt32(&fail) == 1 {
+			w.Header().Set("X-Failed", "true")
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.Header().Set("Cache-Control", "max-age=10")
+		w.Write([]byte("hello"))
+	})
+
+	clock := testutils.GetClock()
+	c, err := New(handler, Clock(clock), StaleIfError(time.Minute))
+	require.NoError(t, err)
+
+	serve(c, http.MethodGet, "/", nil)
+	atomic.StoreInt32(&fail, 1)
+
+	clock.CurrentTime = clock.CurrentTime.Add(30 * time.Second)
+	rw := serve(c, http.MethodGet, "/", nil)
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, StateStale, rw.Header().Get(XCache))
+	assert.Equal(t, `111 - "Revalidation Failed"`, rw.Header().Get("Warning"))
+	assert.Empty(t, rw.Header().Get("X-Failed"))
+	assert.Equal(t, "hello", rw.Body.String())
+
+	clock.CurrentTime = clock.CurrentTime.Add(time.Minute)
+	rw = serve(c, http.MethodGet, "/", nil)
+	assert.Equal(t, http.StatusBadGateway, rw.Code)
+}
+
+func TestCacheOnlyIfCached(t *testing.T) {
+	c, err := New(http.NotFoundHandler(), Clock(testutils.GetClock()))
+	require.NoError(t, err)
+
+	rw := serve(c, http.MethodGet, "/", http.Header{"Cache-Control": {"only-if-cached"}})
+	assert.Equal(t, http.StatusGatewayTimeout, rw.Code)
+}
+
+func TestCacheInvalidation(t *testing.T) {
+	var calls int32
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		switch req.Method {
+		case http.MethodPost:
+			w.Header().Set("Location", "/b")
+			w.WriteHeader(http.StatusCreated)
+		default:
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Header().Set("Surrogate-Key", "all "+req.URL.Path)
+			w.Write([]byte(req.URL.Path))
+		}
+	})
+
+	c, err := New(handler, Clock(testutils.GetClock()))
+	require.NoError(t, err)
+
+	for _, path := range []string{"/a", "/b", "/c"} {
+		serve(c, http.MethodGet, path, nil)
+	}
+
+	rw := serve(c, http.MethodPost, "/a", nil)
+	assert.Equal(t, http.StatusCreated, rw.Code)
+
+	assert.Equal(t, StateMiss, serve(c, http.MethodGet, "/a", nil).Header().Get(XCache))
+	assert.Equal(t, StateMiss, serve(c, http.MethodGet, "/b", nil).Header().Get(XCache))
+	assert.Equal(t, StateHit, serve(c, http.MethodGet, "/c", nil).Header().Get(XCache))
+
+	assert.Equal(t, 1, c.PurgeTag("/c"))
+	assert.Equal(t, 2, c.PurgeTag("all"))
+	assert.Equal(t, 0, c.PurgeTag("all"))
+	assert.EqualValues(t, 6, atomic.LoadInt32(&calls))
+}
+
+func TestCacheMaxEntrySize(t *testing.T) {
+	var calls int32
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("hello world"))
+	})
+
+	c, err := New(handler, Clock(testutils.GetClock()), MaxEntrySize(5))
+	require.NoError(t, err)
+
+	serve(c, http.MethodGet, "/", nil)
+	rw := serve(c, http.MethodGet, "/", nil)
+	assert.Equal(t, StateMiss, rw.Header().Get(XCache))
+	assert.Equal(t, "hello world", rw.Body.String())
+	assert.EqualValues(t, 2, atomic.LoadInt32(&calls))
+
+	_, err = New(handler, MaxEntrySize(-1))
+	require.Error(t, err)
+}
+
+func TestCacheDiskStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "oxy-cache")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	var calls int32
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("hello"))
+	})
+
+	storage, err := NewDiskStorage(dir, 1024*1024)
+	require.NoError(t, err)
+	c, err := New(handler, Clock(testutils.GetClock()), WithStorage(storage))
+	require.NoError(t, err)
+	serve(c, http.MethodGet, "/", nil)
+
+	// a new storage loads the stored responses
+	storage, err = NewDiskStorage(dir, 1024*1024)
+	require.NoError(t, err)
+	c, err = New(handler, Clock(testutils.GetClock()), WithStorage(storage))
+	require.NoError(t, err)
+
+	rw := serve(c, http.MethodGet, "/", nil)
+	assert.Equal(t, StateHit, rw.Header().Get(XCache))
+	assert.Equal(t, "hello", rw.Body.String())
+	assert.EqualValues(t, 1, atomic.LoadInt32(&calls))
+}
+
+func TestCacheWithForwarder(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("hello"))
+	}))
+	defer srv.Close()
+
+	fwd, err := forward.New()
+	require.NoError(t, err)
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		fwd.ServeHTTP(w, req)
+	})
+	c, err := New(handler)
+	require.NoError(t, err)
+
+	proxy := httptest.NewServer(c)
+	defer proxy.Close()
+
+	for _, state := range []string{StateMiss, StateHit} {
+		re, body, err := testutils.Get(proxy.URL)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, re.StatusCode)
+		assert.Equal(t, state, re.Header.Get(XCache))
+		assert.Equal(t, "hello", string(body))
+	}
+	assert.EqualValues(t, 1, atomic.LoadInt32(&calls))
+}
+
+func serve(h http.Handler, method, path string, header http.Header) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, nil)
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, req)
+	return rw
+}
@@ -0,0 +1,174 @@
+package cache
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Cache-Control directives
+const (
+	directiveNoStore              = "no-store"
+	directiveNoCache              = "no-cache"
+	directivePrivate              = "private"
+	directivePublic               = "public"
+	directiveMaxAge               = "max-age"
+	directiveSMaxAge              = "s-maxage"
+	directiveMaxStale             = "max-stale"
+	directiveMinFresh             = "min-fresh"
+	directiveOnlyIfCached         = "only-if-cached"
+	directiveMustRevalidate       = "must-revalidate"
+	directiveProxyRevalidate      = "proxy-revalidate"
+	directiveNoTransform          = "no-transform"
+	directiveStaleWhileRevalidate = "stale-while-revalidate"
+	directiveStaleIfError         = "stale-if-error"
+)
+
+// maxHeuristicLifetime caps the freshness lifetime computed from Last-Modified
+const maxHeuristicLifetime = 24 * time.Hour
+
+// cacheControl holds the directives of Cache-Control headers, the values of the directives without argument are empty
+type cacheControl map[string]string
+
+func parseCacheControl(h http.Header) cacheControl {
+	cc := cacheControl{}
+	for _, value := range h["Cache-Control"] {
+		for _, item := range strings.Split(value, ",") {
+			item = strings.TrimSpace(item)
+			if item == "" {
+				continue
+			}
+
+			name, arg := item, ""
+			if eq := strings.Index(item, "="); eq >= 0 {
+				name, arg = strings.TrimSpace(item[:eq]), strings.Trim(strings.TrimSpace(item[eq+1:]), `"`)
+			}
+			cc[strings.ToLower(name)] = arg
+		}
+	}
+
+	// Pragma: no-cache is the HTTP/1.0 no-cache request directive
+	if _, ok := cc[directiveNoCache]; !ok && len(h["Cache-Control"]) == 0 && strings.EqualFold(strings.TrimSpace(h.Get("Pragma")), directiveNoCache) {
+		cc[directiveNoCache] = ""
+	}
+	return cc
+}
+
+func (cc cacheControl) has(directive string) bool {
+	_, ok := cc[directive]
+	return ok
+}
+
+// seconds returns the delta-seconds argument of the directive, false if it is missing or invalid
+func (cc cacheControl) seconds(directive string) (time.Duration, bool) {
+	arg, ok := cc[directive]
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return time.Duration(n) * time.Second, true
+}
+
+// heuristicStatusCodes are the status codes cacheable without explicit freshness, RFC 7231 section 6.1
+var heuristicStatusCodes = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusNoContent:            true,
+	http.StatusMultipleChoices:      true,
+	http.StatusMovedPermanently:     true,
+	http.StatusPermanentRedirect:    true,
+	http.StatusNotFound:             true,
+	http.StatusMethodNotAllowed:     true,
+	http.StatusGone:                 true,
+	http.StatusRequestURITooLong:    true,
+	http.StatusNotImplemented:       true,
+}
+
+// storable reports whether a shared cache may store the response to the request, RFC 7234 section 3
+func storable(req *http.Request, code int, h http.Header) bool {
+	if req.Method != http.MethodGet {
+		return false
+	}
+
+	reqCC, respCC := parseCacheControl(req.Header), parseCacheControl(h)
+	if reqCC.has(directiveNoStore) || respCC.has(directiveNoStore) || respCC.has(directivePrivate) {
+		return false
+	}
+
+	switch {
+	case code < http.StatusOK, code == http.StatusPartialContent, code == http.StatusNotModified:
+		return false
+	case h.Get("Vary") == "*", len(h["Set-Cookie"]) > 0:
+		return false
+	}
+
+	if req.Header.Get("Authorization") != "" &&
+		!respCC.has(directivePublic) && !respCC.has(directiveMustRevalidate) && !respCC.has(directiveSMaxAge) {
+		return false
+	}
+
+	if _, ok := respCC.seconds(directiveSMaxAge); ok {
+		return true
+	}
+	if _, ok := respCC.seconds(directiveMaxAge); ok {
+		return true
+	}
+	if h.Get("Expires") != "" || respCC.has(directivePublic) {
+		return true
+	}
+	return heuristicStatusCodes[code]
+}
+
+// freshnessLifetime returns the freshness lifetime of a stored response, RFC 7234 section 4.2.1
+func freshnessLifetime(e *Entry) time.Duration {
+	cc := parseCacheControl(e.Header)
+	if d, ok := cc.seconds(directiveSMaxAge); ok {
+		return d
+	}
+	if d, ok := cc.seconds(directiveMaxAge); ok {
+		return d
+	}
+
+	date := e.date()
+	if expires := e.Header.Get("Expires"); expires != "" {
+		t, err := http.ParseTime(expires)
+		if err != nil || !t.After(date) {
+			// invalid dates represent a time in the past
+			return 0
+		}
+		return t.Sub(date)
+	}
+
+	if lastModified, err := http.ParseTime(e.Header.Get("Last-Modified")); err == nil && heuristicStatusCodes[e.StatusCode] && date.After(lastModified) {
+		lifetime := date.Sub(lastModified) / 10
+		if lifetime > maxHeuristicLifetime {
+			lifetime = maxHeuristicLifetime
+		}
+		return lifetime
+	}
+	return 0
+}
+
+// currentAge returns the age of a stored response, RFC 7234 section 4.2.3
+func currentAge(e *Entry, now time.Time) time.Duration {
+	apparentAge := e.ResponseTime.Sub(e.date())
+	if apparentAge < 0 {
+		apparentAge = 0
+	}
+
+	var ageValue time.Duration
+	if n, err := strconv.ParseInt(e.Header.Get("Age"), 10, 64); err == nil && n > 0 {
+		ageValue = time.Duration(n) * time.Second
+	}
+	correctedAgeValue := ageValue + e.ResponseTime.Sub(e.RequestTime)
+
+	initialAge := apparentAge
+	if correctedAgeValue > initialAge {
+		initialAge = correctedAgeValue
+	}
+	return initialAge + now.Sub(e.ResponseTime)
+}
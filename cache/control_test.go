@@ -0,0 +1,155 @@
+package cache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFreshnessLifetime(t *testing.T) {
+	date := time.Date(2012, 3, 4, 5, 6, 7, 0, time.UTC)
+
+	testCases := []struct {
+		desc     string
+		header   http.Header
+		expected time.Duration
+	}{
+		{
+			desc:     "s-maxage",
+			header:   http.Header{"Cache-Control": {"max-age=10, s-maxage=20"}},
+			expected: 20 * time.Second,
+		},
+		{
+			desc:     "max-age",
+			header:   http.Header{"Cache-Control": {"max-age=10"}, "Expires": {date.Add(time.Hour).Format(http.TimeFormat)}},
+			expected: 10 * time.Second,
+		},
+		{
+			desc:     "expires",
+			header:   http.Header{"Expires": {date.Add(time.Hour).Format(http.TimeFormat)}},
+			expected: time.Hour,
+		},
+		{
+			desc:     "invalid expires",
+			header:   http.Header{"Expires": {"0"}},
+			expected: 0,
+		},
+		{
+			desc:     "last modified heuristic",
+			header:   http.Header{"Last-Modified": {date.Add(-10 * time.Hour).Format(http.TimeFormat)}},
+			expected: time.Hour,
+		},
+		{
+			desc:     "capped heuristic",
+			header:   http.Header{"Last-Modified": {date.Add(-1000 * time.Hour).Format(http.TimeFormat)}},
+			expected: 24 * time.Hour,
+		},
+		{
+			desc:     "none",
+			header:   http.Header{},
+			expected: 0,
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			test.header.Set("Date", date.Format(http.TimeFormat))
+			e := &Entry{StatusCode: http.StatusOK, Header: test.header, ResponseTime: date}
+			assert.Equal(t, test.expected, freshnessLifetime(e))
+		})
+	}
+}
+
+func TestCurrentAge(t *testing.T) {
+	date := time.Date(2012, 3, 4, 5, 6, 7, 0, time.UTC)
+
+	e := &Entry{
+		Header:       http.Header{"Date": {date.Format(http.TimeFormat)}, "Age": {"5"}},
+		RequestTime:  date,
+		ResponseTime: date.Add(2 * time.Second),
+	}
+	assert.Equal(t, 17*time.Second, currentAge(e, date.Add(12*time.Second)))
+
+	e.Header.Del("Age")
+	assert.Equal(t, 12*time.Second, currentAge(e, date.Add(12*time.Second)))
+}
+
+func TestStorable(t *testing.T) {
+	testCases := []struct {
+		desc          string
+		requestHeader http.Header
+		code          int
+		header        http.Header
+		expected      bool
+	}{
+		{
+			desc:     "max-age",
+			code:     http.StatusOK,
+			header:   http.Header{"Cache-Control": {"max-age=10"}},
+			expected: true,
+		},
+		{
+			desc:     "heuristic",
+			code:     http.StatusNotFound,
+			header:   http.Header{},
+			expected: true,
+		},
+		{
+			desc:     "not heuristic",
+			code:     http.StatusBadGateway,
+			header:   http.Header{},
+			expected: false,
+		},
+		{
+			desc:     "explicit freshness",
+			code:     http.StatusBadGateway,
+			header:   http.Header{"Cache-Control": {"max-age=10"}},
+			expected: true,
+		},
+		{
+			desc:     "partial content",
+			code:     http.StatusPartialContent,
+			header:   http.Header{"Cache-Control": {"max-age=10"}},
+			expected: false,
+		},
+		{
+			desc:     "vary all",
+			code:     http.StatusOK,
+			header:   http.Header{"Cache-Control": {"max-age=10"}, "Vary": {"*"}},
+			expected: false,
+		},
+		{
+			desc:          "authorization",
+			requestHeader: http.Header{"Authorization": {"Basic YTpi"}},
+			code:          http.StatusOK,
+			header:        http.Header{"Cache-Control": {"max-age=10"}},
+			expected:      false,
+		},
+		{
+			desc:          "public authorization",
+			requestHeader: http.Header{"Authorization": {"Basic YTpi"}},
+			code:          http.StatusOK,
+			header:        http.Header{"Cache-Control": {"public, max-age=10"}},
+			expected:      true,
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			for name, values := range test.requestHeader {
+				req.Header[name] = values
+			}
+			assert.Equal(t, test.expected, storable(req, test.code, test.header))
+		})
+	}
+}
@@ -0,0 +1,169 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const diskEntryExt = ".entry"
+
+// DiskStorage stores the entries in files of a directory, the least recently used entries are evicted beyond its maximum size.
+// The entries found in the directory are loaded when the storage is created, so that the cache survives restarts.
+type DiskStorage struct {
+	dir string
+
+	mutex sync.Mutex
+	// the entries of the index have no body
+	lru *lru
+}
+
+// diskEntry is the content of an entry file
+type diskEntry struct {
+	Key   string
+	Entry *Entry
+}
+
+// NewDiskStorage creates a DiskStorage in the directory, of the maximum size in bytes
+func NewDiskStorage(dir string, maxSize int64) (*DiskStorage, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	s := &DiskStorage{dir: dir, lru: newLRU(maxSize)}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// load indexes the entry files of the directory, from the least recently modified
+func (s *DiskStorage) load() error {
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ModTime().Before(files[j].ModTime())
+	})
+
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), diskEntryExt) {
+			continue
+		}
+
+		de, err := readDiskEntry(filepath.Join(s.dir, file.Name()))
+		if err != nil {
+			// skip the unreadable files, they are replaced when the key is stored again
+			continue
+		}
+		s.index(de.Key, de.Entry)
+	}
+	return nil
+}
+
+// Get returns the entry of the key, false if there is none
+func (s *DiskStorage) Get(key string) (*Entry, bool) {
+	s.mutex.Lock()
+	_, ok := s.lru.get(key)
+	s.mutex.Unlock()
+	if !ok {
+		return nil, false
+	}
+
+	de, err := readDiskEntry(s.path(key))
+	if err != nil || de.Key != key {
+		s.Delete(key)
+		return nil, false
+	}
+	return de.Entry, true
+}
+
+// Set stores the entry at the key, replacing the existing entry if any
+func (s *DiskStorage) Set(key string, e *Entry) error {
+	tmp, err := ioutil.TempFile(s.dir, "tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	err = gob.NewEncoder(tmp).Encode(&diskEntry{Key: key, Entry: e})
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err := os.Rename(tmp.Name(), s.path(key)); err != nil {
+		return err
+	}
+	s.index(key, e)
+	return nil
+}
+
+// index adds the entry to the index, the files of the evicted entries are removed. It requires the lock or exclusive access.
+func (s *DiskStorage) index(key string, e *Entry) {
+	meta := *e
+	meta.Body = nil
+	for _, evicted := range s.lru.set(key, &meta, e.Size()) {
+		os.Remove(s.path(evicted))
+	}
+}
+
+// Delete removes the entry of the key
+func (s *DiskStorage) Delete(key string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.lru.remove(key)
+	os.Remove(s.path(key))
+}
+
+// Range calls f for each entry until f returns false, the body of the entries is not loaded
+func (s *DiskStorage) Range(f func(key string, e *Entry) bool) {
+	s.mutex.Lock()
+	entries := make(map[string]*Entry, len(s.lru.items))
+	for key, elem := range s.lru.items {
+		entries[key] = elem.Value.(*lruItem).value
+	}
+	s.mutex.Unlock()
+
+	for key, e := range entries {
+		if !f(key, e) {
+			return
+		}
+	}
+}
+
+func (s *DiskStorage) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(s.dir, hex.EncodeToString(sum[:])+diskEntryExt)
+}
+
+func readDiskEntry(path string) (*diskEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	de := &diskEntry{}
+	if err := gob.NewDecoder(f).Decode(de); err != nil {
+		return nil, err
+	}
+	// keep the least recently used order across restarts
+	now := time.Now()
+	os.Chtimes(path, now, now)
+	return de, nil
+}
@@ -0,0 +1,177 @@
+package cache
+
+import (
+	"container/list"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Entry is a stored response
+type Entry struct {
+	// URL is the effective request URL, e.g. http://example.com/a?b=c
+	URL string
+	// StatusCode is the response status code
+	StatusCode int
+	// Header are the response headers
+	Header http.Header
+	// Body is the response body
+	Body []byte
+	// RequestTime is the time the request that fetched the response was sent
+	RequestTime time.Time
+	// ResponseTime is the time the response was received
+	ResponseTime time.Time
+	// Tags are the surrogate keys of the response
+	Tags []string
+	// Vary lists the request headers selecting the variants of the URL, when set the entry only records them
+	Vary []string
+}
+
+// Size returns the approximate size of the entry in bytes
+func (e *Entry) Size() int64 {
+	size := int64(len(e.URL) + len(e.Body))
+	for name, values := range e.Header {
+		for _, value := range values {
+			size += int64(len(name) + len(value))
+		}
+	}
+	for _, tag := range e.Tags {
+		size += int64(len(tag))
+	}
+	for _, name := range e.Vary {
+		size += int64(len(name))
+	}
+	return size
+}
+
+// date returns the value of the Date header, the response time when it is missing or invalid
+func (e *Entry) date() time.Time {
+	if t, err := http.ParseTime(e.Header.Get("Date")); err == nil {
+		return t
+	}
+	return e.ResponseTime
+}
+
+// hasTag reports whether the entry has the surrogate key
+func (e *Entry) hasTag(tag string) bool {
+	for _, t := range e.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// Storage stores the entries of the cache, implementations must be safe for concurrent use
+type Storage interface {
+	// Get returns the entry of the key, false if there is none
+	Get(key string) (*Entry, bool)
+	// Set stores the entry at the key, replacing the existing entry if any
+	Set(key string, e *Entry) error
+	// Delete removes the entry of the key
+	Delete(key string)
+	// Range calls f for each entry until f returns false, the body of the entries may not be loaded
+	Range(f func(key string, e *Entry) bool)
+}
+
+// lru tracks the size and the use order of the entries of a storage
+type lru struct {
+	maxSize int64
+	size    int64
+	order   *list.List
+	items   map[string]*list.Element
+}
+
+type lruItem struct {
+	key   string
+	value *Entry
+	size  int64
+}
+
+func newLRU(maxSize int64) *lru {
+	return &lru{maxSize: maxSize, order: list.New(), items: make(map[string]*list.Element)}
+}
+
+func (l *lru) get(key string) (*Entry, bool) {
+	elem, ok := l.items[key]
+	if !ok {
+		return nil, false
+	}
+	l.order.MoveToFront(elem)
+	return elem.Value.(*lruItem).value, true
+}
+
+// set adds or replaces the item, it returns the keys of the least recently used items evicted to make room
+func (l *lru) set(key string, value *Entry, size int64) []string {
+	l.remove(key)
+	l.items[key] = l.order.PushFront(&lruItem{key: key, value: value, size: size})
+	l.size += size
+
+	var evicted []string
+	for l.size > l.maxSize && l.order.Len() > 1 {
+		item := l.order.Back().Value.(*lruItem)
+		l.remove(item.key)
+		evicted = append(evicted, item.key)
+	}
+	return evicted
+}
+
+func (l *lru) remove(key string) bool {
+	elem, ok := l.items[key]
+	if !ok {
+		return false
+	}
+	l.order.Remove(elem)
+	delete(l.items, key)
+	l.size -= elem.Value.(*lruItem).size
+	return true
+}
+
+// MemoryStorage stores the entries in memory, the least recently used entries are evicted beyond its maximum size
+type MemoryStorage struct {
+	mutex sync.Mutex
+	lru   *lru
+}
+
+// NewMemoryStorage creates a MemoryStorage of the maximum size, in bytes
+func NewMemoryStorage(maxSize int64) *MemoryStorage {
+	return &MemoryStorage{lru: newLRU(maxSize)}
+}
+
+// Get returns the entry of the key, false if there is none
+func (s *MemoryStorage) Get(key string) (*Entry, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.lru.get(key)
+}
+
+// Set stores the entry at the key, replacing the existing entry if any
+func (s *MemoryStorage) Set(key string, e *Entry) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.lru.set(key, e, e.Size())
+	return nil
+}
+
+// Delete removes the entry of the key
+func (s *MemoryStorage) Delete(key string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.lru.remove(key)
+}
+
+// Range calls f for each entry until f returns false
+func (s *MemoryStorage) Range(f func(key string, e *Entry) bool) {
+	s.mutex.Lock()
+	entries := make(map[string]*Entry, len(s.lru.items))
+	for key, elem := range s.lru.items {
+		entries[key] = elem.Value.(*lruItem).value
+	}
+	s.mutex.Unlock()
+
+	for key, e := range entries {
+		if !f(key, e) {
+			return
+		}
+	}
+}
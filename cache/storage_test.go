@@ -0,0 +1,108 @@
+package cache
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryStorageEviction(t *testing.T) {
+	s := NewMemoryStorage(25)
+
+	require.NoError(t, s.Set("a", &Entry{Body: []byte("0123456789")}))
+	require.NoError(t, s.Set("b", &Entry{Body: []byte("0123456789")}))
+
+	// a becomes the most recently used entry
+	_, ok := s.Get("a")
+	assert.True(t, ok)
+
+	require.NoError(t, s.Set("c", &Entry{Body: []byte("0123456789")}))
+	_, ok = s.Get("b")
+	assert.False(t, ok)
+	_, ok = s.Get("a")
+	assert.True(t, ok)
+	_, ok = s.Get("c")
+	assert.True(t, ok)
+
+	// an entry larger than the storage replaces all the others
+	require.NoError(t, s.Set("d", &Entry{Body: []byte(strings.Repeat("x", 40))}))
+	var keys []string
+	s.Range(func(key string, e *Entry) bool {
+		keys = append(keys, key)
+		return true
+	})
+	assert.Equal(t, []string{"d"}, keys)
+
+	s.Delete("d")
+	_, ok = s.Get("d")
+	assert.False(t, ok)
+}
+
+func TestDiskStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "oxy-cache")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	s, err := NewDiskStorage(dir, 1024)
+	require.NoError(t, err)
+
+	e := &Entry{
+		URL:        "http://example.com/",
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": {"text/plain"}},
+		Body:       []byte("hello"),
+		Tags:       []string{"a"},
+	}
+	require.NoError(t, s.Set("key", e))
+
+	stored, ok := s.Get("key")
+	require.True(t, ok)
+	assert.Equal(t, e, stored)
+
+	// the storage is reloaded from the directory
+	s, err = NewDiskStorage(dir, 1024)
+	require.NoError(t, err)
+	stored, ok = s.Get("key")
+	require.True(t, ok)
+	assert.Equal(t, e, stored)
+
+	s.Range(func(key string, e *Entry) bool {
+		assert.Equal(t, "key", key)
+		assert.Equal(t, []string{"a"}, e.Tags)
+		return true
+	})
+
+	s.Delete("key")
+	_, ok = s.Get("key")
+	assert.False(t, ok)
+
+	files, err := filepath.Glob(filepath.Join(dir, "*"+diskEntryExt))
+	require.NoError(t, err)
+	assert.Empty(t, files)
+}
+
+func TestDiskStorageEviction(t *testing.T) {
+	dir, err := ioutil.TempDir("", "oxy-cache")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	s, err := NewDiskStorage(dir, 25)
+	require.NoError(t, err)
+
+	require.NoError(t, s.Set("a", &Entry{Body: []byte("0123456789")}))
+	require.NoError(t, s.Set("b", &Entry{Body: []byte("0123456789")}))
+	require.NoError(t, s.Set("c", &Entry{Body: []byte("0123456789")}))
+
+	_, ok := s.Get("a")
+	assert.False(t, ok)
+
+	files, err := filepath.Glob(filepath.Join(dir, "*"+diskEntryExt))
+	require.NoError(t, err)
+	assert.Len(t, files, 2)
+}
@@ -0,0 +1,123 @@
+package cache
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"reflect"
+)
+
+// responseWriter records the response of the next handler while writing it through to the client,
+// unless intercept returns true for its status code: the response is then only recorded, for the cache to answer instead.
+type responseWriter struct {
+	w         http.ResponseWriter
+	intercept func(code int) bool
+	onHeader  func(h http.Header)
+
+	maxBodySize int64
+
+	header      http.Header
+	code        int
+	body        []byte
+	overflow    bool
+	intercepted bool
+	wroteHeader bool
+}
+
+func newResponseWriter(w http.ResponseWriter, maxBodySize int64) *responseWriter {
+	rw := &responseWriter{w: w, maxBodySize: maxBodySize}
+	if w != nil {
+		rw.header = w.Header()
+	} else {
+		rw.header = make(http.Header)
+	}
+	return rw
+}
+
+func (rw *responseWriter) Header() http.Header {
+	return rw.header
+}
+
+func (rw *responseWriter) WriteHeader(code int) {
+	if rw.wroteHeader {
+		return
+	}
+	if code >= 100 && code < 200 && code != http.StatusSwitchingProtocols {
+		// informational responses are followed by the final one
+		if rw.w != nil && !rw.intercepted {
+			rw.w.WriteHeader(code)
+		}
+		return
+	}
+
+	rw.wroteHeader = true
+	rw.code = code
+	rw.intercepted = rw.w == nil || (rw.intercept != nil && rw.intercept(code))
+	if rw.intercepted {
+		return
+	}
+
+	if rw.onHeader != nil {
+		rw.onHeader(rw.header)
+	}
+	rw.w.WriteHeader(code)
+}
+
+func (rw *responseWriter) Write(b []byte) (int, error) {
+	if !rw.wroteHeader {
+		rw.WriteHeader(http.StatusOK)
+	}
+
+	if !rw.overflow {
+		if int64(len(rw.body)+len(b)) > rw.maxBodySize {
+			rw.overflow = true
+			rw.body = nil
+		} else {
+			rw.body = append(rw.body, b...)
+		}
+	}
+
+	if rw.intercepted {
+		return len(b), nil
+	}
+	return rw.w.Write(b)
+}
+
+// Flush flush the writer
+func (rw *responseWriter) Flush() {
+	if rw.intercepted {
+		return
+	}
+	if !rw.wroteHeader {
+		rw.WriteHeader(http.StatusOK)
+	}
+	if f, ok := rw.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// CloseNotify returns a channel that receives at most a single value (true)
+// when the client connection has gone away.
+func (rw *responseWriter) CloseNotify() <-chan bool {
+	if cn, ok := rw.w.(http.CloseNotifier); ok {
+		return cn.CloseNotify()
+	}
+	return make(<-chan bool)
+}
+
+// Hijack lets the caller take over the connection.
+func (rw *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if hi, ok := rw.w.(http.Hijacker); ok && !rw.intercepted {
+		return hi.Hijack()
+	}
+	return nil, nil, fmt.Errorf("the response writer that was wrapped in this cache, does not implement http.Hijacker. It is of type: %v", reflect.TypeOf(rw.w))
+}
+
+// statusCode returns the status code of the response, 200 if the next handler wrote nothing
+func (rw *responseWriter) statusCode() int {
+	if rw.code == 0 {
+		return http.StatusOK
+	}
+	return rw.code
+}
@@ -176,10 +176,14 @@ func (c *CircuitBreaker) serve(w http.ResponseWriter, req *http.Request) {
 	start := c.clock.UtcNow()
 	p := utils.NewProxyWriterWithLogger(w, c.log)
 
+	req, record := utils.WithErrorRecord(req)
 	c.next.ServeHTTP(p, req)
 
 	latency := c.clock.UtcNow().Sub(start)
 	c.metrics.Record(p.StatusCode(), latency)
+	if phase := utils.UpstreamTimeoutPhase(record.Err()); phase != "" {
+		c.metrics.RecordTimeout(string(phase))
+	}
 
 	// Note that this call is less expensive than it looks -- checkCondition only performs the real check
 	// periodically. Because of that we can afford to call it here on every single response.
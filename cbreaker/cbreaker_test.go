@@ -304,6 +304,22 @@ func statsNetErrors(threshold float64) *memmetrics.RTMetrics {
 	return m
 }
 
+func statsTimeouts(phase string, threshold float64) *memmetrics.RTMetrics {
+	m, err := memmetrics.NewRTMetrics()
+	if err != nil {
+		panic(err)
+	}
+	for i := 0; i < 100; i++ {
+		if i < int(threshold*100) {
+			m.Record(http.StatusGatewayTimeout, 0)
+			m.RecordTimeout(phase)
+		} else {
+			m.Record(http.StatusOK, 0)
+		}
+	}
+	return m
+}
+
 func statsLatencyAtQuantile(_ float64, value time.Duration) *memmetrics.RTMetrics {
 	m, err := memmetrics.NewRTMetrics()
 	if err != nil {
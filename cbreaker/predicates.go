@@ -26,6 +26,7 @@ func parseExpression(in string) (hpredicate, error) {
 			"LatencyAtQuantileMS": latencyAtQuantile,
 			"NetworkErrorRatio":   networkErrorRatio,
 			"ResponseCodeRatio":   responseCodeRatio,
+			"TimeoutRatio":        timeoutRatio,
 		},
 	})
 	if err != nil {
@@ -68,6 +69,12 @@ func responseCodeRatio(startA, endA, startB, endB int) toFloat64 {
 	}
 }
 
+func timeoutRatio(phase string) toFloat64 {
+	return func(c *CircuitBreaker) float64 {
+		return c.metrics.TimeoutRatio(phase)
+	}
+}
+
 // or returns predicate by joining the passed predicates with logical 'or'
 func or(fns ...hpredicate) hpredicate {
 	return func(c *CircuitBreaker) bool {
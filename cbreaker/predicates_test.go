@@ -45,6 +45,21 @@ func TestTripped(t *testing.T) {
 			metrics:    statsResponseCodes(statusCode{Code: 200, Count: 5}, statusCode{Code: 500, Count: 4}),
 			expected:   false,
 		},
+		{
+			expression: `TimeoutRatio("dial") > 0.5`,
+			metrics:    statsTimeouts("dial", 0.6),
+			expected:   true,
+		},
+		{
+			expression: `TimeoutRatio("response_header") > 0.5`,
+			metrics:    statsTimeouts("dial", 0.6),
+			expected:   false,
+		},
+		{
+			expression: `TimeoutRatio("") > 0.5`,
+			metrics:    statsTimeouts("response_header", 0.6),
+			expected:   true,
+		},
 		{
 			// quantile not defined
 			expression: "LatencyAtQuantileMS(40.0) > 50",
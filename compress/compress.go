@@ -0,0 +1,274 @@
+/*
+Package compress provides http.Handler middleware that compresses the responses with gzip or deflate
+
+The encoding is negotiated with the Accept-Encoding header of the request, q-values included.
+Only the responses of the configured content types and larger than a minimum size are compressed,
+the responses that are already encoded, partial or marked no-transform are left alone.
+Streaming responses are flushed through the compressor, and hijacked connections such as websockets are passed through.
+
+Examples of a compression middleware:
+
+  // sample HTTP handler
+  handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+    w.Write([]byte("hello"))
+  })
+
+  // Compress the text, JSON, JavaScript and XML responses of 1KB or more
+  compress.New(handler)
+
+  // Compress the JSON responses of 256 bytes or more, with the best compression
+  compress.New(handler,
+    compress.ContentTypes("application/json"),
+    compress.MinSize(256),
+    compress.Level(flate.BestCompression))
+
+*/
+package compress
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vulcand/oxy/utils"
+)
+
+// Encodings
+const (
+	EncodingGzip    = "gzip"
+	EncodingDeflate = "deflate"
+)
+
+const (
+	// DefaultMinSize Compress the responses of 1KB or more by default
+	DefaultMinSize = 1024
+	// DefaultLevel Default compression level
+	DefaultLevel = flate.DefaultCompression
+)
+
+// DefaultContentTypes are the media types compressed by default, the types ending with a slash match all their subtypes
+var DefaultContentTypes = []string{
+	"text/",
+	"application/json",
+	"application/javascript",
+	"application/x-javascript",
+	"application/xml",
+	"application/xhtml+xml",
+	"application/rss+xml",
+	"application/atom+xml",
+	"image/svg+xml",
+}
+
+// Compress is responsible for compressing responses
+type Compress struct {
+	contentTypes []string
+	minSize      int
+	level        int
+	encodings    []string
+
+	pools map[string]*sync.Pool
+
+	next http.Handler
+
+	log *log.Logger
+}
+
+// New returns a new compression middleware. New() function supports optional functional arguments
+func New(next http.Handler, setters ...optSetter) (*Compress, error) {
+	c := &Compress{
+		next: next,
+
+		contentTypes: DefaultContentTypes,
+		minSize:      DefaultMinSize,
+		level:        DefaultLevel,
+		encodings:    []string{EncodingGzip, EncodingDeflate},
+
+		log: log.StandardLogger(),
+	}
+	for _, s := range setters {
+		if err := s(c); err != nil {
+			return nil, err
+		}
+	}
+
+	c.pools = make(map[string]*sync.Pool, len(c.encodings))
+	for _, encoding := range c.encodings {
+		c.pools[encoding] = &sync.Pool{}
+	}
+	return c, nil
+}
+
+// Logger defines the logger the compression middleware will use.
+//
+// It defaults to logrus.StandardLogger(), the global logger used by logrus.
+func Logger(l *log.Logger) optSetter {
+	return func(c *Compress) error {
+		c.log = l
+		return nil
+	}
+}
+
+// ContentTypes sets the media types to compress, the types ending with a slash match all their subtypes, e.g. "text/"
+func ContentTypes(types ...string) optSetter {
+	return func(c *Compress) error {
+		c.contentTypes = nil
+		for _, t := range types {
+			c.contentTypes = append(c.contentTypes, strings.ToLower(strings.TrimSuffix(t, "*")))
+		}
+		return nil
+	}
+}
+
+// MinSize sets the minimum size of the responses to compress, in bytes
+func MinSize(size int) optSetter {
+	return func(c *Compress) error {
+		if size < 0 {
+			return fmt.Errorf("min size should be >= 0")
+		}
+		c.minSize = size
+		return nil
+	}
+}
+
+// Level sets the compression level, from flate.HuffmanOnly to flate.BestCompression
+func Level(level int) optSetter {
+	return func(c *Compress) error {
+		if level < flate.HuffmanOnly || level > flate.BestCompression {
+			return fmt.Errorf("invalid compression level: %d", level)
+		}
+		c.level = level
+		return nil
+	}
+}
+
+// Encodings sets the supported encodings by order of preference, gzip then deflate by default
+func Encodings(encodings ...string) optSetter {
+	return func(c *Compress) error {
+		c.encodings = nil
+		for _, encoding := range encodings {
+			encoding = strings.ToLower(encoding)
+			if encoding != EncodingGzip && encoding != EncodingDeflate {
+				return fmt.Errorf("unsupported encoding: %q", encoding)
+			}
+			c.encodings = append(c.encodings, encoding)
+		}
+		return nil
+	}
+}
+
+type optSetter func(c *Compress) error
+
+// Wrap sets the next handler to be called by compression handler.
+func (c *Compress) Wrap(next http.Handler) error {
+	c.next = next
+	return nil
+}
+
+func (c *Compress) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if c.log.Level >= log.DebugLevel {
+		logEntry := c.log.WithField("Request", utils.DumpHttpRequest(req))
+		logEntry.Debug("vulcand/oxy/compress: begin ServeHttp on request")
+		defer logEntry.Debug("vulcand/oxy/compress: completed ServeHttp on request")
+	}
+
+	rw := &responseWriter{
+		w:        w,
+		c:        c,
+		req:      req,
+		encoding: c.negotiate(req.Header.Get("Accept-Encoding")),
+	}
+	defer func() {
+		if err := rw.close(); err != nil {
+			c.log.Errorf("vulcand/oxy/compress: failed to complete the response: %v", err)
+		}
+	}()
+
+	c.next.ServeHTTP(rw, req)
+}
+
+// negotiate returns the supported encoding the client prefers, empty if it accepts none of them
+func (c *Compress) negotiate(acceptEncoding string) string {
+	if acceptEncoding == "" {
+		return ""
+	}
+
+	qvalues := make(map[string]float64)
+	for _, item := range strings.Split(acceptEncoding, ",") {
+		parts := strings.Split(item, ";")
+		coding := strings.ToLower(strings.TrimSpace(parts[0]))
+		if coding == "x-gzip" {
+			coding = EncodingGzip
+		}
+
+		q := 1.0
+		for _, param := range parts[1:] {
+			param = strings.TrimSpace(param)
+			if len(param) > 2 && strings.EqualFold(param[:2], "q=") {
+				value, err := strconv.ParseFloat(param[2:], 64)
+				if err != nil {
+					value = 0
+				}
+				q = value
+			}
+		}
+		qvalues[coding] = q
+	}
+
+	best, bestQ := "", 0.0
+	for _, encoding := range c.encodings {
+		q, ok := qvalues[encoding]
+		if !ok {
+			q = qvalues["*"]
+		}
+		if q > bestQ {
+			best, bestQ = encoding, q
+		}
+	}
+	return best
+}
+
+// compressibleType reports whether the media type is one of the compressed content types
+func (c *Compress) compressibleType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0]))
+	}
+	for _, t := range c.contentTypes {
+		if mediaType == t || (strings.HasSuffix(t, "/") && strings.HasPrefix(mediaType, t)) {
+			return true
+		}
+	}
+	return false
+}
+
+// newWriter returns a compressor writing to w, from the pool of the encoding
+func (c *Compress) newWriter(encoding string, w io.Writer) (compressor, error) {
+	if cw, ok := c.pools[encoding].Get().(compressor); ok {
+		cw.Reset(w)
+		return cw, nil
+	}
+	if encoding == EncodingGzip {
+		return gzip.NewWriterLevel(w, c.level)
+	}
+	// the deflate content coding is the zlib format
+	return zlib.NewWriterLevel(w, c.level)
+}
+
+func (c *Compress) releaseWriter(encoding string, cw compressor) {
+	c.pools[encoding].Put(cw)
+}
+
+// compressor is implemented by the gzip and zlib writers
+type compressor interface {
+	io.WriteCloser
+	Flush() error
+	Reset(w io.Writer)
+}
@@ -0,0 +1,305 @@
+package compress
+
+import (
+	"bufio"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var largeText = strings.Repeat("hello world ", 200)
+
+func TestNegotiate(t *testing.T) {
+	testCases := []struct {
+		desc           string
+		acceptEncoding string
+		expected       string
+	}{
+		{desc: "none", acceptEncoding: "", expected: ""},
+		{desc: "gzip", acceptEncoding: "gzip", expected: EncodingGzip},
+		{desc: "deflate", acceptEncoding: "deflate", expected: EncodingDeflate},
+		{desc: "server preference", acceptEncoding: "deflate, gzip", expected: EncodingGzip},
+		{desc: "q-values", acceptEncoding: "gzip;q=0.5, deflate;q=0.8", expected: EncodingDeflate},
+		{desc: "refused", acceptEncoding: "gzip;q=0, deflate;q=0", expected: ""},
+		{desc: "wildcard", acceptEncoding: "*", expected: EncodingGzip},
+		{desc: "wildcard with refusal", acceptEncoding: "gzip;Q=0, *;q=0.1", expected: EncodingDeflate},
+		{desc: "identity", acceptEncoding: "identity", expected: ""},
+		{desc: "unsupported", acceptEncoding: "br", expected: ""},
+		{desc: "x-gzip", acceptEncoding: "x-gzip", expected: EncodingGzip},
+	}
+
+	c, err := New(nil)
+	require.NoError(t, err)
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+			assert.Equal(t, test.expected, c.negotiate(test.acceptEncoding))
+		})
+	}
+}
+
+func TestCompress(t *testing.T) {
+	testCases := []struct {
+		desc             string
+		reqHeader        http.Header
+		method           string
+		header           http.Header
+		code             int
+		body             string
+		expectedEncoding string
+		expectedVary     bool
+	}{
+		{
+			desc:             "gzip",
+			reqHeader:        http.Header{"Accept-Encoding": {"gzip"}},
+			header:           http.Header{"Content-Type": {"text/html; charset=utf-8"}},
+			body:             largeText,
+			expectedEncoding: EncodingGzip,
+			expectedVary:     true,
+		},
+		{
+			desc:             "deflate",
+			reqHeader:        http.Header{"Accept-Encoding": {"gzip;q=0.1, deflate"}},
+			header:           http.Header{"Content-Type": {"application/json"}},
+			body:             largeText,
+			expectedEncoding: EncodingDeflate,
+			expectedVary:     true,
+		},
+		{
+			desc:             "content length",
+			reqHeader:        http.Header{"Accept-Encoding": {"gzip"}},
+			header:           http.Header{"Content-Type": {"text/plain"}, "Content-Length": {strconv.Itoa(len(largeText))}},
+			body:             largeText,
+			expectedEncoding: EncodingGzip,
+			expectedVary:     true,
+		},
+		{
+			desc:             "sniffed content type",
+			reqHeader:        http.Header{"Accept-Encoding": {"gzip"}},
+			body:             largeText,
+			expectedEncoding: EncodingGzip,
+			expectedVary:     true,
+		},
+		{
+			desc:         "not accepted",
+			header:       http.Header{"Content-Type": {"text/plain"}},
+			body:         largeText,
+			expectedVary: true,
+		},
+		{
+			desc:         "small body",
+			reqHeader:    http.Header{"Accept-Encoding": {"gzip"}},
+			header:       http.Header{"Content-Type": {"text/plain"}},
+			body:         "hello",
+			expectedVary: true,
+		},
+		{
+			desc:      "other content type",
+			reqHeader: http.Header{"Accept-Encoding": {"gzip"}},
+			header:    http.Header{"Content-Type": {"image/png"}},
+			body:      largeText,
+		},
+		{
+			desc:             "already encoded",
+			reqHeader:        http.Header{"Accept-Encoding": {"gzip"}},
+			header:           http.Header{"Content-Type": {"text/plain"}, "Content-Encoding": {"br"}},
+			body:             largeText,
+			expectedEncoding: "br",
+		},
+		{
+			desc:         "range request",
+			reqHeader:    http.Header{"Accept-Encoding": {"gzip"}, "Range": {"bytes=0-"}},
+			header:       http.Header{"Content-Type": {"text/plain"}},
+			body:         largeText,
+			expectedVary: true,
+		},
+		{
+			desc:      "partial content",
+			reqHeader: http.Header{"Accept-Encoding": {"gzip"}},
+			header:    http.Header{"Content-Type": {"text/plain"}, "Content-Range": {"bytes 0-2399/5000"}},
+			code:      http.StatusPartialContent,
+			body:      largeText,
+		},
+		{
+			desc:      "no transform",
+			reqHeader: http.Header{"Accept-Encoding": {"gzip"}},
+			header:    http.Header{"Content-Type": {"text/plain"}, "Cache-Control": {"public, no-transform"}},
+			body:      largeText,
+		},
+		{
+			desc:         "head request",
+			reqHeader:    http.Header{"Accept-Encoding": {"gzip"}},
+			method:       http.MethodHead,
+			header:       http.Header{"Content-Type": {"text/plain"}, "Content-Length": {"5000"}},
+			expectedVary: true,
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			c, err := New(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				for name, values := range test.header {
+					w.Header()[name] = values
+				}
+				if test.code != 0 {
+					w.WriteHeader(test.code)
+				}
+				// write in small chunks to exercise the buffering
+				for i := 0; i < len(test.body); i += 100 {
+					end := i + 100
+					if end > len(test.body) {
+						end = len(test.body)
+					}
+					w.Write([]byte(test.body[i:end]))
+				}
+			}))
+			require.NoError(t, err)
+
+			method := test.method
+			if method == "" {
+				method = http.MethodGet
+			}
+			req := httptest.NewRequest(method, "http://localhost", nil)
+			if test.reqHeader != nil {
+				req.Header = test.reqHeader
+			}
+
+			recorder := httptest.NewRecorder()
+			c.ServeHTTP(recorder, req)
+
+			assert.Equal(t, test.expectedEncoding, recorder.Header().Get("Content-Encoding"))
+			if test.expectedVary {
+				assert.Equal(t, "Accept-Encoding", recorder.Header().Get("Vary"))
+			} else {
+				assert.Empty(t, recorder.Header().Get("Vary"))
+			}
+
+			var body io.Reader = recorder.Body
+			switch test.expectedEncoding {
+			case EncodingGzip:
+				assert.Empty(t, recorder.Header().Get("Content-Length"))
+				body, err = gzip.NewReader(recorder.Body)
+				require.NoError(t, err)
+			case EncodingDeflate:
+				body, err = zlib.NewReader(recorder.Body)
+				require.NoError(t, err)
+			}
+			decoded, err := ioutil.ReadAll(body)
+			require.NoError(t, err)
+			assert.Equal(t, test.body, string(decoded))
+		})
+	}
+}
+
+func TestCompressETag(t *testing.T) {
+	c, err := New(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Etag", `"abc"`)
+		w.Header().Set("Accept-Ranges", "bytes")
+		w.Header().Set("Vary", "Origin")
+		w.Write([]byte(largeText))
+	}))
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	recorder := httptest.NewRecorder()
+	c.ServeHTTP(recorder, req)
+
+	assert.Equal(t, EncodingGzip, recorder.Header().Get("Content-Encoding"))
+	assert.Equal(t, `W/"abc"`, recorder.Header().Get("Etag"))
+	assert.Empty(t, recorder.Header().Get("Accept-Ranges"))
+	assert.Equal(t, []string{"Origin", "Accept-Encoding"}, recorder.Header()["Vary"])
+}
+
+func TestCompressStreaming(t *testing.T) {
+	next := make(chan struct{})
+	c, err := New(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte("data: first\n\n"))
+		w.(http.Flusher).Flush()
+		<-next
+		w.Write([]byte("data: second\n\n"))
+	}))
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(c)
+	defer srv.Close()
+
+	req, err := http.NewRequest(http.MethodGet, srv.URL, nil)
+	require.NoError(t, err)
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, EncodingGzip, resp.Header.Get("Content-Encoding"))
+
+	gz, err := gzip.NewReader(resp.Body)
+	require.NoError(t, err)
+	reader := bufio.NewReader(gz)
+
+	// the first event is received before the handler completes
+	line, err := reader.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "data: first\n", line)
+
+	close(next)
+	rest, err := ioutil.ReadAll(reader)
+	require.NoError(t, err)
+	assert.Equal(t, "\ndata: second\n\n", string(rest))
+}
+
+func TestCompressHijack(t *testing.T) {
+	c, err := New(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		require.NoError(t, err)
+		defer conn.Close()
+		rw.WriteString("HTTP/1.1 200 OK\r\nContent-Length: 5\r\nContent-Type: text/plain\r\n\r\nhello")
+		rw.Flush()
+	}))
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(c)
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\nAccept-Encoding: gzip\r\n\r\n"))
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Empty(t, resp.Header.Get("Content-Encoding"))
+	assert.Equal(t, "hello", string(body))
+}
+
+func TestCompressOptions(t *testing.T) {
+	c, err := New(http.NotFoundHandler(), ContentTypes("application/*"), MinSize(0), Encodings("deflate"))
+	require.NoError(t, err)
+	assert.True(t, c.compressibleType("application/x-protobuf"))
+	assert.False(t, c.compressibleType("text/plain"))
+	assert.Equal(t, EncodingDeflate, c.negotiate("gzip, deflate;q=0.5"))
+
+	_, err = New(nil, MinSize(-1))
+	assert.Error(t, err)
+	_, err = New(nil, Level(10))
+	assert.Error(t, err)
+	_, err = New(nil, Encodings("br"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,232 @@
+package compress
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// responseWriter compresses the response once it knows its headers and enough of its body to decide
+type responseWriter struct {
+	w        http.ResponseWriter
+	c        *Compress
+	req      *http.Request
+	encoding string
+
+	code     int
+	started  bool
+	hijacked bool
+	buf      []byte
+
+	cw compressor
+}
+
+func (rw *responseWriter) Header() http.Header {
+	return rw.w.Header()
+}
+
+func (rw *responseWriter) WriteHeader(code int) {
+	if rw.started || rw.hijacked {
+		return
+	}
+	if code >= 100 && code < 200 && code != http.StatusSwitchingProtocols {
+		// informational responses are followed by the final one
+		rw.w.WriteHeader(code)
+		return
+	}
+	if rw.code != 0 {
+		return
+	}
+	rw.code = code
+
+	if !rw.compressible() {
+		rw.start(false)
+		return
+	}
+	// without content type, the decision waits for the body to sniff it
+	if rw.Header().Get("Content-Type") == "" {
+		return
+	}
+	if size, err := strconv.ParseInt(rw.Header().Get("Content-Length"), 10, 64); err == nil {
+		rw.start(size >= int64(rw.c.minSize))
+	}
+}
+
+func (rw *responseWriter) Write(b []byte) (int, error) {
+	if rw.code == 0 {
+		rw.WriteHeader(http.StatusOK)
+	}
+	if rw.started {
+		return rw.write(b)
+	}
+
+	rw.buf = append(rw.buf, b...)
+	if len(rw.buf) >= rw.c.minSize {
+		if err := rw.decide(true); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// Flush flush the writer, the buffered bytes are compressed whatever their size as more may follow
+func (rw *responseWriter) Flush() {
+	if rw.hijacked {
+		return
+	}
+	if rw.code == 0 {
+		rw.WriteHeader(http.StatusOK)
+	}
+	if !rw.started {
+		if err := rw.decide(true); err != nil {
+			rw.c.log.Errorf("vulcand/oxy/compress: failed to flush the response: %v", err)
+			return
+		}
+	}
+	if rw.cw != nil {
+		if err := rw.cw.Flush(); err != nil {
+			rw.c.log.Errorf("vulcand/oxy/compress: failed to flush the response: %v", err)
+			return
+		}
+	}
+	if f, ok := rw.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// CloseNotify returns a channel that receives at most a single value (true)
+// when the client connection has gone away.
+func (rw *responseWriter) CloseNotify() <-chan bool {
+	if cn, ok := rw.w.(http.CloseNotifier); ok {
+		return cn.CloseNotify()
+	}
+	return make(<-chan bool)
+}
+
+// Hijack lets the caller take over the connection.
+func (rw *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hi, ok := rw.w.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("the response writer that was wrapped in this compressor, does not implement http.Hijacker. It is of type: %v", reflect.TypeOf(rw.w))
+	}
+	conn, brw, err := hi.Hijack()
+	if err == nil {
+		rw.hijacked = true
+	}
+	return conn, brw, err
+}
+
+// decide starts the response, compressed if it is compressible and large enough or streamed
+func (rw *responseWriter) decide(streamed bool) error {
+	if rw.Header().Get("Content-Type") == "" && len(rw.buf) > 0 {
+		// sniff the content type the way net/http would
+		rw.Header().Set("Content-Type", http.DetectContentType(rw.buf))
+	}
+
+	rw.start(rw.compressible() && (streamed || len(rw.buf) >= rw.c.minSize))
+
+	buf := rw.buf
+	rw.buf = nil
+	if len(buf) > 0 {
+		if _, err := rw.write(buf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// start writes the headers of the response
+func (rw *responseWriter) start(compress bool) {
+	rw.started = true
+	h := rw.Header()
+
+	if rw.varies() && !headerContainsToken(h, "Vary", "Accept-Encoding") {
+		h.Add("Vary", "Accept-Encoding")
+	}
+
+	if compress {
+		cw, err := rw.c.newWriter(rw.encoding, rw.w)
+		if err != nil {
+			rw.c.log.Errorf("vulcand/oxy/compress: failed to create the %s compressor: %v", rw.encoding, err)
+		} else {
+			rw.cw = cw
+			h.Set("Content-Encoding", rw.encoding)
+			h.Del("Content-Length")
+			h.Del("Accept-Ranges")
+			// the compressed representation is not byte for byte identical to the original one
+			if etag := h.Get("Etag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+				h.Set("Etag", "W/"+etag)
+			}
+		}
+	}
+
+	rw.w.WriteHeader(rw.code)
+}
+
+func (rw *responseWriter) write(b []byte) (int, error) {
+	if rw.cw != nil {
+		if _, err := rw.cw.Write(b); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+	return rw.w.Write(b)
+}
+
+// close completes the response once the next handler returned
+func (rw *responseWriter) close() error {
+	if rw.hijacked {
+		return nil
+	}
+	if !rw.started {
+		if rw.code == 0 {
+			rw.code = http.StatusOK
+		}
+		if err := rw.decide(false); err != nil {
+			return err
+		}
+	}
+	if rw.cw == nil {
+		return nil
+	}
+
+	err := rw.cw.Close()
+	rw.c.releaseWriter(rw.encoding, rw.cw)
+	rw.cw = nil
+	return err
+}
+
+// varies reports whether the response may be compressed depending on the Accept-Encoding header of the request
+func (rw *responseWriter) varies() bool {
+	h := rw.Header()
+	if h.Get("Content-Encoding") != "" || h.Get("Content-Range") != "" || headerContainsToken(h, "Cache-Control", "no-transform") {
+		return false
+	}
+	switch {
+	case rw.code < http.StatusOK, rw.code == http.StatusNoContent, rw.code == http.StatusPartialContent, rw.code == http.StatusNotModified:
+		return false
+	}
+	contentType := h.Get("Content-Type")
+	return contentType == "" || rw.c.compressibleType(contentType)
+}
+
+// compressible reports whether the response can be compressed for the request
+func (rw *responseWriter) compressible() bool {
+	return rw.encoding != "" && rw.req.Method != http.MethodHead && rw.req.Header.Get("Range") == "" && rw.varies()
+}
+
+// headerContainsToken reports whether the comma separated values of the header contain the token
+func headerContainsToken(h http.Header, name, token string) bool {
+	for _, value := range h[name] {
+		for _, item := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(item), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
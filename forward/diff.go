@@ -0,0 +1,404 @@
+package forward
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// maxDiffValueSize is the maximum size of the body values reported in a Difference
+const maxDiffValueSize = 256
+
+// Diff reports the differences between the responses of next and of the mirror to a request
+type Diff struct {
+	Method      string       `json:"method"`      // Method - request method
+	URL         string       `json:"url"`         // URL - request URI
+	Primary     DiffResponse `json:"primary"`     // Primary - response of next
+	Candidate   DiffResponse `json:"candidate"`   // Candidate - response of the mirror
+	Differences []Difference `json:"differences"` // Differences - compared fields that differ
+}
+
+// DiffResponse contains information about a compared response
+type DiffResponse struct {
+	Code      int  `json:"code"`                // Code - response status code
+	BodyBytes int  `json:"body_bytes"`          // BodyBytes - size of the compared body in bytes
+	Truncated bool `json:"truncated,omitempty"` // Truncated tells if the body was larger than the body size limit
+}
+
+// Difference is a field that differs between the primary and the candidate responses.
+// The field is "status", "header.<name>", "body" or "body.<path>" for JSON bodies, e.g. "body.items.0.id".
+type Difference struct {
+	Field     string `json:"field"`
+	Primary   string `json:"primary,omitempty"`
+	Candidate string `json:"candidate,omitempty"`
+}
+
+// MirrorDiff enables the comparison mode: the response of next and the response of the mirror are compared,
+// and report is called when they differ. The client only ever gets the response of next.
+func MirrorDiff(report func(*Diff)) mirrorOptSetter {
+	return func(m *Mirror) error {
+		m.report = report
+		return nil
+	}
+}
+
+// MirrorDiffWriter enables the comparison mode, the differences are emitted as JSON lines to writer
+func MirrorDiffWriter(writer io.Writer) mirrorOptSetter {
+	return func(m *Mirror) error {
+		var mutex sync.Mutex
+		m.report = func(d *Diff) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			if err := json.NewEncoder(writer).Encode(d); err != nil {
+				m.log.Errorf("vulcand/oxy/forward/mirror: failed to marshal diff: %v", err)
+			}
+		}
+		return nil
+	}
+}
+
+// MirrorDiffHeaders adds response headers to compare, the headers are not compared by default
+func MirrorDiffHeaders(headers ...string) mirrorOptSetter {
+	return func(m *Mirror) error {
+		for _, h := range headers {
+			m.diffHeaders = append(m.diffHeaders, http.CanonicalHeaderKey(h))
+		}
+		return nil
+	}
+}
+
+// MirrorDiffIgnoreFields adds fields of the JSON bodies to ignore, as dotted paths where * matches any key or index,
+// e.g. "meta.timestamp" or "items.*.id"
+func MirrorDiffIgnoreFields(paths ...string) mirrorOptSetter {
+	return func(m *Mirror) error {
+		for _, p := range paths {
+			m.ignoreFields = append(m.ignoreFields, strings.Split(p, "."))
+		}
+		return nil
+	}
+}
+
+// MirrorDiffIgnorePatterns adds regular expressions matching volatile values such as dates or request IDs,
+// the matches are removed from the compared header values and bodies
+func MirrorDiffIgnorePatterns(exprs ...string) mirrorOptSetter {
+	return func(m *Mirror) error {
+		for _, expr := range exprs {
+			re, err := regexp.Compile(expr)
+			if err != nil {
+				return fmt.Errorf("invalid ignore pattern %q: %v", expr, err)
+			}
+			m.ignorePatterns = append(m.ignorePatterns, re)
+		}
+		return nil
+	}
+}
+
+// diff compares the primary and the candidate responses, it returns nil when they don't differ
+func (m *Mirror) diff(req *http.Request, primary, candidate *capturedResponse) *Diff {
+	var differences []Difference
+
+	if primary.statusCode() != candidate.statusCode() {
+		differences = append(differences, Difference{
+			Field:     "status",
+			Primary:   strconv.Itoa(primary.statusCode()),
+			Candidate: strconv.Itoa(candidate.statusCode()),
+		})
+	}
+
+	for _, h := range m.diffHeaders {
+		p := m.mask(strings.Join(primary.header[h], ", "))
+		c := m.mask(strings.Join(candidate.header[h], ", "))
+		if p != c {
+			differences = append(differences, Difference{Field: "header." + h, Primary: p, Candidate: c})
+		}
+	}
+
+	differences = append(differences, m.diffBodies(primary.body.Bytes(), candidate.body.Bytes())...)
+	if len(differences) == 0 {
+		return nil
+	}
+
+	uri := req.RequestURI
+	if uri == "" {
+		uri = req.URL.RequestURI()
+	}
+	return &Diff{
+		Method:      req.Method,
+		URL:         uri,
+		Primary:     primary.diffResponse(),
+		Candidate:   candidate.diffResponse(),
+		Differences: differences,
+	}
+}
+
+func (m *Mirror) diffBodies(primary, candidate []byte) []Difference {
+	p, c := m.mask(string(primary)), m.mask(string(candidate))
+
+	pv, perr := decodeJSON(p)
+	cv, cerr := decodeJSON(c)
+	if perr == nil && cerr == nil {
+		for _, path := range m.ignoreFields {
+			removeJSONField(pv, path)
+			removeJSONField(cv, path)
+		}
+		return diffJSON("body", pv, cv)
+	}
+
+	if p == c {
+		return nil
+	}
+	return []Difference{{Field: "body", Primary: truncateValue(p), Candidate: truncateValue(c)}}
+}
+
+// mask removes the matches of the ignore patterns from the value
+func (m *Mirror) mask(value string) string {
+	for _, re := range m.ignorePatterns {
+		value = re.ReplaceAllString(value, "")
+	}
+	return value
+}
+
+func decodeJSON(body string) (interface{}, error) {
+	decoder := json.NewDecoder(strings.NewReader(body))
+	decoder.UseNumber()
+
+	var v interface{}
+	if err := decoder.Decode(&v); err != nil {
+		return nil, err
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return nil, fmt.Errorf("unexpected data after the JSON value")
+	}
+	return v, nil
+}
+
+// removeJSONField removes the values at the path from a decoded JSON value
+func removeJSONField(v interface{}, path []string) {
+	if len(path) == 0 {
+		return
+	}
+
+	switch value := v.(type) {
+	case map[string]interface{}:
+		for key, child := range value {
+			if path[0] != "*" && path[0] != key {
+				continue
+			}
+			if len(path) == 1 {
+				delete(value, key)
+			} else {
+				removeJSONField(child, path[1:])
+			}
+		}
+	case []interface{}:
+		for i, child := range value {
+			if path[0] != "*" && path[0] != strconv.Itoa(i) {
+				continue
+			}
+			if len(path) == 1 {
+				value[i] = nil
+			} else {
+				removeJSONField(child, path[1:])
+			}
+		}
+	}
+}
+
+// diffJSON compares two decoded JSON values, objects and arrays are compared member by member
+func diffJSON(field string, primary, candidate interface{}) []Difference {
+	switch p := primary.(type) {
+	case map[string]interface{}:
+		c, ok := candidate.(map[string]interface{})
+		if !ok {
+			break
+		}
+
+		keys := make([]string, 0, len(p)+len(c))
+		for key := range p {
+			keys = append(keys, key)
+		}
+		for key := range c {
+			if _, exists := p[key]; !exists {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+
+		var differences []Difference
+		for _, key := range keys {
+			differences = append(differences, diffJSONMember(field+"."+key, p, c, key)...)
+		}
+		return differences
+	case []interface{}:
+		c, ok := candidate.([]interface{})
+		if !ok {
+			break
+		}
+
+		var differences []Difference
+		for i := 0; i < len(p) || i < len(c); i++ {
+			f := field + "." + strconv.Itoa(i)
+			switch {
+			case i >= len(c):
+				differences = append(differences, Difference{Field: f, Primary: encodeJSON(p[i])})
+			case i >= len(p):
+				differences = append(differences, Difference{Field: f, Candidate: encodeJSON(c[i])})
+			default:
+				differences = append(differences, diffJSON(f, p[i], c[i])...)
+			}
+		}
+		return differences
+	}
+
+	if reflect.DeepEqual(primary, candidate) {
+		return nil
+	}
+	return []Difference{{Field: field, Primary: encodeJSON(primary), Candidate: encodeJSON(candidate)}}
+}
+
+func diffJSONMember(field string, primary, candidate map[string]interface{}, key string) []Difference {
+	p, pok := primary[key]
+	c, cok := candidate[key]
+	switch {
+	case !cok:
+		return []Difference{{Field: field, Primary: encodeJSON(p)}}
+	case !pok:
+		return []Difference{{Field: field, Candidate: encodeJSON(c)}}
+	}
+	return diffJSON(field, p, c)
+}
+
+func encodeJSON(v interface{}) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return truncateValue(string(b))
+}
+
+func truncateValue(value string) string {
+	if len(value) <= maxDiffValueSize {
+		return value
+	}
+	return value[:maxDiffValueSize] + "..."
+}
+
+// capturedResponse records a response up to a body size limit, it is the response writer of the mirrored requests
+type capturedResponse struct {
+	header    http.Header
+	code      int
+	body      bytes.Buffer
+	maxBody   int64
+	truncated bool
+}
+
+func newCapturedResponse(maxBody int64) *capturedResponse {
+	return &capturedResponse{header: make(http.Header), maxBody: maxBody}
+}
+
+func (c *capturedResponse) Header() http.Header {
+	return c.header
+}
+
+func (c *capturedResponse) Write(b []byte) (int, error) {
+	c.WriteHeader(http.StatusOK)
+	c.capture(b)
+	return len(b), nil
+}
+
+func (c *capturedResponse) WriteHeader(code int) {
+	// informational responses are followed by the final one
+	if c.code == 0 && (code >= http.StatusOK || code == http.StatusSwitchingProtocols) {
+		c.code = code
+	}
+}
+
+func (c *capturedResponse) capture(b []byte) {
+	room := c.maxBody - int64(c.body.Len())
+	if int64(len(b)) > room {
+		c.truncated = true
+		if room < 0 {
+			room = 0
+		}
+		b = b[:room]
+	}
+	c.body.Write(b)
+}
+
+func (c *capturedResponse) statusCode() int {
+	if c.code == 0 {
+		return http.StatusOK
+	}
+	return c.code
+}
+
+func (c *capturedResponse) diffResponse() DiffResponse {
+	return DiffResponse{Code: c.statusCode(), BodyBytes: c.body.Len(), Truncated: c.truncated}
+}
+
+// primaryRecorder captures the response of next while writing it to the client
+type primaryRecorder struct {
+	w    http.ResponseWriter
+	resp *capturedResponse
+	done chan struct{}
+}
+
+func newPrimaryRecorder(w http.ResponseWriter, maxBody int64) *primaryRecorder {
+	return &primaryRecorder{w: w, resp: newCapturedResponse(maxBody), done: make(chan struct{})}
+}
+
+func (p *primaryRecorder) Header() http.Header {
+	return p.w.Header()
+}
+
+func (p *primaryRecorder) Write(b []byte) (int, error) {
+	p.resp.WriteHeader(http.StatusOK)
+	n, err := p.w.Write(b)
+	p.resp.capture(b[:n])
+	return n, err
+}
+
+func (p *primaryRecorder) WriteHeader(code int) {
+	p.resp.WriteHeader(code)
+	p.w.WriteHeader(code)
+}
+
+// Flush flush the writer
+func (p *primaryRecorder) Flush() {
+	if f, ok := p.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// CloseNotify returns a channel that receives at most a single value (true)
+// when the client connection has gone away.
+func (p *primaryRecorder) CloseNotify() <-chan bool {
+	if cn, ok := p.w.(http.CloseNotifier); ok {
+		return cn.CloseNotify()
+	}
+	return make(<-chan bool)
+}
+
+// Hijack lets the caller take over the connection.
+func (p *primaryRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if hi, ok := p.w.(http.Hijacker); ok {
+		return hi.Hijack()
+	}
+	return nil, nil, fmt.Errorf("the response writer that was wrapped in this recorder, does not implement http.Hijacker. It is of type: %v", reflect.TypeOf(p.w))
+}
+
+// finish makes the response available to the comparison once next has served the request
+func (p *primaryRecorder) finish() {
+	p.resp.header = p.w.Header().Clone()
+	close(p.done)
+}
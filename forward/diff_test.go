@@ -0,0 +1,158 @@
+package forward
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/testutils"
+)
+
+func TestMirrorDiffResponses(t *testing.T) {
+	testCases := []struct {
+		desc      string
+		setters   []mirrorOptSetter
+		primary   *capturedResponse
+		candidate *capturedResponse
+		expected  []Difference
+	}{
+		{
+			desc:      "same responses",
+			primary:   newTestResponse(http.StatusOK, http.Header{"Date": {"Mon"}}, "hello"),
+			candidate: newTestResponse(http.StatusOK, http.Header{"Date": {"Tue"}}, "hello"),
+		},
+		{
+			desc:      "status",
+			primary:   newTestResponse(http.StatusOK, nil, ""),
+			candidate: newTestResponse(http.StatusNotFound, nil, ""),
+			expected:  []Difference{{Field: "status", Primary: "200", Candidate: "404"}},
+		},
+		{
+			desc:      "selected headers",
+			setters:   []mirrorOptSetter{MirrorDiffHeaders("content-type", "X-Request-Id"), MirrorDiffIgnorePatterns(`[0-9a-f]{8}`)},
+			primary:   newTestResponse(http.StatusOK, http.Header{ContentType: {"text/plain"}, "X-Request-Id": {"req-0123abcd"}, "Date": {"Mon"}}, ""),
+			candidate: newTestResponse(http.StatusOK, http.Header{ContentType: {"text/html"}, "X-Request-Id": {"req-4567cdef"}, "Date": {"Tue"}}, ""),
+			expected:  []Difference{{Field: "header.Content-Type", Primary: "text/plain", Candidate: "text/html"}},
+		},
+		{
+			desc:      "text body",
+			setters:   []mirrorOptSetter{MirrorDiffIgnorePatterns(`\d{4}-\d{2}-\d{2}`)},
+			primary:   newTestResponse(http.StatusOK, nil, "hello at 2020-01-01"),
+			candidate: newTestResponse(http.StatusOK, nil, "hi at 2020-01-02"),
+			expected:  []Difference{{Field: "body", Primary: "hello at ", Candidate: "hi at "}},
+		},
+		{
+			desc:      "JSON body",
+			setters:   []mirrorOptSetter{MirrorDiffIgnoreFields("meta.time", "items.*.id")},
+			primary:   newTestResponse(http.StatusOK, nil, `{"meta":{"time":1},"items":[{"id":1,"name":"a"},{"id":2,"name":"b"}],"total":2.0}`),
+			candidate: newTestResponse(http.StatusOK, nil, `{"items":[{"id":3,"name":"a"},{"id":4,"name":"c"},{"id":5}],"meta":{"time":2},"count":3}`),
+			expected: []Difference{
+				{Field: "body.count", Candidate: "3"},
+				{Field: "body.items.1.name", Primary: `"b"`, Candidate: `"c"`},
+				{Field: "body.items.2", Candidate: "{}"},
+				{Field: "body.total", Primary: "2.0"},
+			},
+		},
+		{
+			desc:      "JSON and text bodies",
+			primary:   newTestResponse(http.StatusOK, nil, `{"a":1}`),
+			candidate: newTestResponse(http.StatusOK, nil, `{"a":1} trailing`),
+			expected:  []Difference{{Field: "body", Primary: `{"a":1}`, Candidate: `{"a":1} trailing`}},
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			m, err := NewMirror(http.NotFoundHandler(), testutils.ParseURI("http://localhost"), test.setters...)
+			require.NoError(t, err)
+
+			req := httptest.NewRequest(http.MethodGet, "/api?x=1", nil)
+			d := m.diff(req, test.primary, test.candidate)
+			if test.expected == nil {
+				assert.Nil(t, d)
+				return
+			}
+
+			require.NotNil(t, d)
+			assert.Equal(t, http.MethodGet, d.Method)
+			assert.Equal(t, "/api?x=1", d.URL)
+			assert.Equal(t, test.expected, d.Differences)
+		})
+	}
+}
+
+func TestMirrorDiffWriter(t *testing.T) {
+	primary := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set(ContentType, "application/json")
+		w.Write([]byte(`{"name":"primary","id":1}`))
+	})
+	defer primary.Close()
+
+	candidate := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set(ContentType, "application/json")
+		w.Write([]byte(`{"name":"candidate","id":2}`))
+	})
+	defer candidate.Close()
+
+	lines := make(chan []byte, 1)
+	f, err := New()
+	require.NoError(t, err)
+	m, err := NewMirror(f, testutils.ParseURI(candidate.URL),
+		MirrorDiffWriter(chanWriter(lines)),
+		MirrorDiffIgnoreFields("id"),
+		MirrorDiffHeaders(ContentType))
+	require.NoError(t, err)
+
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(primary.URL)
+		m.ServeHTTP(w, req)
+	}))
+	defer proxy.Close()
+
+	re, body, err := testutils.Get(proxy.URL + "/users")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, `{"name":"primary","id":1}`, string(body))
+
+	var line []byte
+	select {
+	case line = <-lines:
+	case <-time.After(time.Second):
+		t.Fatal("the diff was not reported")
+	}
+
+	var d Diff
+	require.NoError(t, json.Unmarshal(line, &d))
+	assert.Equal(t, Diff{
+		Method:      http.MethodGet,
+		URL:         "/users",
+		Primary:     DiffResponse{Code: http.StatusOK, BodyBytes: 25},
+		Candidate:   DiffResponse{Code: http.StatusOK, BodyBytes: 27},
+		Differences: []Difference{{Field: "body.name", Primary: `"primary"`, Candidate: `"candidate"`}},
+	}, d)
+}
+
+func newTestResponse(code int, header http.Header, body string) *capturedResponse {
+	resp := newCapturedResponse(defaultMirrorMaxBodySize)
+	for name, values := range header {
+		resp.header[name] = values
+	}
+	resp.WriteHeader(code)
+	resp.Write([]byte(body))
+	return resp
+}
+
+// chanWriter sends the written lines to a channel
+type chanWriter chan []byte
+
+func (c chanWriter) Write(b []byte) (int, error) {
+	c <- append([]byte(nil), b...)
+	return len(b), nil
+}
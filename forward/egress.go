@@ -0,0 +1,249 @@
+package forward
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"reflect"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vulcand/oxy/utils"
+)
+
+// ProxyConnection is the non standard hop-by-hop header some clients send to forward proxies
+const ProxyConnection = "Proxy-Connection"
+
+// ForwardProxy enables the forward (egress) proxy mode: the destination of the requests is the one asked by the clients,
+// absolute-form requests are forwarded to their URL and CONNECT requests open a tunnel to their host:port.
+// The origin-form requests are rejected with utils.BadRequestError as they have no destination.
+func ForwardProxy(b bool) optSetter {
+	return func(f *Forwarder) error {
+		f.forwardProxy = b
+		return nil
+	}
+}
+
+// ProxyAllowlist restricts the destinations of the forward proxy, the others are rejected with utils.DestinationNotAllowedError.
+// A destination is a host name, a wildcard matching its sub-domains ("*.example.com"), an IP address or a CIDR,
+// optionally followed by a port ("example.com:443"). All the destinations are allowed when the list is empty.
+func ProxyAllowlist(destinations ...string) optSetter {
+	return func(f *Forwarder) error {
+		for _, d := range destinations {
+			rule, err := parseDestinationRule(d)
+			if err != nil {
+				return err
+			}
+			f.proxyAllowlist = append(f.proxyAllowlist, rule)
+		}
+		return nil
+	}
+}
+
+// ProxyAuth sets the authenticator of the clients of the forward proxy
+func ProxyAuth(a ProxyAuthenticator) optSetter {
+	return func(f *Forwarder) error {
+		f.proxyAuth = a
+		return nil
+	}
+}
+
+// ProxyAuthenticator authenticates the clients of the forward proxy, usually from their Proxy-Authorization header.
+// Authenticate returns an error for the clients which are not authorized, they get a 407 response. A utils.ProxyAuthError
+// sets its challenge, the other errors are wrapped in one.
+type ProxyAuthenticator interface {
+	Authenticate(req *http.Request) error
+}
+
+// ProxyAuthenticatorFunc proxy authenticator function type
+type ProxyAuthenticatorFunc func(req *http.Request) error
+
+// Authenticate calls f(req).
+func (f ProxyAuthenticatorFunc) Authenticate(req *http.Request) error {
+	return f(req)
+}
+
+// BasicProxyAuth returns a ProxyAuthenticator checking the Basic credentials of the Proxy-Authorization header
+func BasicProxyAuth(realm string, check func(username, password string) bool) ProxyAuthenticator {
+	challenge := fmt.Sprintf("Basic realm=%q", realm)
+	return ProxyAuthenticatorFunc(func(req *http.Request) error {
+		header := req.Header.Get(ProxyAuthorization)
+		if header == "" {
+			return &utils.ProxyAuthError{Challenge: challenge}
+		}
+		auth, err := utils.ParseAuthHeader(header)
+		if err != nil {
+			return &utils.ProxyAuthError{Challenge: challenge, Err: err}
+		}
+		if !check(auth.Username, auth.Password) {
+			return &utils.ProxyAuthError{Challenge: challenge, Err: fmt.Errorf("invalid credentials for user %q", auth.Username)}
+		}
+		return nil
+	})
+}
+
+// destinationRule is an entry of the allowlist of the forward proxy
+type destinationRule struct {
+	host     string
+	wildcard bool
+	network  *net.IPNet
+	port     string
+}
+
+func parseDestinationRule(d string) (destinationRule, error) {
+	if _, network, err := net.ParseCIDR(d); err == nil {
+		return destinationRule{network: network}, nil
+	}
+
+	host, port := d, ""
+	if net.ParseIP(d) == nil && strings.Contains(d, ":") {
+		var err error
+		if host, port, err = net.SplitHostPort(d); err != nil {
+			return destinationRule{}, fmt.Errorf("invalid proxy destination %q: %v", d, err)
+		}
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		bits := 8 * net.IPv4len
+		if ip.To4() == nil {
+			bits = 8 * net.IPv6len
+		}
+		return destinationRule{network: &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, port: port}, nil
+	}
+
+	rule := destinationRule{host: normalizeHostname(host), port: port}
+	if strings.HasPrefix(rule.host, "*.") {
+		rule.wildcard = true
+		rule.host = rule.host[1:]
+	}
+	if rule.host == "" || rule.host == "." {
+		return destinationRule{}, fmt.Errorf("invalid proxy destination %q", d)
+	}
+	return rule, nil
+}
+
+func (r destinationRule) match(host, port string) bool {
+	if r.port != "" && r.port != port {
+		return false
+	}
+	if r.network != nil {
+		ip := net.ParseIP(host)
+		return ip != nil && r.network.Contains(ip)
+	}
+	if r.wildcard {
+		return strings.HasSuffix(host, r.host)
+	}
+	return host == r.host
+}
+
+// normalizeHostname lowercases the host name and removes the trailing dot of fully qualified names
+func normalizeHostname(host string) string {
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+// proxyDestination returns the host and port the request asks the forward proxy for
+func proxyDestination(req *http.Request) (string, string, error) {
+	if req.Method == http.MethodConnect {
+		host, port, err := net.SplitHostPort(req.URL.Host)
+		if err != nil || host == "" || port == "" {
+			return "", "", &utils.BadRequestError{Reason: fmt.Sprintf("invalid CONNECT authority %q", req.URL.Host)}
+		}
+		return normalizeHostname(host), port, nil
+	}
+
+	if !req.URL.IsAbs() || req.URL.Host == "" {
+		return "", "", &utils.BadRequestError{Reason: "the forward proxy requires absolute-form requests"}
+	}
+
+	var port string
+	switch strings.ToLower(req.URL.Scheme) {
+	case "http":
+		port = "80"
+	case "https":
+		port = "443"
+	default:
+		return "", "", &utils.BadRequestError{Reason: fmt.Sprintf("unsupported scheme %q", req.URL.Scheme)}
+	}
+	if p := req.URL.Port(); p != "" {
+		port = p
+	}
+	return normalizeHostname(req.URL.Hostname()), port, nil
+}
+
+// authorizeProxyRequest authenticates the client and checks the destination of the request against the allowlist
+func (f *Forwarder) authorizeProxyRequest(req *http.Request) error {
+	if f.proxyAuth != nil {
+		if err := f.proxyAuth.Authenticate(req); err != nil {
+			var proxyAuthErr *utils.ProxyAuthError
+			if !errors.As(err, &proxyAuthErr) {
+				err = &utils.ProxyAuthError{Err: err}
+			}
+			return err
+		}
+	}
+
+	host, port, err := proxyDestination(req)
+	if err != nil {
+		return err
+	}
+	if len(f.proxyAllowlist) == 0 {
+		return nil
+	}
+	for _, rule := range f.proxyAllowlist {
+		if rule.match(host, port) {
+			return nil
+		}
+	}
+	return &utils.DestinationNotAllowedError{Destination: net.JoinHostPort(host, port)}
+}
+
+// serveConnect opens a tunnel to the destination of a CONNECT request of a forward proxy client
+func (f *httpForwarder) serveConnect(w http.ResponseWriter, req *http.Request, ctx *handlerContext) {
+	if f.log.GetLevel() >= log.DebugLevel {
+		logEntry := f.log.WithField("Request", utils.DumpHttpRequest(req))
+		logEntry.Debug("vulcand/oxy/forward/connect: begin ServeHttp on request")
+		defer logEntry.Debug("vulcand/oxy/forward/connect: completed ServeHttp on request")
+	}
+
+	backendConn, err := f.dialUpstream(req, req.URL)
+	if err != nil {
+		utils.RecordError(req, err)
+		ctx.errHandler.ServeHTTP(w, req, err)
+		return
+	}
+	defer backendConn.Close()
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		f.log.Errorf("vulcand/oxy/forward/connect: %s can not be hijack", reflect.TypeOf(w))
+		ctx.errHandler.ServeHTTP(w, req, fmt.Errorf("%s can not be hijack", reflect.TypeOf(w)))
+		return
+	}
+
+	clientConn, clientBuf, err := hijacker.Hijack()
+	if err != nil {
+		f.log.Errorf("vulcand/oxy/forward/connect: Failed to hijack responseWriter: %v", err)
+		ctx.errHandler.ServeHTTP(w, req, err)
+		return
+	}
+	defer clientConn.Close()
+
+	if _, err = clientBuf.WriteString("HTTP/1.1 200 Connection established\r\n\r\n"); err == nil {
+		err = clientBuf.Flush()
+	}
+	if err != nil {
+		f.log.Errorf("vulcand/oxy/forward/connect: Failed to write response: %v", err)
+		return
+	}
+
+	if f.tunnelStateListener != nil {
+		f.tunnelStateListener(req.URL, StateConnected, TunnelStats{})
+	}
+
+	stats := tunnelConns(clientConn, clientBuf.Reader, backendConn, backendConn)
+
+	if f.tunnelStateListener != nil {
+		f.tunnelStateListener(req.URL, StateDisconnected, stats)
+	}
+}
@@ -0,0 +1,196 @@
+package forward
+
+import (
+	"crypto/tls"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/testutils"
+)
+
+func TestForwardProxy(t *testing.T) {
+	var outReq *http.Request
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		outReq = req
+		w.Write([]byte("hello"))
+	}))
+	defer srv.Close()
+
+	tlsSrv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("secure hello"))
+	}))
+	defer tlsSrv.Close()
+
+	f, err := New(ForwardProxy(true), ProxyAuth(BasicProxyAuth("egress", func(username, password string) bool {
+		return username == "user" && password == "secret"
+	})))
+	require.NoError(t, err)
+
+	proxy := httptest.NewServer(f)
+	defer proxy.Close()
+
+	proxyURL := testutils.ParseURI(proxy.URL)
+	proxyURL.User = url.UserPassword("user", "secret")
+	client := &http.Client{Transport: &http.Transport{
+		Proxy:           http.ProxyURL(proxyURL),
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+	defer client.CloseIdleConnections()
+
+	re, err := client.Get(srv.URL + "/path?a=b")
+	require.NoError(t, err)
+	body, err := ioutil.ReadAll(re.Body)
+	re.Body.Close()
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, "hello", string(body))
+	assert.Equal(t, "/path", outReq.URL.Path)
+	assert.Equal(t, "a=b", outReq.URL.RawQuery)
+	assert.Equal(t, testutils.ParseURI(srv.URL).Host, outReq.Host)
+	assert.Empty(t, outReq.Header.Get(ProxyAuthorization))
+	assert.Empty(t, outReq.Header.Get(ProxyConnection))
+
+	// https URLs are tunnelled with CONNECT
+	re, err = client.Get(tlsSrv.URL)
+	require.NoError(t, err)
+	body, err = ioutil.ReadAll(re.Body)
+	re.Body.Close()
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, "secure hello", string(body))
+}
+
+func TestForwardProxyRefused(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer srv.Close()
+
+	f, err := New(
+		ForwardProxy(true),
+		ProxyAllowlist("*.example.com:443", "10.0.0.0/8"),
+		ProxyAuth(BasicProxyAuth("egress", func(username, password string) bool {
+			return username == "user" && password == "secret"
+		})),
+	)
+	require.NoError(t, err)
+
+	proxy := httptest.NewServer(f)
+	defer proxy.Close()
+
+	testCases := []struct {
+		desc               string
+		user               *url.Userinfo
+		expectedStatusCode int
+		expectedChallenge  string
+	}{
+		{
+			desc:               "no credentials",
+			expectedStatusCode: http.StatusProxyAuthRequired,
+			expectedChallenge:  `Basic realm="egress"`,
+		},
+		{
+			desc:               "invalid credentials",
+			user:               url.UserPassword("user", "wrong"),
+			expectedStatusCode: http.StatusProxyAuthRequired,
+			expectedChallenge:  `Basic realm="egress"`,
+		},
+		{
+			desc:               "destination not allowed",
+			user:               url.UserPassword("user", "secret"),
+			expectedStatusCode: http.StatusForbidden,
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			proxyURL := testutils.ParseURI(proxy.URL)
+			proxyURL.User = test.user
+			client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+			defer client.CloseIdleConnections()
+
+			re, err := client.Get(srv.URL)
+			require.NoError(t, err)
+			re.Body.Close()
+			assert.Equal(t, test.expectedStatusCode, re.StatusCode)
+			assert.Equal(t, test.expectedChallenge, re.Header.Get("Proxy-Authenticate"))
+		})
+	}
+
+	// requests without destination are refused
+	re, _, err := testutils.Get(proxy.URL, testutils.Header(ProxyAuthorization, "Basic dXNlcjpzZWNyZXQ="))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, re.StatusCode)
+}
+
+func TestForwardProxyAuthenticatorError(t *testing.T) {
+	f, err := New(ForwardProxy(true), ProxyAuth(ProxyAuthenticatorFunc(func(req *http.Request) error {
+		return errors.New("unknown client")
+	})))
+	require.NoError(t, err)
+
+	proxy := httptest.NewServer(f)
+	defer proxy.Close()
+
+	proxyURL := testutils.ParseURI(proxy.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	defer client.CloseIdleConnections()
+
+	re, err := client.Get("http://example.com")
+	require.NoError(t, err)
+	re.Body.Close()
+	assert.Equal(t, http.StatusProxyAuthRequired, re.StatusCode)
+	assert.Empty(t, re.Header.Get("Proxy-Authenticate"))
+}
+
+func TestProxyAllowlist(t *testing.T) {
+	f, err := New(ForwardProxy(true), ProxyAllowlist("Example.com", "*.example.org:443", "10.0.0.0/8", "::1", "192.168.1.1:8080"))
+	require.NoError(t, err)
+
+	testCases := []struct {
+		method   string
+		target   string
+		expected bool
+	}{
+		{method: http.MethodGet, target: "http://example.com/a", expected: true},
+		{method: http.MethodGet, target: "http://EXAMPLE.com.:8080/a", expected: true},
+		{method: http.MethodGet, target: "http://www.example.com/a", expected: false},
+		{method: http.MethodConnect, target: "api.example.org:443", expected: true},
+		{method: http.MethodConnect, target: "example.org:443", expected: false},
+		{method: http.MethodGet, target: "http://api.example.org/", expected: false},
+		{method: http.MethodGet, target: "https://api.example.org/", expected: true},
+		{method: http.MethodConnect, target: "10.1.2.3:22", expected: true},
+		{method: http.MethodConnect, target: "11.1.2.3:22", expected: false},
+		{method: http.MethodConnect, target: "[::1]:443", expected: true},
+		{method: http.MethodGet, target: "http://192.168.1.1:8080/", expected: true},
+		{method: http.MethodGet, target: "http://192.168.1.1/", expected: false},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.method+" "+test.target, func(t *testing.T) {
+			t.Parallel()
+
+			req := httptest.NewRequest(test.method, test.target, nil)
+			if test.method == http.MethodConnect {
+				req.URL = &url.URL{Host: test.target}
+			}
+			err := f.authorizeProxyRequest(req)
+			if test.expected {
+				assert.NoError(t, err)
+			} else {
+				assert.Error(t, err)
+			}
+		})
+	}
+
+	_, err = New(ProxyAllowlist("example.com:443:1"))
+	assert.Error(t, err)
+}
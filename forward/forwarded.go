@@ -0,0 +1,202 @@
+package forward
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// ForwardedMode selects the forwarding headers the HeaderRewriter emits
+type ForwardedMode int
+
+// Forwarding header modes
+const (
+	// ForwardedModeLegacy emits the X-Forwarded-* headers only and leaves the Forwarded header untouched, it's the default
+	ForwardedModeLegacy ForwardedMode = iota
+	// ForwardedModeBoth emits the RFC 7239 Forwarded header alongside the X-Forwarded-* headers
+	ForwardedModeBoth
+	// ForwardedModeStandard emits the RFC 7239 Forwarded header instead of the X-Forwarded-* headers
+	ForwardedModeStandard
+)
+
+// ForwardedElement is a forwarded-element of the RFC 7239 Forwarded header
+type ForwardedElement struct {
+	For   string
+	Proto string
+	Host  string
+	By    string
+}
+
+// String formats the element as it appears in the Forwarded header, quoting values when required
+func (e ForwardedElement) String() string {
+	var pairs []string
+	for _, p := range []struct{ name, value string }{
+		{"for", e.For},
+		{"proto", e.Proto},
+		{"host", e.Host},
+		{"by", e.By},
+	} {
+		if p.value != "" {
+			pairs = append(pairs, p.name+"="+quoteForwardedValue(p.value))
+		}
+	}
+	return strings.Join(pairs, ";")
+}
+
+// FormatForwarded formats the elements as a Forwarded header value
+func FormatForwarded(elements []ForwardedElement) string {
+	values := make([]string, len(elements))
+	for i, e := range elements {
+		values[i] = e.String()
+	}
+	return strings.Join(values, ", ")
+}
+
+// ParseForwarded parses a Forwarded header value, see https://tools.ietf.org/html/rfc7239#section-4
+// Unknown parameters are accepted and ignored.
+func ParseForwarded(value string) ([]ForwardedElement, error) {
+	var elements []ForwardedElement
+	var elem ForwardedElement
+	seen := map[string]bool{}
+
+	p := &forwardedParser{s: value}
+	for {
+		p.skipSpaces()
+		if p.eof() {
+			break
+		}
+
+		name := strings.ToLower(p.token())
+		if name == "" || !p.consume('=') {
+			return nil, fmt.Errorf("invalid forwarded pair at offset %d", p.pos)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("duplicate forwarded parameter %q", name)
+		}
+		seen[name] = true
+
+		val, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+
+		switch name {
+		case "for":
+			elem.For = val
+		case "proto":
+			elem.Proto = val
+		case "host":
+			elem.Host = val
+		case "by":
+			elem.By = val
+		}
+
+		p.skipSpaces()
+		if p.eof() {
+			elements = append(elements, elem)
+			break
+		}
+
+		switch p.s[p.pos] {
+		case ';':
+			p.pos++
+		case ',':
+			p.pos++
+			elements = append(elements, elem)
+			elem = ForwardedElement{}
+			seen = map[string]bool{}
+		default:
+			return nil, fmt.Errorf("unexpected character %q at offset %d", p.s[p.pos], p.pos)
+		}
+	}
+	return elements, nil
+}
+
+type forwardedParser struct {
+	s   string
+	pos int
+}
+
+func (p *forwardedParser) eof() bool {
+	return p.pos >= len(p.s)
+}
+
+func (p *forwardedParser) skipSpaces() {
+	for !p.eof() && (p.s[p.pos] == ' ' || p.s[p.pos] == '\t') {
+		p.pos++
+	}
+}
+
+func (p *forwardedParser) consume(c byte) bool {
+	if p.eof() || p.s[p.pos] != c {
+		return false
+	}
+	p.pos++
+	return true
+}
+
+func (p *forwardedParser) token() string {
+	start := p.pos
+	for !p.eof() && isTokenChar(p.s[p.pos]) {
+		p.pos++
+	}
+	return p.s[start:p.pos]
+}
+
+func (p *forwardedParser) value() (string, error) {
+	if !p.consume('"') {
+		return p.token(), nil
+	}
+
+	var sb strings.Builder
+	for !p.eof() {
+		c := p.s[p.pos]
+		p.pos++
+		switch c {
+		case '"':
+			return sb.String(), nil
+		case '\\':
+			if p.eof() {
+				return "", fmt.Errorf("unterminated quoted-pair in forwarded value")
+			}
+			sb.WriteByte(p.s[p.pos])
+			p.pos++
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	return "", fmt.Errorf("unterminated quoted-string in forwarded value")
+}
+
+// isTokenChar reports whether c is a tchar, see https://tools.ietf.org/html/rfc7230#section-3.2.6
+func isTokenChar(c byte) bool {
+	switch {
+	case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		return true
+	}
+	return strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0
+}
+
+// quoteForwardedValue returns the value as a token, or as a quoted-string if it contains non token characters
+func quoteForwardedValue(v string) string {
+	quote := false
+	for i := 0; i < len(v); i++ {
+		if !isTokenChar(v[i]) {
+			quote = true
+			break
+		}
+	}
+	if !quote {
+		return v
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(v) + `"`
+}
+
+// forwardedNode formats an IP address or an obfuscated identifier as a node name,
+// IPv6 addresses are enclosed in brackets.
+func forwardedNode(ip string) string {
+	if parsed := net.ParseIP(ip); parsed != nil && parsed.To4() == nil {
+		return "[" + ip + "]"
+	}
+	return ip
+}
@@ -0,0 +1,103 @@
+package forward
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseForwarded(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		value    string
+		expected []ForwardedElement
+	}{
+		{
+			desc:  "empty",
+			value: "",
+		},
+		{
+			desc:     "single element",
+			value:    "for=192.0.2.60;proto=http;by=203.0.113.43",
+			expected: []ForwardedElement{{For: "192.0.2.60", Proto: "http", By: "203.0.113.43"}},
+		},
+		{
+			desc:     "case insensitive names",
+			value:    "For=192.0.2.43;HOST=example.com",
+			expected: []ForwardedElement{{For: "192.0.2.43", Host: "example.com"}},
+		},
+		{
+			desc:  "multiple elements",
+			value: `for=192.0.2.43, for="[2001:db8:cafe::17]:4711" , for=unknown`,
+			expected: []ForwardedElement{
+				{For: "192.0.2.43"},
+				{For: "[2001:db8:cafe::17]:4711"},
+				{For: "unknown"},
+			},
+		},
+		{
+			desc:     "obfuscated identifiers and escapes",
+			value:    `for="_gazonk:_8080";by=_hidden;host="a\"b"`,
+			expected: []ForwardedElement{{For: "_gazonk:_8080", By: "_hidden", Host: `a"b`}},
+		},
+		{
+			desc:     "unknown parameter",
+			value:    "for=192.0.2.43;secret=foo",
+			expected: []ForwardedElement{{For: "192.0.2.43"}},
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			actual, err := ParseForwarded(test.value)
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, actual)
+		})
+	}
+}
+
+func TestParseForwardedErrors(t *testing.T) {
+	testCases := []struct {
+		desc  string
+		value string
+	}{
+		{desc: "missing value separator", value: "for"},
+		{desc: "unquoted IPv6", value: "for=[2001:db8::1]"},
+		{desc: "unterminated quoted string", value: `for="[2001:db8::1]`},
+		{desc: "duplicate parameter", value: "for=a;for=b"},
+		{desc: "garbage", value: "for=a b"},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			_, err := ParseForwarded(test.value)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestFormatForwarded(t *testing.T) {
+	elements := []ForwardedElement{
+		{For: "192.0.2.43", Proto: "https", Host: "example.com", By: "_proxy"},
+		{For: forwardedNode("2001:db8:cafe::17"), Proto: "http"},
+		{For: `_a"b`},
+	}
+
+	actual := FormatForwarded(elements)
+	assert.Equal(t, `for=192.0.2.43;proto=https;host=example.com;by=_proxy, for="[2001:db8:cafe::17]";proto=http, for="_a\"b"`, actual)
+
+	parsed, err := ParseForwarded(actual)
+	require.NoError(t, err)
+	assert.Equal(t, []ForwardedElement{
+		{For: "192.0.2.43", Proto: "https", Host: "example.com", By: "_proxy"},
+		{For: "[2001:db8:cafe::17]", Proto: "http"},
+		{For: `_a"b`},
+	}, parsed)
+}
@@ -9,14 +9,17 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/http/httptrace"
 	"net/http/httputil"
 	"net/url"
 	"os"
 	"reflect"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -78,6 +81,17 @@ func WebsocketTLSClientConfig(tcc *tls.Config) optSetter {
 	}
 }
 
+// WebsocketDialer defines the dialer used to reach websocket backends, it is copied and never modified.
+// It defaults to a dialer derived from the RoundTripper, the TLS client configuration
+// set by WebsocketTLSClientConfig is used when the dialer has none.
+func WebsocketDialer(d *websocket.Dialer) optSetter {
+	return func(f *Forwarder) error {
+		dialer := *d
+		f.httpForwarder.websocketDialer = &dialer
+		return nil
+	}
+}
+
 // ErrorHandler is a functional argument that sets error handler of the server
 func ErrorHandler(h utils.ErrorHandler) optSetter {
 	return func(f *Forwarder) error {
@@ -107,18 +121,25 @@ func Stream(stream bool) optSetter {
 // It defaults to logrus.StandardLogger(), the global logger used by logrus.
 func Logger(l log.FieldLogger) optSetter {
 	return func(f *Forwarder) error {
-		if logger, ok := l.(OxyLogger); ok {
-			f.log = logger
-			return nil
+		logger, err := toOxyLogger(l)
+		if err != nil {
+			return err
 		}
+		f.log = logger
+		return nil
+	}
+}
 
-		if logger, ok := l.(*log.Logger); ok {
-			f.log = &internalLogger{Logger: logger}
-			return nil
-		}
+func toOxyLogger(l log.FieldLogger) (OxyLogger, error) {
+	if logger, ok := l.(OxyLogger); ok {
+		return logger, nil
+	}
 
-		return errors.New("the type of the logger must be OxyLogger or logrus.Logger")
+	if logger, ok := l.(*log.Logger); ok {
+		return &internalLogger{Logger: logger}, nil
 	}
+
+	return nil, errors.New("the type of the logger must be OxyLogger or logrus.Logger")
 }
 
 // StateListener defines a state listener for the HTTP forwarder
@@ -129,7 +150,8 @@ func StateListener(stateListener UrlForwardingStateListener) optSetter {
 	}
 }
 
-// WebsocketConnectionClosedHook defines a hook called when websocket connection is closed
+// WebsocketConnectionClosedHook defines a hook called when websocket connection is closed,
+// WebsocketCloseReasonFromRequest tells why from the request given to the hook
 func WebsocketConnectionClosedHook(hook func(req *http.Request, conn net.Conn)) optSetter {
 	return func(f *Forwarder) error {
 		f.httpForwarder.websocketConnectionClosedHook = hook
@@ -163,6 +185,8 @@ type ErrorHandlingRoundTripper struct {
 func (rt ErrorHandlingRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
 	res, err := rt.RoundTripper.RoundTrip(req)
 	if err != nil {
+		utils.RecordError(req, err)
+
 		// We use the recorder from httptest because there isn't another `public` implementation of a recorder.
 		recorder := httptest.NewRecorder()
 		rt.errorHandler.ServeHTTP(recorder, req, err)
@@ -179,6 +203,11 @@ type Forwarder struct {
 	*handlerContext
 	stateListener UrlForwardingStateListener
 	stream        bool
+	grpc          bool
+
+	forwardProxy   bool
+	proxyAllowlist []destinationRule
+	proxyAuth      ProxyAuthenticator
 }
 
 // handlerContext defines a handler context for error reporting and logging
@@ -189,18 +218,51 @@ type handlerContext struct {
 // httpForwarder is a handler that can reverse proxy
 // HTTP traffic
 type httpForwarder struct {
-	roundTripper   http.RoundTripper
-	rewriter       ReqRewriter
-	passHost       bool
-	flushInterval  time.Duration
-	modifyResponse func(*http.Response) error
+	roundTripper     http.RoundTripper
+	protocolSelector ProtocolSelector
+	rewriter         ReqRewriter
+	passHost         bool
+	flushInterval    time.Duration
+	modifyResponse   func(*http.Response) error
 
 	tlsClientConfig *tls.Config
+	websocketDialer *websocket.Dialer
 
 	log OxyLogger
 
 	bufferPool                    httputil.BufferPool
 	websocketConnectionClosedHook func(req *http.Request, conn net.Conn)
+	websocketInterceptor          WebsocketInterceptor
+	websocketIdleTimeout          time.Duration
+	websocketMaxLifetime          time.Duration
+	websocketPingInterval         time.Duration
+	websocketMaxMessageSize       int64
+
+	tunnel              bool
+	tunnelStateListener UrlTunnelStateListener
+	dialContext         dialContextFunc
+
+	proxyProtocolVersion int
+
+	unixSocketHost string
+
+	timeouts upstreamTimeouts
+
+	upstreamTLS map[string]*utils.UpstreamTLS
+	tlsConfigs  *tlsConfigCache
+
+	timingHook func(req *http.Request, timing utils.UpstreamTiming)
+
+	streamingContentTypes []string
+
+	suppressInterim bool
+	expectContinue  ExpectContinueMode
+
+	via     string
+	maxHops int
+
+	validationMode    RequestValidationMode
+	maxRequestHeaders int
 }
 
 const defaultFlushInterval = time.Duration(100) * time.Millisecond
@@ -232,6 +294,14 @@ func New(setters ...optSetter) (*Forwarder, error) {
 		f.flushInterval = defaultFlushInterval
 	}
 
+	if f.grpc {
+		// gRPC streams are flushed immediately to support bidirectional streaming
+		f.flushInterval = -1
+		if f.protocolSelector == nil {
+			f.protocolSelector = grpcProtocolSelector
+		}
+	}
+
 	if f.httpForwarder.rewriter == nil {
 		h, err := os.Hostname()
 		if err != nil {
@@ -244,8 +314,20 @@ func New(setters ...optSetter) (*Forwarder, error) {
 		f.httpForwarder.roundTripper = http.DefaultTransport
 	}
 
+	if f.streamingContentTypes == nil {
+		f.streamingContentTypes = DefaultStreamingContentTypes
+	}
+
+	if f.unixSocketHost == "" {
+		f.unixSocketHost = defaultUnixSocketHost
+	}
+
 	if f.errHandler == nil {
-		f.errHandler = utils.DefaultHandler
+		if f.grpc {
+			f.errHandler = &GRPCErrorHandler{}
+		} else {
+			f.errHandler = utils.DefaultHandler
+		}
 	}
 
 	if f.tlsClientConfig == nil {
@@ -254,6 +336,31 @@ func New(setters ...optSetter) (*Forwarder, error) {
 		}
 	}
 
+	f.dialContext = (&net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}).DialContext
+	if ht, ok := f.httpForwarder.roundTripper.(*http.Transport); ok && ht.DialContext != nil {
+		f.dialContext = ht.DialContext
+	}
+
+	if f.websocketDialer == nil {
+		f.websocketDialer = newWebsocketDialer(f.httpForwarder.roundTripper)
+	}
+	if f.websocketDialer.TLSClientConfig == nil {
+		f.websocketDialer.TLSClientConfig = f.tlsClientConfig
+	}
+
+	baseTransport, _ := f.httpForwarder.roundTripper.(*http.Transport)
+	f.tlsConfigs = newTLSConfigCache(f.tlsClientConfig, transportIdleTimeout(baseTransport))
+
+	rt, err := newUpstreamRoundTripper(f.httpForwarder, f.httpForwarder.roundTripper)
+	if err != nil {
+		return nil, err
+	}
+	f.httpForwarder.roundTripper = rt
+
+	if f.timeouts.enabled() {
+		f.httpForwarder.roundTripper = &timeoutRoundTripper{RoundTripper: f.httpForwarder.roundTripper, timeouts: f.timeouts}
+	}
+
 	f.httpForwarder.roundTripper = ErrorHandlingRoundTripper{
 		RoundTripper: f.httpForwarder.roundTripper,
 		errorHandler: f.errHandler,
@@ -273,12 +380,49 @@ func (f *Forwarder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		defer logEntry.Debug("vulcand/oxy/forward: completed ServeHttp on request")
 	}
 
+	if err := f.validateRequest(req); err != nil {
+		f.log.Debugf("vulcand/oxy/forward: request refused: %v", err)
+		f.errHandler.ServeHTTP(w, req, err)
+		return
+	}
+
+	if err := f.checkLoop(req); err != nil {
+		f.log.Debugf("vulcand/oxy/forward: request refused: %v", err)
+		f.errHandler.ServeHTTP(w, req, err)
+		return
+	}
+	if f.serveMaxForwards(w, req) {
+		return
+	}
+
 	if f.stateListener != nil {
 		f.stateListener(req.URL, StateConnected)
 		defer f.stateListener(req.URL, StateDisconnected)
 	}
+
+	if f.forwardProxy {
+		if err := f.authorizeProxyRequest(req); err != nil {
+			f.log.Debugf("vulcand/oxy/forward: forward proxy request refused: %v", err)
+			f.errHandler.ServeHTTP(w, req, err)
+			return
+		}
+		req.Header.Del(ProxyConnection)
+		if req.Method == http.MethodConnect {
+			f.httpForwarder.serveConnect(w, req, f.handlerContext)
+			return
+		}
+	}
+
+	if f.grpc && IsGRPCRequest(req) {
+		var cancel func()
+		req, cancel = withGRPCDeadline(req)
+		defer cancel()
+	}
+
 	if IsWebsocketRequest(req) {
 		f.httpForwarder.serveWebSocket(w, req, f.handlerContext)
+	} else if f.tunnel && (req.Method == http.MethodConnect || IsUpgradeRequest(req)) {
+		f.httpForwarder.serveTunnel(w, req, f.handlerContext)
 	} else {
 		f.httpForwarder.serveHTTP(w, req, f.handlerContext)
 	}
@@ -302,31 +446,58 @@ func (f *httpForwarder) getUrlFromRequest(req *http.Request) *url.URL {
 
 // Modify the request to handle the target URL
 func (f *httpForwarder) modifyRequest(outReq *http.Request, target *url.URL) {
+	protoMajor, protoMinor := outReq.ProtoMajor, outReq.ProtoMinor
 	outReq.URL = utils.CopyURL(outReq.URL)
 	outReq.URL.Scheme = target.Scheme
 	outReq.URL.Host = target.Host
 
 	u := f.getUrlFromRequest(outReq)
+	if utils.IsUnixSocketURL(target) {
+		if outReq.RequestURI == "" {
+			// the path of the target is the socket path
+			u = &url.URL{Path: "/", RawQuery: u.RawQuery}
+		}
+		outReq.URL.Scheme = unixSocketScheme
+		outReq.URL.Host = utils.UnixSocketPath(target)
+	}
 
 	outReq.URL.Path = u.Path
 	outReq.URL.RawPath = u.RawPath
 	outReq.URL.RawQuery = u.RawQuery
 	outReq.RequestURI = "" // Outgoing request should not have RequestURI
 
-	outReq.Proto = "HTTP/1.1"
-	outReq.ProtoMajor = 1
-	outReq.ProtoMinor = 1
+	switch f.upstreamProtocol(target) {
+	case ProtocolHTTP2, ProtocolH2C:
+		outReq.Proto = "HTTP/2.0"
+		outReq.ProtoMajor = 2
+		outReq.ProtoMinor = 0
+	default:
+		outReq.Proto = "HTTP/1.1"
+		outReq.ProtoMajor = 1
+		outReq.ProtoMinor = 1
+	}
+
+	cleanConnectionHeader(outReq.Header)
 
 	if f.rewriter != nil {
 		f.rewriter.Rewrite(outReq)
 	}
+	f.stampRequest(outReq, protoMajor, protoMinor)
 
 	// Do not pass client Host header unless optsetter PassHostHeader is set.
 	if !f.passHost {
-		outReq.Host = target.Host
+		outReq.Host = f.targetHost(target)
 	}
 }
 
+// targetHost returns the Host header sent to the target
+func (f *httpForwarder) targetHost(target *url.URL) string {
+	if utils.IsUnixSocketURL(target) {
+		return f.unixSocketHost
+	}
+	return target.Host
+}
+
 // serveWebSocket forwards websocket traffic
 func (f *httpForwarder) serveWebSocket(w http.ResponseWriter, req *http.Request, ctx *handlerContext) {
 	if f.log.GetLevel() >= log.DebugLevel {
@@ -337,16 +508,41 @@ func (f *httpForwarder) serveWebSocket(w http.ResponseWriter, req *http.Request,
 
 	outReq := f.copyWebSocketRequest(req)
 
-	dialer := websocket.DefaultDialer
+	dialer := *f.websocketDialer
+
+	if utils.IsUnixSocketURL(req.URL) || f.proxyProtocolVersion != 0 || f.timeouts.dial > 0 {
+		dial := dialer.NetDialContext
+		if dial == nil && dialer.NetDial != nil {
+			dial = contextDialer(dialer.NetDial)
+		} else if dial == nil {
+			dial = (&net.Dialer{}).DialContext
+		}
+		var socketPath string
+		if utils.IsUnixSocketURL(req.URL) {
+			socketPath = utils.UnixSocketPath(req.URL)
+			dialer.Proxy = nil
+		}
+		dialer.NetDialContext = f.upstreamDialer(dial, socketPath, req)
+	}
+
+	if u := f.upstreamTLSSettings(req, req.URL); u != nil {
+		cfg, err := f.tlsConfigs.get(u)
+		if err != nil {
+			ctx.errHandler.ServeHTTP(w, req, err)
+			return
+		}
+		dialer.TLSClientConfig = cfg
+	}
 
-	if outReq.URL.Scheme == "wss" && f.tlsClientConfig != nil {
-		dialer.TLSClientConfig = f.tlsClientConfig.Clone()
+	if outReq.URL.Scheme == "wss" && dialer.TLSClientConfig != nil {
+		dialer.TLSClientConfig = dialer.TLSClientConfig.Clone()
 		// WebSocket is only in http/1.1
 		dialer.TLSClientConfig.NextProtos = []string{"http/1.1"}
 	}
 	targetConn, resp, err := dialer.DialContext(outReq.Context(), outReq.URL.String(), outReq.Header)
 	if err != nil {
 		if resp == nil {
+			utils.RecordError(req, err)
 			ctx.errHandler.ServeHTTP(w, req, err)
 		} else {
 			f.log.Errorf("vulcand/oxy/forward/websocket: Error dialing %q: %v with resp: %d %s", outReq.Host, err, resp.StatusCode, resp.Status)
@@ -366,10 +562,11 @@ func (f *httpForwarder) serveWebSocket(w http.ResponseWriter, req *http.Request,
 			defer func() {
 				conn.Close()
 				if f.websocketConnectionClosedHook != nil {
-					f.websocketConnectionClosedHook(req, conn)
+					f.websocketConnectionClosedHook(withWebsocketCloseReason(req, WebsocketClosedBackendRejected), conn)
 				}
 			}()
 
+			removeHopHeaders(resp.Header)
 			errWrite := resp.Write(conn)
 			if errWrite != nil {
 				f.log.Errorf("vulcand/oxy/forward/websocket: Failed to forward response")
@@ -385,7 +582,9 @@ func (f *httpForwarder) serveWebSocket(w http.ResponseWriter, req *http.Request,
 		return true
 	}}
 
+	removeHopHeaders(resp.Header)
 	utils.RemoveHeaders(resp.Header, WebsocketUpgradeHeaders...)
+	f.stampResponse(resp.Header, resp.ProtoMajor, resp.ProtoMinor)
 	utils.CopyHeaders(resp.Header, w.Header())
 
 	underlyingConn, err := upgrader.Upgrade(w, req, resp.Header)
@@ -393,17 +592,31 @@ func (f *httpForwarder) serveWebSocket(w http.ResponseWriter, req *http.Request,
 		f.log.Errorf("vulcand/oxy/forward/websocket: Error while upgrading connection : %v", err)
 		return
 	}
+	if f.websocketMaxMessageSize > 0 {
+		underlyingConn.SetReadLimit(f.websocketMaxMessageSize)
+		targetConn.SetReadLimit(f.websocketMaxMessageSize)
+	}
+
+	var reason WebsocketCloseReason
 	defer func() {
 		underlyingConn.Close()
 		targetConn.Close()
 		if f.websocketConnectionClosedHook != nil {
-			f.websocketConnectionClosedHook(req, underlyingConn.UnderlyingConn())
+			f.websocketConnectionClosedHook(withWebsocketCloseReason(req, reason), underlyingConn.UnderlyingConn())
 		}
 	}()
 
+	// lastActivity is the time of the last proxied message and pongs the time of
+	// the last pong answering our pings, indexed by the direction of their sender
+	lastActivity := time.Now().UnixNano()
+	var pongs [2]int64
+	touch := func() {
+		atomic.StoreInt64(&lastActivity, time.Now().UnixNano())
+	}
+
 	errClient := make(chan error, 1)
 	errBackend := make(chan error, 1)
-	replicateWebsocketConn := func(dst, src *websocket.Conn, errc chan error) {
+	replicateWebsocketConn := func(dst, src *websocket.Conn, direction WebsocketDirection, errc chan error) {
 
 		forward := func(messageType int, reader io.Reader) error {
 			writer, err := dst.NextWriter(messageType)
@@ -418,10 +631,16 @@ func (f *httpForwarder) serveWebSocket(w http.ResponseWriter, req *http.Request,
 		}
 
 		src.SetPingHandler(func(data string) error {
+			touch()
 			return forward(websocket.PingMessage, bytes.NewReader([]byte(data)))
 		})
 
 		src.SetPongHandler(func(data string) error {
+			if data == websocketPingPayload {
+				atomic.StoreInt64(&pongs[direction], time.Now().UnixNano())
+				return nil
+			}
+			touch()
 			return forward(websocket.PongMessage, bytes.NewReader([]byte(data)))
 		})
 
@@ -430,7 +649,9 @@ func (f *httpForwarder) serveWebSocket(w http.ResponseWriter, req *http.Request,
 
 			if err != nil {
 				m := websocket.FormatCloseMessage(websocket.CloseNormalClosure, fmt.Sprintf("%v", err))
-				if e, ok := err.(*websocket.CloseError); ok {
+				if err == websocket.ErrReadLimit {
+					m = websocket.FormatCloseMessage(websocket.CloseMessageTooBig, "")
+				} else if e, ok := err.(*websocket.CloseError); ok {
 					if e.Code != websocket.CloseNoStatusReceived {
 						m = nil
 						// Following codes are not valid on the wire so just close the
@@ -448,30 +669,139 @@ func (f *httpForwarder) serveWebSocket(w http.ResponseWriter, req *http.Request,
 				}
 				break
 			}
+			touch()
+
+			if f.websocketInterceptor != nil && (msgType == websocket.TextMessage || msgType == websocket.BinaryMessage) {
+				// the size of the payload is bounded by the read limit of src, see WebsocketMaxMessageSize
+				payload, err := ioutil.ReadAll(reader)
+				if err != nil {
+					closeTooBig(dst, err)
+					errc <- err
+					break
+				}
+
+				msg := &WebsocketMessage{Direction: direction, Type: msgType, Payload: payload}
+				err = f.websocketInterceptor.InterceptMessage(req, msg)
+				if err == nil && msg.Type != websocket.TextMessage && msg.Type != websocket.BinaryMessage {
+					err = fmt.Errorf("invalid websocket message type %d", msg.Type)
+				}
+				if err == ErrWebsocketDropMessage {
+					continue
+				}
+				if err != nil {
+					closeErr := interceptorCloseError(err)
+					m := websocket.FormatCloseMessage(closeErr.Code, closeErr.Text)
+					deadline := time.Now().Add(time.Second)
+					dst.WriteControl(websocket.CloseMessage, m, deadline)
+					src.WriteControl(websocket.CloseMessage, m, deadline)
+					errc <- interceptedCloseError{closeErr}
+					break
+				}
+				msgType, reader = msg.Type, bytes.NewReader(msg.Payload)
+			}
+
 			err = forward(msgType, reader)
 			if err != nil {
+				closeTooBig(dst, err)
 				errc <- err
 				break
 			}
 		}
 	}
 
-	go replicateWebsocketConn(underlyingConn, targetConn, errClient)
-	go replicateWebsocketConn(targetConn, underlyingConn, errBackend)
+	go replicateWebsocketConn(underlyingConn, targetConn, WebsocketBackendToClient, errClient)
+	go replicateWebsocketConn(targetConn, underlyingConn, WebsocketClientToBackend, errBackend)
+
+	var idleC, lifetimeC, pingC <-chan time.Time
+	var idleTimer *time.Timer
+	if f.websocketIdleTimeout > 0 {
+		idleTimer = time.NewTimer(f.websocketIdleTimeout)
+		defer idleTimer.Stop()
+		idleC = idleTimer.C
+	}
+	if f.websocketMaxLifetime > 0 {
+		lifetimeTimer := time.NewTimer(f.websocketMaxLifetime)
+		defer lifetimeTimer.Stop()
+		lifetimeC = lifetimeTimer.C
+	}
+	if f.websocketPingInterval > 0 {
+		pingTicker := time.NewTicker(f.websocketPingInterval)
+		defer pingTicker.Stop()
+		pingC = pingTicker.C
+	}
 
 	var message string
-	select {
-	case err = <-errClient:
-		message = "vulcand/oxy/forward/websocket: Error when copying from backend to client: %v"
-	case err = <-errBackend:
-		message = "vulcand/oxy/forward/websocket: Error when copying from client to backend: %v"
+	var lastPing int64
+loop:
+	for {
+		select {
+		case err = <-errClient:
+			message = "vulcand/oxy/forward/websocket: Error when copying from backend to client: %v"
+			reason = WebsocketClosedByBackend
+			break loop
+		case err = <-errBackend:
+			message = "vulcand/oxy/forward/websocket: Error when copying from client to backend: %v"
+			reason = WebsocketClosedByClient
+			break loop
+		case <-idleC:
+			idle := time.Since(time.Unix(0, atomic.LoadInt64(&lastActivity)))
+			if idle < f.websocketIdleTimeout {
+				idleTimer.Reset(f.websocketIdleTimeout - idle)
+				continue
+			}
+			reason = WebsocketClosedIdleTimeout
+			break loop
+		case <-lifetimeC:
+			reason = WebsocketClosedMaxLifetime
+			break loop
+		case now := <-pingC:
+			if lastPing != 0 && (atomic.LoadInt64(&pongs[WebsocketClientToBackend]) < lastPing ||
+				atomic.LoadInt64(&pongs[WebsocketBackendToClient]) < lastPing) {
+				reason = WebsocketClosedPingTimeout
+				break loop
+			}
+			lastPing = now.UnixNano()
+			deadline := now.Add(f.websocketPingInterval)
+			underlyingConn.WriteControl(websocket.PingMessage, []byte(websocketPingPayload), deadline)
+			targetConn.WriteControl(websocket.PingMessage, []byte(websocketPingPayload), deadline)
+		}
+	}
 
+	switch reason {
+	case WebsocketClosedIdleTimeout, WebsocketClosedMaxLifetime, WebsocketClosedPingTimeout:
+		f.log.Debugf("vulcand/oxy/forward/websocket: Closing connection: %v", reason)
+		m := websocket.FormatCloseMessage(websocket.CloseGoingAway, reason.String())
+		deadline := time.Now().Add(time.Second)
+		underlyingConn.WriteControl(websocket.CloseMessage, m, deadline)
+		targetConn.WriteControl(websocket.CloseMessage, m, deadline)
+		return
+	}
+
+	if _, ok := err.(interceptedCloseError); ok {
+		reason = WebsocketClosedByInterceptor
+		return
 	}
 	if e, ok := err.(*websocket.CloseError); !ok || e.Code == websocket.CloseAbnormalClosure {
 		f.log.Errorf(message, err)
 	}
 }
 
+// newWebsocketDialer creates a websocket dialer sharing the proxy, dial function
+// and buffer sizes of the round tripper when it is an *http.Transport
+func newWebsocketDialer(rt http.RoundTripper) *websocket.Dialer {
+	dialer := &websocket.Dialer{
+		Proxy:            http.ProxyFromEnvironment,
+		HandshakeTimeout: 45 * time.Second,
+	}
+	if ht, ok := rt.(*http.Transport); ok {
+		dialer.Proxy = ht.Proxy
+		dialer.NetDialContext = ht.DialContext
+		dialer.ReadBufferSize = ht.ReadBufferSize
+		dialer.WriteBufferSize = ht.WriteBufferSize
+	}
+	return dialer
+}
+
 // copyWebsocketRequest makes a copy of the specified request.
 func (f *httpForwarder) copyWebSocketRequest(req *http.Request) (outReq *http.Request) {
 	outReq = new(http.Request)
@@ -484,31 +814,37 @@ func (f *httpForwarder) copyWebSocketRequest(req *http.Request) (outReq *http.Re
 	switch req.URL.Scheme {
 	case "https":
 		outReq.URL.Scheme = "wss"
-	case "http":
+	case "http", "unix", unixSocketScheme:
 		outReq.URL.Scheme = "ws"
 	}
 
 	u := f.getUrlFromRequest(outReq)
+	if utils.IsUnixSocketURL(req.URL) && outReq.RequestURI == "" {
+		// the path of the target is the socket path
+		u = &url.URL{Path: "/", RawQuery: u.RawQuery}
+	}
 
 	outReq.URL.Path = u.Path
 	outReq.URL.RawPath = u.RawPath
 	outReq.URL.RawQuery = u.RawQuery
 	outReq.RequestURI = "" // Outgoing request should not have RequestURI
 
-	outReq.URL.Host = req.URL.Host
+	outReq.URL.Host = f.targetHost(req.URL)
 	if !f.passHost {
-		outReq.Host = req.URL.Host
+		outReq.Host = f.targetHost(req.URL)
 	}
 
 	outReq.Header = make(http.Header)
 	// gorilla websocket use this header to set the request.Host tested in checkSameOrigin
 	outReq.Header.Set("Host", outReq.Host)
 	utils.CopyHeaders(outReq.Header, req.Header)
+	removeHopHeaders(outReq.Header)
 	utils.RemoveHeaders(outReq.Header, WebsocketDialHeaders...)
 
 	if f.rewriter != nil {
 		f.rewriter.Rewrite(outReq)
 	}
+	f.stampRequest(outReq, req.ProtoMajor, req.ProtoMinor)
 	return outReq
 }
 
@@ -528,15 +864,41 @@ func (f *httpForwarder) serveHTTP(w http.ResponseWriter, inReq *http.Request, ct
 	revproxy := httputil.ReverseProxy{
 		Director: func(req *http.Request) {
 			f.modifyRequest(req, inReq.URL)
+			if f.expectContinue == ExpectContinueLocal {
+				// the body is sent right away, reading it answers 100 Continue to the client
+				req.Header.Del(Expect)
+			}
 		},
-		Transport:      f.roundTripper,
-		FlushInterval:  f.flushInterval,
-		ModifyResponse: f.modifyResponse,
-		BufferPool:     f.bufferPool,
+		Transport:     f.roundTripper,
+		FlushInterval: f.flushInterval,
+		BufferPool:    f.bufferPool,
+	}
+	revproxy.ModifyResponse = func(resp *http.Response) error {
+		if f.modifyResponse != nil {
+			if err := f.modifyResponse(resp); err != nil {
+				return err
+			}
+		}
+		f.stampResponse(resp.Header, resp.ProtoMajor, resp.ProtoMinor)
+		// the flush interval of the response is read once it is modified
+		if f.isStreamingResponse(resp) {
+			revproxy.FlushInterval = -1
+		}
+		return nil
 	}
 
+	var tracker *timingTracker
+	timingRecord := utils.GetTimingRecord(inReq)
+	if f.timingHook != nil || timingRecord != nil {
+		tracker = newTimingTracker()
+		outReq = outReq.WithContext(httptrace.WithClientTrace(outReq.Context(), tracker.clientTrace()))
+	}
+
+	iw := newInterimResponseWriter(w, inReq, f)
+	outReq = outReq.WithContext(httptrace.WithClientTrace(outReq.Context(), iw.clientTrace()))
+
 	if f.log.GetLevel() >= log.DebugLevel {
-		pw := utils.NewProxyWriter(w)
+		pw := utils.NewProxyWriter(iw)
 		revproxy.ServeHTTP(pw, outReq)
 
 		if inReq.TLS != nil {
@@ -551,7 +913,17 @@ func (f *httpForwarder) serveHTTP(w http.ResponseWriter, inReq *http.Request, ct
 				inReq.URL, pw.StatusCode(), pw.GetLength(), time.Now().UTC().Sub(start))
 		}
 	} else {
-		revproxy.ServeHTTP(w, outReq)
+		revproxy.ServeHTTP(iw, outReq)
+	}
+
+	if tracker != nil {
+		timing := tracker.finish()
+		if timingRecord != nil {
+			timingRecord.Record(timing)
+		}
+		if f.timingHook != nil {
+			f.timingHook(inReq, timing)
+		}
 	}
 
 	for key := range w.Header() {
@@ -54,6 +54,45 @@ func TestForwardHopHeaders(t *testing.T) {
 	assert.Equal(t, expectedHost, outHost)
 }
 
+// Makes sure the headers listed in the Connection header are removed, and can't remove those set by the proxy
+func TestForwardConnectionHeaders(t *testing.T) {
+	var outHeaders http.Header
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		outHeaders = req.Header
+		w.Header().Set(Connection, "X-Backend")
+		w.Header().Set("X-Backend", "secret")
+		w.Header().Set("X-Response", "value")
+		w.Write([]byte("hello"))
+	})
+	defer srv.Close()
+
+	f, err := New()
+	require.NoError(t, err)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	headers := http.Header{
+		Connection: []string{"X-Forwarded-Proto, X-Secret, te"},
+		"X-Secret": []string{"secret"},
+		Te:         []string{"trailers"},
+	}
+
+	re, body, err := testutils.Get(proxy.URL, testutils.Headers(headers))
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(body))
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, "", outHeaders.Get(Connection))
+	assert.Equal(t, "", outHeaders.Get("X-Secret"))
+	assert.Equal(t, "http", outHeaders.Get(XForwardedProto))
+	assert.Equal(t, "trailers", outHeaders.Get(Te))
+	assert.Equal(t, "", re.Header.Get("X-Backend"))
+	assert.Equal(t, "value", re.Header.Get("X-Response"))
+}
+
 func TestDefaultErrHandler(t *testing.T) {
 	f, err := New()
 	require.NoError(t, err)
@@ -353,7 +392,9 @@ func TestChunkedResponseConversion(t *testing.T) {
 	require.NoError(t, err)
 	assert.Equal(t, "testtest1test2", string(body))
 	assert.Equal(t, http.StatusOK, re.StatusCode)
-	assert.Equal(t, fmt.Sprintf("%d", len("testtest1test2")), re.Header.Get("Content-Length"))
+	// responses of unknown length are streamed
+	assert.Empty(t, re.Header.Get("Content-Length"))
+	assert.Equal(t, []string{"chunked"}, re.TransferEncoding)
 }
 
 func TestContextWithValueInErrHandler(t *testing.T) {
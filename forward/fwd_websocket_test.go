@@ -2,12 +2,14 @@ package forward
 
 import (
 	"bufio"
+	"context"
 	"crypto/tls"
 	"fmt"
 	"net"
 	"net/http"
 	"net/http/httptest"
 	"runtime"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -206,6 +208,44 @@ func TestWebSocketEcho(t *testing.T) {
 	conn.Close()
 }
 
+func TestWebSocketConnectionHeaders(t *testing.T) {
+	f, err := New()
+	require.NoError(t, err)
+
+	headers := make(chan http.Header, 1)
+	mux := http.NewServeMux()
+	mux.Handle("/ws", websocket.Handler(func(conn *websocket.Conn) {
+		headers <- conn.Request().Header
+		conn.Write([]byte("ok"))
+		conn.Close()
+	}))
+
+	srv := testutils.NewHandler(mux.ServeHTTP)
+	defer srv.Close()
+
+	proxy := createProxyWithForwarder(f, srv.URL)
+	defer proxy.Close()
+
+	conn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// the websocket clients don't let the Connection header be extended
+	_, err = conn.Write([]byte("GET /ws HTTP/1.1\r\nHost: example.com\r\nOrigin: http://example.com\r\n" +
+		"Connection: Upgrade, X-Secret\r\nUpgrade: websocket\r\nSec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n" +
+		"X-Secret: secret\r\nKeep-Alive: timeout=5\r\nX-Endpoint: ws\r\n\r\n"))
+	require.NoError(t, err)
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+
+	h := <-headers
+	assert.Empty(t, h.Get("X-Secret"))
+	assert.Empty(t, h.Get(KeepAlive))
+	assert.Equal(t, "ws", h.Get("X-Endpoint"))
+}
+
 func TestWebSocketPassHost(t *testing.T) {
 	testCases := []struct {
 		desc     string
@@ -717,6 +757,60 @@ func TestWebSocketTransferTLSConfig(t *testing.T) {
 	assert.Equal(t, "ok", resp)
 }
 
+func TestWebSocketDialer(t *testing.T) {
+	srv := createTLSWebsocketServer()
+	defer srv.Close()
+
+	var dialed int32
+	dialer := &gorillawebsocket.Dialer{
+		HandshakeTimeout: time.Second,
+		TLSClientConfig:  &tls.Config{InsecureSkipVerify: true},
+		NetDialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			atomic.AddInt32(&dialed, 1)
+			return (&net.Dialer{}).DialContext(ctx, network, addr)
+		},
+	}
+
+	f, err := New(PassHostHeader(true), WebsocketDialer(dialer))
+	require.NoError(t, err)
+
+	proxy := createProxyWithForwarder(f, srv.URL)
+	defer proxy.Close()
+
+	resp, err := newWebsocketRequest(
+		withServer(proxy.Listener.Addr().String()),
+		withPath("/ws"),
+		withData("ok"),
+	).send()
+
+	require.NoError(t, err)
+	assert.Equal(t, "ok", resp)
+	assert.EqualValues(t, 1, atomic.LoadInt32(&dialed))
+	assert.Nil(t, dialer.TLSClientConfig.NextProtos)
+	assert.Nil(t, gorillawebsocket.DefaultDialer.TLSClientConfig)
+}
+
+func TestWebSocketTLSClientConfigDoesNotLeak(t *testing.T) {
+	srv := createTLSWebsocketServer()
+	defer srv.Close()
+
+	f, err := New(PassHostHeader(true), WebsocketTLSClientConfig(&tls.Config{InsecureSkipVerify: true}))
+	require.NoError(t, err)
+
+	proxy := createProxyWithForwarder(f, srv.URL)
+	defer proxy.Close()
+
+	resp, err := newWebsocketRequest(
+		withServer(proxy.Listener.Addr().String()),
+		withPath("/ws"),
+		withData("ok"),
+	).send()
+
+	require.NoError(t, err)
+	assert.Equal(t, "ok", resp)
+	assert.Nil(t, gorillawebsocket.DefaultDialer.TLSClientConfig)
+}
+
 const dialTimeout = time.Second
 
 type websocketRequestOpt func(w *websocketRequest)
@@ -0,0 +1,134 @@
+package forward
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vulcand/oxy/utils"
+)
+
+// gRPC status codes, see https://github.com/grpc/grpc/blob/master/doc/statuscodes.md
+const (
+	grpcCodeCanceled         = 1
+	grpcCodeDeadlineExceeded = 4
+	grpcCodeUnavailable      = 14
+)
+
+// GRPC enables the gRPC mode of the HTTP forwarder:
+// upstreams are reached over HTTP/2 (h2c for http targets) unless UpstreamProtocolSelector is set,
+// responses are flushed immediately to support bidirectional streaming,
+// the grpc-timeout request header is honoured as the request deadline
+// and upstream errors are reported to gRPC clients as grpc-status/grpc-message trailers.
+func GRPC(b bool) optSetter {
+	return func(f *Forwarder) error {
+		f.grpc = b
+		return nil
+	}
+}
+
+// IsGRPCRequest determines if the specified HTTP request is a gRPC request
+func IsGRPCRequest(req *http.Request) bool {
+	return strings.HasPrefix(req.Header.Get(ContentType), "application/grpc")
+}
+
+// grpcProtocolSelector speaks HTTP/2 over TLS to https targets and h2c to the others
+func grpcProtocolSelector(target *url.URL) Protocol {
+	if target.Scheme == "https" {
+		return ProtocolHTTP2
+	}
+	return ProtocolH2C
+}
+
+// GRPCErrorHandler reports errors to gRPC clients as grpc-status/grpc-message trailers
+// and delegates non gRPC requests to utils.DefaultHandler
+type GRPCErrorHandler struct{}
+
+func (e *GRPCErrorHandler) ServeHTTP(w http.ResponseWriter, req *http.Request, err error) {
+	if !IsGRPCRequest(req) {
+		utils.DefaultHandler.ServeHTTP(w, req, err)
+		return
+	}
+
+	code := grpcCodeUnavailable
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		code = grpcCodeDeadlineExceeded
+	} else if errors.Is(err, context.DeadlineExceeded) {
+		code = grpcCodeDeadlineExceeded
+	} else if errors.Is(err, context.Canceled) {
+		code = grpcCodeCanceled
+	}
+
+	w.Header().Set(ContentType, "application/grpc")
+	w.Header().Set(http.TrailerPrefix+GRPCStatus, strconv.Itoa(code))
+	w.Header().Set(http.TrailerPrefix+GRPCMessage, encodeGRPCMessage(err.Error()))
+	w.WriteHeader(http.StatusOK)
+	log.Debugf("'grpc-status %d' caused by: %v", code, err)
+}
+
+// encodeGRPCMessage percent-encodes the message as required for the grpc-message header
+func encodeGRPCMessage(msg string) string {
+	var sb strings.Builder
+	for i := 0; i < len(msg); i++ {
+		c := msg[i]
+		if c >= ' ' && c <= '~' && c != '%' {
+			sb.WriteByte(c)
+		} else {
+			sb.WriteString(fmt.Sprintf("%%%02X", c))
+		}
+	}
+	return sb.String()
+}
+
+// parseGRPCTimeout parses the value of the grpc-timeout header: at most 8 digits followed by a unit
+func parseGRPCTimeout(value string) (time.Duration, bool) {
+	if len(value) < 2 || len(value) > 9 {
+		return 0, false
+	}
+
+	var unit time.Duration
+	switch value[len(value)-1] {
+	case 'H':
+		unit = time.Hour
+	case 'M':
+		unit = time.Minute
+	case 'S':
+		unit = time.Second
+	case 'm':
+		unit = time.Millisecond
+	case 'u':
+		unit = time.Microsecond
+	case 'n':
+		unit = time.Nanosecond
+	default:
+		return 0, false
+	}
+
+	v, err := strconv.ParseInt(value[:len(value)-1], 10, 64)
+	if err != nil || v < 0 {
+		return 0, false
+	}
+	if v > math.MaxInt64/int64(unit) {
+		return math.MaxInt64, true
+	}
+	return time.Duration(v) * unit, true
+}
+
+// withGRPCDeadline returns the request bound to the deadline of its grpc-timeout header, if any
+func withGRPCDeadline(req *http.Request) (*http.Request, context.CancelFunc) {
+	timeout, ok := parseGRPCTimeout(req.Header.Get(GRPCTimeout))
+	if !ok {
+		return req, func() {}
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), timeout)
+	return req.WithContext(ctx), cancel
+}
@@ -0,0 +1,225 @@
+package forward
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/testutils"
+	"github.com/vulcand/oxy/utils"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+func TestGRPCForward(t *testing.T) {
+	var proto, te string
+	srv := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		proto = req.Proto
+		te = req.Header.Get(Te)
+		body, _ := ioutil.ReadAll(req.Body)
+		w.Header().Set(ContentType, "application/grpc")
+		w.Header().Set("Trailer", GRPCStatus)
+		w.Write(body)
+		w.Header().Set(GRPCStatus, "0")
+	}), &http2.Server{}))
+	defer srv.Close()
+
+	f, err := New(GRPC(true))
+	require.NoError(t, err)
+
+	proxy := newGRPCProxy(f, srv.URL)
+	defer proxy.Close()
+
+	re, body, err := grpcPost(proxy.URL, "message", nil)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, "message", string(body))
+	assert.Equal(t, "0", re.Trailer.Get(GRPCStatus))
+	assert.Equal(t, "HTTP/2.0", proto)
+	assert.Equal(t, "trailers", te)
+}
+
+func TestGRPCErrors(t *testing.T) {
+	srv := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}), &http2.Server{}))
+	defer srv.Close()
+
+	testCases := []struct {
+		desc           string
+		target         string
+		headers        http.Header
+		expectedStatus string
+	}{
+		{
+			desc:           "unreachable upstream",
+			target:         "http://localhost:63450",
+			expectedStatus: "14",
+		},
+		{
+			desc:           "grpc-timeout expired",
+			target:         srv.URL,
+			headers:        http.Header{GRPCTimeout: []string{"50m"}},
+			expectedStatus: "4",
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			f, err := New(GRPC(true))
+			require.NoError(t, err)
+
+			proxy := newGRPCProxy(f, test.target)
+			defer proxy.Close()
+
+			re, _, err := grpcPost(proxy.URL, "", test.headers)
+			require.NoError(t, err)
+			assert.Equal(t, http.StatusOK, re.StatusCode)
+			assert.Equal(t, "application/grpc", re.Header.Get(ContentType))
+			assert.Equal(t, test.expectedStatus, re.Trailer.Get(GRPCStatus))
+			assert.NotEmpty(t, re.Trailer.Get(GRPCMessage))
+		})
+	}
+}
+
+// newGRPCProxy creates a h2c proxy forwarding to the target
+func newGRPCProxy(f *Forwarder, target string) *httptest.Server {
+	return httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(target)
+		f.ServeHTTP(w, req)
+	}), &http2.Server{}))
+}
+
+// grpcPost sends a gRPC like request over h2c and reads the whole response
+func grpcPost(url, body string, headers http.Header) (*http.Response, []byte, error) {
+	req, err := http.NewRequest(http.MethodPost, url, strings.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	utils.CopyHeaders(req.Header, headers)
+	req.Header.Set(ContentType, "application/grpc")
+	req.Header.Set(Te, "trailers")
+
+	client := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+			return net.Dial(network, addr)
+		},
+	}}
+	re, err := client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer re.Body.Close()
+	b, err := ioutil.ReadAll(re.Body)
+	return re, b, err
+}
+
+func TestGRPCErrorHandlerWrappedErrors(t *testing.T) {
+	testCases := []struct {
+		desc           string
+		err            error
+		expectedStatus string
+	}{
+		{
+			desc:           "wrapped timeout",
+			err:            fmt.Errorf("dial: %w", &net.OpError{Op: "dial", Err: timeoutError{}}),
+			expectedStatus: "4",
+		},
+		{
+			desc:           "wrapped deadline exceeded",
+			err:            fmt.Errorf("upstream: %w", context.DeadlineExceeded),
+			expectedStatus: "4",
+		},
+		{
+			desc:           "wrapped canceled",
+			err:            fmt.Errorf("upstream: %w", context.Canceled),
+			expectedStatus: "1",
+		},
+		{
+			desc:           "other error",
+			err:            errors.New("boom"),
+			expectedStatus: "14",
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			req := httptest.NewRequest(http.MethodPost, "http://localhost", nil)
+			req.Header.Set(ContentType, "application/grpc")
+			w := httptest.NewRecorder()
+
+			(&GRPCErrorHandler{}).ServeHTTP(w, req, test.err)
+
+			assert.Equal(t, http.StatusOK, w.Code)
+			assert.Equal(t, test.expectedStatus, w.Header().Get(http.TrailerPrefix+GRPCStatus))
+		})
+	}
+}
+
+// timeoutError is a net.Error reporting a timeout
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestGRPCErrorHandlerNonGRPCRequest(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	w := httptest.NewRecorder()
+
+	(&GRPCErrorHandler{}).ServeHTTP(w, req, errors.New("boom"))
+
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.Empty(t, w.Result().Trailer.Get(GRPCStatus))
+}
+
+func TestParseGRPCTimeout(t *testing.T) {
+	testCases := []struct {
+		value    string
+		expected time.Duration
+		ok       bool
+	}{
+		{value: "", ok: false},
+		{value: "1", ok: false},
+		{value: "10x", ok: false},
+		{value: "-1S", ok: false},
+		{value: "123456789S", ok: false},
+		{value: "1H", expected: time.Hour, ok: true},
+		{value: "2M", expected: 2 * time.Minute, ok: true},
+		{value: "3S", expected: 3 * time.Second, ok: true},
+		{value: "4m", expected: 4 * time.Millisecond, ok: true},
+		{value: "5u", expected: 5 * time.Microsecond, ok: true},
+		{value: "6n", expected: 6 * time.Nanosecond, ok: true},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.value, func(t *testing.T) {
+			t.Parallel()
+
+			actual, ok := parseGRPCTimeout(test.value)
+			assert.Equal(t, test.ok, ok)
+			assert.Equal(t, test.expected, actual)
+		})
+	}
+}
+
+func TestEncodeGRPCMessage(t *testing.T) {
+	assert.Equal(t, "dial tcp: connection refused", encodeGRPCMessage("dial tcp: connection refused"))
+	assert.Equal(t, "100%25 d%C3%A9j%C3%A0%0A", encodeGRPCMessage("100% déjà\n"))
+}
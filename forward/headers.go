@@ -1,5 +1,11 @@
 package forward
 
+import (
+	"net/http"
+
+	"github.com/vulcand/oxy/utils"
+)
+
 // Headers
 const (
 	XForwardedProto        = "X-Forwarded-Proto"
@@ -7,7 +13,10 @@ const (
 	XForwardedHost         = "X-Forwarded-Host"
 	XForwardedPort         = "X-Forwarded-Port"
 	XForwardedServer       = "X-Forwarded-Server"
+	XForwardedPrefix       = "X-Forwarded-Prefix"
+	XOriginalURI           = "X-Original-Uri"
 	XRealIp                = "X-Real-Ip"
+	Forwarded              = "Forwarded"
 	Connection             = "Connection"
 	KeepAlive              = "Keep-Alive"
 	ProxyAuthenticate      = "Proxy-Authenticate"
@@ -21,6 +30,14 @@ const (
 	SecWebsocketVersion    = "Sec-Websocket-Version"
 	SecWebsocketExtensions = "Sec-Websocket-Extensions"
 	SecWebsocketAccept     = "Sec-Websocket-Accept"
+	ContentType            = "Content-Type"
+	GRPCStatus             = "Grpc-Status"
+	GRPCMessage            = "Grpc-Message"
+	GRPCTimeout            = "Grpc-Timeout"
+	Location               = "Location"
+	ContentLocation        = "Content-Location"
+	Refresh                = "Refresh"
+	SetCookie              = "Set-Cookie"
 )
 
 // HopHeaders Hop-by-hop headers. These are removed when sent to the backend.
@@ -62,5 +79,25 @@ var XHeaders = []string{
 	XForwardedHost,
 	XForwardedPort,
 	XForwardedServer,
+	XForwardedPrefix,
+	XOriginalURI,
 	XRealIp,
 }
+
+// removeHopHeaders removes the hop-by-hop headers, those of HopHeaders and those listed in the Connection header
+func removeHopHeaders(h http.Header) {
+	utils.RemoveConnectionHeaders(h)
+	utils.RemoveHeaders(h, HopHeaders...)
+}
+
+// cleanConnectionHeader removes the headers listed in the Connection header of the client, so that they can't
+// remove the headers set by the proxy. Only the upgrade option is kept, for httputil.ReverseProxy to handle it,
+// which also keeps "Te: trailers" on its own.
+func cleanConnectionHeader(h http.Header) {
+	upgrade := headerContainsToken(h, Connection, "upgrade")
+	utils.RemoveConnectionHeaders(h, Upgrade)
+	h.Del(Connection)
+	if upgrade {
+		h.Set(Connection, "Upgrade")
+	}
+}
@@ -0,0 +1,183 @@
+package forward
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/textproto"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// Expect is the header of the requests waiting for a 100 Continue response before sending their body
+const Expect = "Expect"
+
+// ExpectContinueMode defines how the requests with "Expect: 100-continue" are handled
+type ExpectContinueMode int
+
+const (
+	// ExpectContinueRelay forwards the expectation to the backend, the client receives 100 Continue once the backend asks for the body.
+	// The transport must wait for the 100 Continue of the backend, see http.Transport.ExpectContinueTimeout.
+	ExpectContinueRelay ExpectContinueMode = iota
+	// ExpectContinueLocal answers 100 Continue to the client as soon as the request is forwarded,
+	// the body is sent to the backend without expectation
+	ExpectContinueLocal
+)
+
+// InterimResponses defines whether the 1xx informational responses of the backends other than 100 Continue,
+// e.g. 103 Early Hints and their Link headers, are relayed to the clients. They are by default.
+func InterimResponses(relay bool) optSetter {
+	return func(f *Forwarder) error {
+		f.httpForwarder.suppressInterim = !relay
+		return nil
+	}
+}
+
+// ExpectContinue defines how the requests with "Expect: 100-continue" are handled, ExpectContinueRelay by default
+func ExpectContinue(mode ExpectContinueMode) optSetter {
+	return func(f *Forwarder) error {
+		if mode != ExpectContinueRelay && mode != ExpectContinueLocal {
+			return fmt.Errorf("invalid expect continue mode: %d", mode)
+		}
+		f.httpForwarder.expectContinue = mode
+		return nil
+	}
+}
+
+// expectsContinue reports whether the client waits for a 100 Continue response before sending the body
+func expectsContinue(req *http.Request) bool {
+	return strings.EqualFold(strings.TrimSpace(req.Header.Get(Expect)), "100-continue")
+}
+
+// isInterimCode reports whether the status code is the one of an informational response followed by the final one
+func isInterimCode(code int) bool {
+	return code >= 100 && code < 200 && code != http.StatusSwitchingProtocols
+}
+
+// interimResponseWriter relays the 1xx informational responses of the backend to the client, or drops them.
+// Recent versions of httputil.ReverseProxy relay them by writing their status code, the older ones ignore them:
+// they are then relayed by the Got1xxResponse hook of the client trace of the writer.
+type interimResponseWriter struct {
+	http.ResponseWriter
+
+	relayInterim  bool
+	relayContinue bool
+
+	mutex sync.Mutex
+	// pending counts the informational responses written by httputil.ReverseProxy not yet seen by the hook
+	pending   int
+	continued bool
+	done      bool
+}
+
+func newInterimResponseWriter(w http.ResponseWriter, req *http.Request, f *httpForwarder) *interimResponseWriter {
+	return &interimResponseWriter{
+		ResponseWriter: w,
+		relayInterim:   !f.suppressInterim,
+		relayContinue:  f.expectContinue == ExpectContinueRelay && expectsContinue(req),
+	}
+}
+
+func (w *interimResponseWriter) WriteHeader(code int) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if !isInterimCode(code) {
+		w.done = true
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+
+	w.pending++
+	w.writeInterim(code)
+}
+
+func (w *interimResponseWriter) Write(b []byte) (int, error) {
+	w.mutex.Lock()
+	w.done = true
+	w.mutex.Unlock()
+	return w.ResponseWriter.Write(b)
+}
+
+// writeInterim writes the informational response whose headers are set, unless it is dropped
+func (w *interimResponseWriter) writeInterim(code int) {
+	if w.done {
+		return
+	}
+	if code == http.StatusContinue {
+		// only the clients waiting for it get a single 100 Continue
+		if !w.relayContinue || w.continued {
+			return
+		}
+		w.continued = true
+	} else if !w.relayInterim {
+		return
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// clientTrace returns the trace relaying the informational responses httputil.ReverseProxy ignores
+func (w *interimResponseWriter) clientTrace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+			w.mutex.Lock()
+			defer w.mutex.Unlock()
+
+			if w.pending > 0 {
+				// already relayed by httputil.ReverseProxy, whose hook is called first
+				w.pending--
+				return nil
+			}
+
+			h := w.ResponseWriter.Header()
+			saved := h.Clone()
+			for name, values := range header {
+				h[name] = values
+			}
+			w.writeInterim(code)
+
+			for name := range h {
+				delete(h, name)
+			}
+			for name, values := range saved {
+				h[name] = values
+			}
+			return nil
+		},
+	}
+}
+
+// Flush flush the writer
+func (w *interimResponseWriter) Flush() {
+	w.mutex.Lock()
+	w.done = true
+	w.mutex.Unlock()
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// CloseNotify returns a channel that receives at most a single value (true)
+// when the client connection has gone away.
+func (w *interimResponseWriter) CloseNotify() <-chan bool {
+	if cn, ok := w.ResponseWriter.(http.CloseNotifier); ok {
+		return cn.CloseNotify()
+	}
+	return make(<-chan bool)
+}
+
+// Hijack lets the caller take over the connection.
+func (w *interimResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if hi, ok := w.ResponseWriter.(http.Hijacker); ok {
+		return hi.Hijack()
+	}
+	return nil, nil, fmt.Errorf("the response writer that was wrapped in this proxy, does not implement http.Hijacker. It is of type: %v", reflect.TypeOf(w.ResponseWriter))
+}
+
+// Unwrap returns the wrapped response writer, for http.ResponseController
+func (w *interimResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,224 @@
+package forward
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/testutils"
+)
+
+func TestEarlyHints(t *testing.T) {
+	testCases := []struct {
+		desc          string
+		options       []optSetter
+		expectedCodes []int
+		expectedLinks []string
+	}{
+		{
+			desc:          "relayed",
+			expectedCodes: []int{http.StatusEarlyHints},
+			expectedLinks: []string{"</style.css>; rel=preload; as=style"},
+		},
+		{
+			desc:    "suppressed",
+			options: []optSetter{InterimResponses(false)},
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+				w.Header().Set("Link", "</style.css>; rel=preload; as=style")
+				w.WriteHeader(http.StatusEarlyHints)
+				w.Header().Del("Link")
+				w.Write([]byte("hello"))
+			})
+			defer srv.Close()
+
+			f, err := New(test.options...)
+			require.NoError(t, err)
+
+			proxy := createProxyWithForwarder(f, srv.URL)
+			defer proxy.Close()
+
+			var codes []int
+			var links []string
+			trace := &httptrace.ClientTrace{
+				Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+					codes = append(codes, code)
+					links = append(links, header["Link"]...)
+					return nil
+				},
+			}
+			req, err := http.NewRequest(http.MethodGet, proxy.URL, nil)
+			require.NoError(t, err)
+			req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+
+			re, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			body, err := ioutil.ReadAll(re.Body)
+			re.Body.Close()
+			require.NoError(t, err)
+
+			assert.Equal(t, http.StatusOK, re.StatusCode)
+			assert.Equal(t, "hello", string(body))
+			assert.Empty(t, re.Header.Get("Link"))
+			assert.Equal(t, test.expectedCodes, codes)
+			assert.Equal(t, test.expectedLinks, links)
+		})
+	}
+}
+
+func TestExpectContinue(t *testing.T) {
+	testCases := []struct {
+		desc             string
+		mode             ExpectContinueMode
+		reject           bool
+		expectedExpect   string
+		expectedContinue bool
+		expectedCode     int
+	}{
+		{
+			desc:             "relayed",
+			mode:             ExpectContinueRelay,
+			expectedExpect:   "100-continue",
+			expectedContinue: true,
+			expectedCode:     http.StatusOK,
+		},
+		{
+			desc:             "rejected by the backend",
+			mode:             ExpectContinueRelay,
+			reject:           true,
+			expectedExpect:   "100-continue",
+			expectedContinue: false,
+			expectedCode:     http.StatusRequestEntityTooLarge,
+		},
+		{
+			desc:             "answered locally",
+			mode:             ExpectContinueLocal,
+			expectedContinue: true,
+			expectedCode:     http.StatusOK,
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			var expect string
+			srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+				expect = req.Header.Get(Expect)
+				if test.reject {
+					w.WriteHeader(http.StatusRequestEntityTooLarge)
+					return
+				}
+				body, _ := ioutil.ReadAll(req.Body)
+				w.Write(body)
+			})
+			defer srv.Close()
+
+			// a long timeout makes sure the 100 Continue responses are relayed rather than assumed
+			transport := &http.Transport{ExpectContinueTimeout: 10 * time.Second}
+			defer transport.CloseIdleConnections()
+
+			f, err := New(RoundTripper(transport), ExpectContinue(test.mode))
+			require.NoError(t, err)
+
+			proxy := createProxyWithForwarder(f, srv.URL)
+			defer proxy.Close()
+
+			var mutex sync.Mutex
+			continued := false
+			trace := &httptrace.ClientTrace{
+				Got100Continue: func() {
+					mutex.Lock()
+					continued = true
+					mutex.Unlock()
+				},
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			req, err := http.NewRequestWithContext(httptrace.WithClientTrace(ctx, trace), http.MethodPost, proxy.URL, strings.NewReader("large upload"))
+			require.NoError(t, err)
+			req.Header.Set(Expect, "100-continue")
+
+			client := &http.Client{Transport: &http.Transport{ExpectContinueTimeout: 10 * time.Second}}
+			defer client.CloseIdleConnections()
+
+			re, err := client.Do(req)
+			require.NoError(t, err)
+			body, err := ioutil.ReadAll(re.Body)
+			re.Body.Close()
+			require.NoError(t, err)
+
+			assert.Equal(t, test.expectedCode, re.StatusCode)
+			if test.expectedCode == http.StatusOK {
+				assert.Equal(t, "large upload", string(body))
+			}
+			assert.Equal(t, test.expectedExpect, expect)
+			mutex.Lock()
+			assert.Equal(t, test.expectedContinue, continued)
+			mutex.Unlock()
+		})
+	}
+
+	_, err := New(ExpectContinue(ExpectContinueMode(42)))
+	assert.Error(t, err)
+}
+
+// interimRecorder records the status codes and the headers written
+type interimRecorder struct {
+	*httptest.ResponseRecorder
+	codes []int
+	links []string
+}
+
+func (r *interimRecorder) WriteHeader(code int) {
+	r.codes = append(r.codes, code)
+	r.links = append(r.links, r.Header()["Link"]...)
+	r.ResponseRecorder.WriteHeader(code)
+}
+
+func TestInterimResponseWriterHook(t *testing.T) {
+	f, err := New()
+	require.NoError(t, err)
+
+	rec := &interimRecorder{ResponseRecorder: httptest.NewRecorder()}
+	rec.Header().Set("X-Middleware", "value")
+
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("body"))
+	req.Header.Set(Expect, "100-continue")
+	iw := newInterimResponseWriter(rec, req, f.httpForwarder)
+	trace := iw.clientTrace()
+
+	// relayed by the hook, as by the older versions of httputil.ReverseProxy
+	require.NoError(t, trace.Got1xxResponse(http.StatusContinue, nil))
+	require.NoError(t, trace.Got1xxResponse(http.StatusEarlyHints, textproto.MIMEHeader{"Link": {"</a.js>; rel=preload"}}))
+	assert.Equal(t, "value", rec.Header().Get("X-Middleware"))
+	assert.Empty(t, rec.Header().Get("Link"))
+
+	// relayed by httputil.ReverseProxy first, not twice
+	rec.Header().Set("Link", "</b.js>; rel=preload")
+	iw.WriteHeader(http.StatusEarlyHints)
+	rec.Header().Del("Link")
+	require.NoError(t, trace.Got1xxResponse(http.StatusEarlyHints, textproto.MIMEHeader{"Link": {"</b.js>; rel=preload"}}))
+
+	// a single 100 Continue
+	require.NoError(t, trace.Got1xxResponse(http.StatusContinue, nil))
+
+	iw.WriteHeader(http.StatusOK)
+	require.NoError(t, trace.Got1xxResponse(http.StatusEarlyHints, nil))
+
+	assert.Equal(t, []int{http.StatusContinue, http.StatusEarlyHints, http.StatusEarlyHints, http.StatusOK}, rec.codes)
+	assert.Equal(t, []string{"</a.js>; rel=preload", "</b.js>; rel=preload"}, rec.links)
+}
@@ -0,0 +1,207 @@
+package forward
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/vulcand/oxy/utils"
+)
+
+// Headers
+const (
+	Via         = "Via"
+	MaxForwards = "Max-Forwards"
+)
+
+// ViaPseudonym enables the RFC 7230 Via header: the forwarded requests and responses are stamped with the pseudonym
+// identifying this proxy, e.g. "oxy-edge". The requests whose Via or X-Forwarded-Server headers show they already went
+// through this proxy are rejected with utils.LoopDetectedError. It also enables the Max-Forwards handling, see serveMaxForwards.
+func ViaPseudonym(pseudonym string) optSetter {
+	return func(f *Forwarder) error {
+		pseudonym = strings.TrimSpace(pseudonym)
+		if pseudonym == "" || strings.ContainsAny(pseudonym, " \t,()") {
+			return fmt.Errorf("invalid via pseudonym %q", pseudonym)
+		}
+		f.httpForwarder.via = pseudonym
+		return nil
+	}
+}
+
+// MaxHops rejects with utils.LoopDetectedError the requests which went through more than max proxies according to their
+// Via header, there is no limit by default. It also enables the Max-Forwards handling, see serveMaxForwards.
+func MaxHops(max int) optSetter {
+	return func(f *Forwarder) error {
+		if max < 1 {
+			return fmt.Errorf("max hops should be >= 1")
+		}
+		f.httpForwarder.maxHops = max
+		return nil
+	}
+}
+
+// loopDetection reports whether ViaPseudonym or MaxHops is set, otherwise neither the Via headers nor Max-Forwards are checked
+func (f *httpForwarder) loopDetection() bool {
+	return f.via != "" || f.maxHops > 0
+}
+
+// checkLoop rejects the requests looping through this proxy or exceeding the hop limits
+func (f *Forwarder) checkLoop(req *http.Request) error {
+	if !f.loopDetection() {
+		return nil
+	}
+
+	proxies := viaProxies(req.Header)
+	if f.maxHops > 0 && len(proxies) > f.maxHops {
+		return &utils.LoopDetectedError{Reason: fmt.Sprintf("%d hops exceed the limit of %d", len(proxies), f.maxHops)}
+	}
+
+	if f.via == "" {
+		return nil
+	}
+	for _, proxy := range proxies {
+		if strings.EqualFold(proxy, f.via) {
+			return &utils.LoopDetectedError{Reason: fmt.Sprintf("%s already received the request", f.via)}
+		}
+	}
+	if hostname := forwardedServer(f.rewriter); hostname != "" {
+		for _, server := range req.Header[XForwardedServer] {
+			if strings.EqualFold(strings.TrimSpace(server), hostname) {
+				return &utils.LoopDetectedError{Reason: fmt.Sprintf("%s already forwarded the request", hostname)}
+			}
+		}
+	}
+	return nil
+}
+
+// forwardedServer returns the X-Forwarded-Server hostname of the HeaderRewriter, searched in the rewriter chains
+func forwardedServer(rewriter ReqRewriter) string {
+	switch rw := rewriter.(type) {
+	case *HeaderRewriter:
+		return rw.Hostname
+	case RewriterChain:
+		for _, r := range rw {
+			if hostname := forwardedServer(r); hostname != "" {
+				return hostname
+			}
+		}
+	}
+	return ""
+}
+
+// serveMaxForwards handles Max-Forwards as in RFC 7231 section 5.1.2 when loop detection is enabled: the TRACE and OPTIONS
+// requests whose Max-Forwards is 0 are answered by this proxy as their final recipient, stampRequest decrements it on the
+// others. Max-Forwards is passed through unchanged without loop detection. It returns false if the request is to be forwarded.
+func (f *Forwarder) serveMaxForwards(w http.ResponseWriter, req *http.Request) bool {
+	if !f.loopDetection() {
+		return false
+	}
+	if maxForwards, ok := requestMaxForwards(req); !ok || maxForwards != 0 {
+		return false
+	}
+
+	f.stampResponse(w.Header(), req.ProtoMajor, req.ProtoMinor)
+	if req.Method == http.MethodOptions {
+		w.Header().Set("Allow", strings.Join(allowedMethods, ", "))
+		w.Header().Set(ContentLength, "0")
+		w.WriteHeader(http.StatusOK)
+		return true
+	}
+
+	// the request is echoed without its credentials, RFC 7231 section 4.3.8
+	h := make(http.Header)
+	utils.CopyHeaders(h, req.Header)
+	for _, name := range []string{"Authorization", "Proxy-Authorization", "Cookie"} {
+		h.Del(name)
+	}
+	msg := &strings.Builder{}
+	fmt.Fprintf(msg, "%s %s %s\r\nHost: %s\r\n", req.Method, req.RequestURI, req.Proto, req.Host)
+	h.Write(msg)
+	msg.WriteString("\r\n")
+
+	w.Header().Set(ContentType, "message/http")
+	w.Header().Set(ContentLength, strconv.Itoa(msg.Len()))
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(msg.String()))
+	return true
+}
+
+// allowedMethods are the methods announced in the Allow header of the OPTIONS requests answered by this proxy
+var allowedMethods = []string{
+	http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+	http.MethodDelete, http.MethodOptions, http.MethodTrace,
+}
+
+// stampRequest adds this proxy to the Via header of the outgoing request and decrements its Max-Forwards, see serveMaxForwards
+func (f *httpForwarder) stampRequest(outReq *http.Request, protoMajor, protoMinor int) {
+	if f.via != "" {
+		outReq.Header.Add(Via, viaEntry(protoMajor, protoMinor, f.via))
+	}
+	if !f.loopDetection() {
+		return
+	}
+	if maxForwards, ok := requestMaxForwards(outReq); ok && maxForwards > 0 {
+		outReq.Header.Set(MaxForwards, strconv.Itoa(maxForwards-1))
+	}
+}
+
+// stampResponse adds this proxy to the Via header of the response
+func (f *httpForwarder) stampResponse(h http.Header, protoMajor, protoMinor int) {
+	if f.via != "" {
+		h.Add(Via, viaEntry(protoMajor, protoMinor, f.via))
+	}
+}
+
+func viaEntry(protoMajor, protoMinor int, pseudonym string) string {
+	return fmt.Sprintf("%d.%d %s", protoMajor, protoMinor, pseudonym)
+}
+
+// requestMaxForwards returns the Max-Forwards of the TRACE and OPTIONS requests, false if it is missing or invalid
+func requestMaxForwards(req *http.Request) (int, bool) {
+	if req.Method != http.MethodTrace && req.Method != http.MethodOptions {
+		return 0, false
+	}
+	value := req.Header.Get(MaxForwards)
+	if value == "" {
+		return 0, false
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return n, true
+}
+
+// viaProxies returns the received-by part of the entries of the Via headers, their comments excluded
+func viaProxies(h http.Header) []string {
+	var proxies []string
+	for _, value := range h[Via] {
+		depth := 0
+		entry := strings.Builder{}
+		flush := func() {
+			if fields := strings.Fields(entry.String()); len(fields) >= 2 {
+				proxies = append(proxies, fields[1])
+			} else if len(fields) == 1 {
+				// a malformed entry still counts as a hop
+				proxies = append(proxies, "")
+			}
+			entry.Reset()
+		}
+		for _, r := range value {
+			switch {
+			case r == '(':
+				depth++
+			case r == ')' && depth > 0:
+				depth--
+			case depth > 0:
+			case r == ',':
+				flush()
+			default:
+				entry.WriteRune(r)
+			}
+		}
+		flush()
+	}
+	return proxies
+}
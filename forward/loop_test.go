@@ -0,0 +1,190 @@
+package forward
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/testutils"
+)
+
+func TestViaHeader(t *testing.T) {
+	var outReq *http.Request
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		outReq = req
+		w.Header().Add(Via, "1.1 backend")
+		w.Write([]byte("hello"))
+	})
+	defer srv.Close()
+
+	f, err := New(ViaPseudonym("edge"))
+	require.NoError(t, err)
+
+	proxy := createProxyWithForwarder(f, srv.URL)
+	defer proxy.Close()
+
+	re, body, err := testutils.Get(proxy.URL, testutils.Header(Via, "1.0 client-proxy (Squid)"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, "hello", string(body))
+	assert.Equal(t, []string{"1.0 client-proxy (Squid)", "1.1 edge"}, outReq.Header[Via])
+	assert.Equal(t, []string{"1.1 backend", "1.1 edge"}, re.Header[Via])
+}
+
+func TestLoopDetection(t *testing.T) {
+	testCases := []struct {
+		desc                string
+		options             []optSetter
+		method              string
+		headers             map[string]string
+		expectedStatusCode  int
+		expectedMaxForwards string
+	}{
+		{
+			desc:               "no loop",
+			options:            []optSetter{ViaPseudonym("edge"), MaxHops(2)},
+			method:             http.MethodGet,
+			headers:            map[string]string{Via: "1.1 a, 1.1 b"},
+			expectedStatusCode: http.StatusOK,
+		},
+		{
+			desc:               "via loop",
+			options:            []optSetter{ViaPseudonym("edge")},
+			method:             http.MethodGet,
+			headers:            map[string]string{Via: "1.1 a (edge), HTTP/1.1 Edge"},
+			expectedStatusCode: http.StatusLoopDetected,
+		},
+		{
+			desc:               "via in a comment",
+			options:            []optSetter{ViaPseudonym("edge")},
+			method:             http.MethodGet,
+			headers:            map[string]string{Via: "1.1 a (edge)"},
+			expectedStatusCode: http.StatusOK,
+		},
+		{
+			desc:               "forwarded server loop",
+			options:            []optSetter{ViaPseudonym("edge"), Rewriter(&HeaderRewriter{Hostname: "edge-01"})},
+			method:             http.MethodGet,
+			headers:            map[string]string{XForwardedServer: "edge-01"},
+			expectedStatusCode: http.StatusLoopDetected,
+		},
+		{
+			desc: "forwarded server loop with a rewriter chain",
+			options: []optSetter{ViaPseudonym("edge"), Rewriter(RewriterChain{
+				&HeaderRewriter{Hostname: "edge-01"},
+				&StripPrefixRewriter{Prefix: "/api"},
+			})},
+			method:             http.MethodGet,
+			headers:            map[string]string{XForwardedServer: "edge-01"},
+			expectedStatusCode: http.StatusLoopDetected,
+		},
+		{
+			desc:               "too many hops",
+			options:            []optSetter{MaxHops(2)},
+			method:             http.MethodGet,
+			headers:            map[string]string{Via: "1.1 a, 1.1 b, 1.1 c"},
+			expectedStatusCode: http.StatusLoopDetected,
+		},
+		{
+			desc:                "max forwards without loop detection",
+			method:              http.MethodOptions,
+			headers:             map[string]string{MaxForwards: "0"},
+			expectedStatusCode:  http.StatusOK,
+			expectedMaxForwards: "0",
+		},
+		{
+			desc:               "max forwards exhausted",
+			options:            []optSetter{ViaPseudonym("edge")},
+			method:             http.MethodOptions,
+			headers:            map[string]string{MaxForwards: "0"},
+			expectedStatusCode: http.StatusOK,
+		},
+		{
+			desc:                "max forwards passed through without loop detection",
+			method:              http.MethodOptions,
+			headers:             map[string]string{MaxForwards: "1"},
+			expectedStatusCode:  http.StatusOK,
+			expectedMaxForwards: "1",
+		},
+		{
+			desc:                "max forwards decremented",
+			options:             []optSetter{MaxHops(5)},
+			method:              http.MethodTrace,
+			headers:             map[string]string{MaxForwards: "2"},
+			expectedStatusCode:  http.StatusOK,
+			expectedMaxForwards: "1",
+		},
+		{
+			desc:                "max forwards ignored",
+			options:             []optSetter{MaxHops(5)},
+			method:              http.MethodGet,
+			headers:             map[string]string{MaxForwards: "0"},
+			expectedStatusCode:  http.StatusOK,
+			expectedMaxForwards: "0",
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			var maxForwards string
+			srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+				maxForwards = req.Header.Get(MaxForwards)
+				w.Write([]byte("hello"))
+			})
+			defer srv.Close()
+
+			f, err := New(test.options...)
+			require.NoError(t, err)
+
+			proxy := createProxyWithForwarder(f, srv.URL)
+			defer proxy.Close()
+
+			opts := []testutils.ReqOption{testutils.Method(test.method)}
+			for name, value := range test.headers {
+				opts = append(opts, testutils.Header(name, value))
+			}
+			re, _, err := testutils.MakeRequest(proxy.URL, opts...)
+			require.NoError(t, err)
+			assert.Equal(t, test.expectedStatusCode, re.StatusCode)
+			assert.Equal(t, test.expectedMaxForwards, maxForwards)
+		})
+	}
+
+	_, err := New(ViaPseudonym("my proxy"))
+	assert.Error(t, err)
+
+	_, err = New(MaxHops(0))
+	assert.Error(t, err)
+}
+
+func TestMaxForwardsExhausted(t *testing.T) {
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		t.Error("the request should not be forwarded")
+	})
+	defer srv.Close()
+
+	f, err := New(MaxHops(10), ViaPseudonym("edge"))
+	require.NoError(t, err)
+
+	proxy := createProxyWithForwarder(f, srv.URL)
+	defer proxy.Close()
+
+	re, body, err := testutils.MakeRequest(proxy.URL+"/path", testutils.Method(http.MethodOptions), testutils.Header(MaxForwards, "0"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, "GET, HEAD, POST, PUT, PATCH, DELETE, OPTIONS, TRACE", re.Header.Get("Allow"))
+	assert.Equal(t, "1.1 edge", re.Header.Get(Via))
+	assert.Empty(t, body)
+
+	re, body, err = testutils.MakeRequest(proxy.URL+"/path", testutils.Method(http.MethodTrace),
+		testutils.Header(MaxForwards, "0"), testutils.Header("Cookie", "session=secret"), testutils.Header("X-Test", "a"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, "message/http", re.Header.Get(ContentType))
+	assert.True(t, strings.HasPrefix(string(body), "TRACE /path HTTP/1.1\r\n"), string(body))
+	assert.Contains(t, string(body), "X-Test: a\r\n")
+	assert.NotContains(t, string(body), "secret")
+}
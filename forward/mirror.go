@@ -0,0 +1,317 @@
+package forward
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vulcand/oxy/utils"
+)
+
+const (
+	defaultMirrorMaxBodySize    = 1024 * 1024
+	defaultMirrorTimeout        = 10 * time.Second
+	defaultMirrorMaxConcurrency = 100
+)
+
+// Mirror is a handler sending a copy of the requests to a shadow backend, the client only ever gets the response of next.
+// Mirrored requests are fire-and-forget: they run in the background with their own timeout and never delay
+// nor affect the primary requests. Requests are not mirrored when the concurrency limit is reached,
+// when their body exceeds the size limit, and for websocket, upgrade and CONNECT requests.
+//
+// In comparison mode, see MirrorDiff, the response of the mirror is compared with the response of next
+// and the differences are reported.
+type Mirror struct {
+	next   http.Handler
+	shadow http.Handler
+	target *url.URL
+
+	percent     float64
+	maxBodySize int64
+	timeout     time.Duration
+	slots       chan struct{}
+	maxSlots    int
+
+	report         func(*Diff)
+	diffHeaders    []string
+	ignoreFields   [][]string
+	ignorePatterns []*regexp.Regexp
+
+	log OxyLogger
+}
+
+type mirrorOptSetter func(m *Mirror) error
+
+// MirrorForwarder defines the handler forwarding the mirrored requests, a Forwarder with the default options by default
+func MirrorForwarder(h http.Handler) mirrorOptSetter {
+	return func(m *Mirror) error {
+		m.shadow = h
+		return nil
+	}
+}
+
+// MirrorPercent defines the percentage of the requests to mirror, from 0 to 100 (the default)
+func MirrorPercent(p float64) mirrorOptSetter {
+	return func(m *Mirror) error {
+		if p < 0 || p > 100 {
+			return fmt.Errorf("invalid mirror percentage: %v", p)
+		}
+		m.percent = p
+		return nil
+	}
+}
+
+// MirrorMaxBodySize defines the maximum size of the request bodies copied to the mirror, 1MB by default.
+// The requests with larger bodies are not mirrored.
+func MirrorMaxBodySize(n int64) mirrorOptSetter {
+	return func(m *Mirror) error {
+		m.maxBodySize = n
+		return nil
+	}
+}
+
+// MirrorTimeout defines the timeout of the mirrored requests, 10 seconds by default
+func MirrorTimeout(d time.Duration) mirrorOptSetter {
+	return func(m *Mirror) error {
+		m.timeout = d
+		return nil
+	}
+}
+
+// MirrorMaxConcurrency defines the maximum number of mirrored requests in flight, 100 by default
+func MirrorMaxConcurrency(n int) mirrorOptSetter {
+	return func(m *Mirror) error {
+		if n <= 0 {
+			return fmt.Errorf("invalid mirror concurrency: %d", n)
+		}
+		m.maxSlots = n
+		return nil
+	}
+}
+
+// MirrorLogger defines the logger the mirror will use, it defaults to logrus.StandardLogger()
+func MirrorLogger(l log.FieldLogger) mirrorOptSetter {
+	return func(m *Mirror) error {
+		logger, err := toOxyLogger(l)
+		if err != nil {
+			return err
+		}
+		m.log = logger
+		return nil
+	}
+}
+
+// NewMirror creates a Mirror sending a copy of the requests handled by next to the target
+func NewMirror(next http.Handler, target *url.URL, setters ...mirrorOptSetter) (*Mirror, error) {
+	if target == nil {
+		return nil, errors.New("mirror target URL can't be nil")
+	}
+
+	m := &Mirror{
+		next:        next,
+		target:      target,
+		percent:     100,
+		maxBodySize: defaultMirrorMaxBodySize,
+		timeout:     defaultMirrorTimeout,
+		maxSlots:    defaultMirrorMaxConcurrency,
+		log:         &internalLogger{Logger: log.StandardLogger()},
+	}
+	for _, s := range setters {
+		if err := s(m); err != nil {
+			return nil, err
+		}
+	}
+
+	if m.shadow == nil {
+		f, err := New(Logger(m.log))
+		if err != nil {
+			return nil, err
+		}
+		m.shadow = f
+	}
+	m.slots = make(chan struct{}, m.maxSlots)
+	return m, nil
+}
+
+// ServeHTTP sends a copy of the request to the mirror in the background and serves it with next
+func (m *Mirror) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if m.log.GetLevel() >= log.DebugLevel {
+		logEntry := m.log.WithField("Request", utils.DumpHttpRequest(req))
+		logEntry.Debug("vulcand/oxy/forward/mirror: begin ServeHttp on request")
+		defer logEntry.Debug("vulcand/oxy/forward/mirror: completed ServeHttp on request")
+	}
+
+	if m.sampled(req) {
+		select {
+		case m.slots <- struct{}{}:
+			if mirrorReq, cancel := m.mirrorRequest(req); mirrorReq != nil {
+				var primary *primaryRecorder
+				if m.report != nil {
+					primary = newPrimaryRecorder(w, m.maxBodySize)
+					w = primary
+					defer primary.finish()
+				}
+				launch := &mirrorLaunch{mirror: m, req: mirrorReq, cancel: cancel, primary: primary}
+				// the mirrored request is dropped if next did not read the whole body
+				defer launch.drop()
+				m.teeBody(req, launch)
+			} else {
+				<-m.slots
+			}
+		default:
+			m.log.Debugf("vulcand/oxy/forward/mirror: too many mirrored requests in flight, skipping %v", req.URL)
+		}
+	}
+
+	m.next.ServeHTTP(w, req)
+}
+
+func (m *Mirror) sampled(req *http.Request) bool {
+	if req.Method == http.MethodConnect || IsWebsocketRequest(req) || IsUpgradeRequest(req) {
+		return false
+	}
+	return m.percent >= 100 || rand.Float64()*100 < m.percent
+}
+
+// mirrorRequest copies the request for the mirror, without its body.
+// It returns nil when the body is known to exceed the size limit.
+func (m *Mirror) mirrorRequest(req *http.Request) (*http.Request, context.CancelFunc) {
+	if req.ContentLength > m.maxBodySize {
+		return nil, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), m.timeout)
+	mirrorReq := req.Clone(ctx)
+	mirrorReq.URL = utils.CopyURL(m.target)
+	mirrorReq.ContentLength = 0
+	mirrorReq.TransferEncoding = nil
+	mirrorReq.Body = http.NoBody
+	return mirrorReq, cancel
+}
+
+// teeBody copies the body of the request to the mirror while next reads it, the mirrored request is started
+// once the whole body is read. The body is never read ahead of next, so slow uploads and Expect: 100-continue
+// requests are not held back by the mirror.
+func (m *Mirror) teeBody(req *http.Request, launch *mirrorLaunch) {
+	if req.Body == nil || req.Body == http.NoBody {
+		launch.start(nil)
+		return
+	}
+	req.Body = &mirroredBody{ReadCloser: req.Body, launch: launch, maxSize: m.maxBodySize, length: req.ContentLength}
+}
+
+func (m *Mirror) serveMirror(req *http.Request, cancel context.CancelFunc, primary *primaryRecorder) {
+	defer func() {
+		cancel()
+		if r := recover(); r != nil {
+			m.log.Errorf("vulcand/oxy/forward/mirror: mirrored request %v panicked: %v", req.URL, r)
+		}
+		<-m.slots
+	}()
+
+	if primary == nil {
+		m.shadow.ServeHTTP(&discardResponseWriter{header: make(http.Header)}, req)
+		return
+	}
+
+	candidate := newCapturedResponse(m.maxBodySize)
+	m.shadow.ServeHTTP(candidate, req)
+
+	<-primary.done
+	if d := m.diff(req, primary.resp, candidate); d != nil {
+		m.report(d)
+	}
+}
+
+// mirrorLaunch starts or drops a mirrored request, whichever comes first
+type mirrorLaunch struct {
+	once    sync.Once
+	mirror  *Mirror
+	req     *http.Request
+	cancel  context.CancelFunc
+	primary *primaryRecorder
+}
+
+// start sends the mirrored request with the body in the background
+func (l *mirrorLaunch) start(body []byte) {
+	l.once.Do(func() {
+		if len(body) > 0 {
+			l.req.ContentLength = int64(len(body))
+			l.req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+		go l.mirror.serveMirror(l.req, l.cancel, l.primary)
+	})
+}
+
+// drop releases the mirrored request if it was not started
+func (l *mirrorLaunch) drop() {
+	l.once.Do(func() {
+		l.cancel()
+		<-l.mirror.slots
+	})
+}
+
+// mirroredBody copies the request body read by next, up to the size limit, and starts the mirrored request at its end
+type mirroredBody struct {
+	io.ReadCloser
+	launch  *mirrorLaunch
+	maxSize int64
+	length  int64
+	buf     bytes.Buffer
+	done    bool
+}
+
+func (b *mirroredBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if b.done {
+		return n, err
+	}
+
+	switch {
+	case int64(b.buf.Len()+n) > b.maxSize:
+		b.finish(nil, fmt.Errorf("body exceeds %d bytes", b.maxSize))
+	default:
+		b.buf.Write(p[:n])
+		if err == io.EOF || (err == nil && b.length >= 0 && int64(b.buf.Len()) == b.length) {
+			b.finish(b.buf.Bytes(), nil)
+		} else if err != nil {
+			b.finish(nil, err)
+		}
+	}
+	return n, err
+}
+
+func (b *mirroredBody) finish(body []byte, err error) {
+	b.done = true
+	if err != nil {
+		b.launch.mirror.log.Debugf("vulcand/oxy/forward/mirror: not mirroring %v: %v", b.launch.req.URL, err)
+		b.launch.drop()
+		return
+	}
+	b.launch.start(body)
+}
+
+// discardResponseWriter is the response writer of the mirrored requests, their responses are dropped
+type discardResponseWriter struct {
+	header http.Header
+}
+
+func (w *discardResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *discardResponseWriter) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (w *discardResponseWriter) WriteHeader(int) {}
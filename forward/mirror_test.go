@@ -0,0 +1,225 @@
+package forward
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/testutils"
+)
+
+type mirroredRequest struct {
+	method string
+	uri    string
+	body   string
+}
+
+// newMirrorBackends creates the primary backend echoing the request body and the shadow backend reporting its requests
+func newMirrorBackends(t *testing.T, shadowHandler http.HandlerFunc) (*httptest.Server, *httptest.Server, chan mirroredRequest) {
+	primary := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		body, err := ioutil.ReadAll(req.Body)
+		require.NoError(t, err)
+		w.Write([]byte("primary " + string(body)))
+	})
+
+	mirrored := make(chan mirroredRequest, 10)
+	shadow := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		body, err := ioutil.ReadAll(req.Body)
+		require.NoError(t, err)
+		mirrored <- mirroredRequest{method: req.Method, uri: req.RequestURI, body: string(body)}
+		if shadowHandler != nil {
+			shadowHandler(w, req)
+		}
+	})
+	return primary, shadow, mirrored
+}
+
+func newMirrorProxy(t *testing.T, primary, shadow *httptest.Server, setters ...mirrorOptSetter) *httptest.Server {
+	f, err := New()
+	require.NoError(t, err)
+
+	m, err := NewMirror(f, testutils.ParseURI(shadow.URL), setters...)
+	require.NoError(t, err)
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(primary.URL)
+		m.ServeHTTP(w, req)
+	}))
+}
+
+func TestMirror(t *testing.T) {
+	primary, shadow, mirrored := newMirrorBackends(t, func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	defer primary.Close()
+	defer shadow.Close()
+
+	proxy := newMirrorProxy(t, primary, shadow)
+	defer proxy.Close()
+
+	re, body, err := testutils.Post(proxy.URL+"/api?x=1", testutils.Body("hello"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, "primary hello", string(body))
+
+	select {
+	case req := <-mirrored:
+		assert.Equal(t, mirroredRequest{method: http.MethodPost, uri: "/api?x=1", body: "hello"}, req)
+	case <-time.After(time.Second):
+		t.Fatal("the request was not mirrored")
+	}
+}
+
+func TestMirrorSkipped(t *testing.T) {
+	testCases := []struct {
+		desc    string
+		setters []mirrorOptSetter
+		body    string
+	}{
+		{
+			desc:    "not sampled",
+			setters: []mirrorOptSetter{MirrorPercent(0)},
+			body:    "hello",
+		},
+		{
+			desc:    "body too large",
+			setters: []mirrorOptSetter{MirrorMaxBodySize(4)},
+			body:    "hello",
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			primary, shadow, mirrored := newMirrorBackends(t, nil)
+			defer primary.Close()
+			defer shadow.Close()
+
+			proxy := newMirrorProxy(t, primary, shadow, test.setters...)
+			defer proxy.Close()
+
+			// the chunked body has no known length, it is read up to the limit
+			req, err := http.NewRequest(http.MethodPost, proxy.URL, ioutil.NopCloser(strings.NewReader(test.body)))
+			require.NoError(t, err)
+			re, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			body, err := ioutil.ReadAll(re.Body)
+			re.Body.Close()
+			require.NoError(t, err)
+			assert.Equal(t, "primary "+test.body, string(body))
+
+			select {
+			case req := <-mirrored:
+				t.Fatalf("unexpected mirrored request %v", req)
+			case <-time.After(100 * time.Millisecond):
+			}
+		})
+	}
+}
+
+func TestMirrorConcurrencyAndTimeout(t *testing.T) {
+	canceled := make(chan struct{}, 10)
+	primary, shadow, mirrored := newMirrorBackends(t, func(w http.ResponseWriter, req *http.Request) {
+		select {
+		case <-req.Context().Done():
+			canceled <- struct{}{}
+		case <-time.After(5 * time.Second):
+		}
+	})
+	defer primary.Close()
+	defer shadow.Close()
+
+	proxy := newMirrorProxy(t, primary, shadow, MirrorMaxConcurrency(1), MirrorTimeout(200*time.Millisecond))
+	defer proxy.Close()
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		re, body, err := testutils.Get(proxy.URL)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, re.StatusCode)
+		assert.Equal(t, "primary ", string(body))
+	}
+	// the primary requests do not wait for the mirror
+	assert.True(t, time.Since(start) < 200*time.Millisecond)
+
+	<-mirrored
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		t.Fatal("the mirrored request did not time out")
+	}
+
+	// only one mirrored request was in flight
+	select {
+	case req := <-mirrored:
+		t.Fatalf("unexpected mirrored request %v", req)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestMirrorSlowBody(t *testing.T) {
+	started := make(chan struct{})
+	primary := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		close(started)
+		body, err := ioutil.ReadAll(req.Body)
+		require.NoError(t, err)
+		w.Write([]byte("primary " + string(body)))
+	})
+	defer primary.Close()
+
+	_, shadow, mirrored := newMirrorBackends(t, nil)
+	defer shadow.Close()
+
+	proxy := newMirrorProxy(t, primary, shadow)
+	defer proxy.Close()
+
+	reader, writer := io.Pipe()
+	go func() {
+		writer.Write([]byte("hello "))
+		// the rest of the body is only sent once the primary backend got the request
+		select {
+		case <-started:
+			writer.Write([]byte("world"))
+			writer.Close()
+		case <-time.After(time.Second):
+			writer.CloseWithError(errors.New("the primary request waited for the body"))
+		}
+	}()
+
+	req, err := http.NewRequest(http.MethodPost, proxy.URL, reader)
+	require.NoError(t, err)
+	re, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	body, err := ioutil.ReadAll(re.Body)
+	re.Body.Close()
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, "primary hello world", string(body))
+
+	select {
+	case req := <-mirrored:
+		assert.Equal(t, "hello world", req.body)
+	case <-time.After(time.Second):
+		t.Fatal("the request was not mirrored")
+	}
+}
+
+func TestMirrorInvalidOptions(t *testing.T) {
+	target := testutils.ParseURI("http://localhost")
+
+	_, err := NewMirror(http.NotFoundHandler(), nil)
+	assert.Error(t, err)
+
+	_, err = NewMirror(http.NotFoundHandler(), target, MirrorPercent(101))
+	assert.Error(t, err)
+
+	_, err = NewMirror(http.NotFoundHandler(), target, MirrorMaxConcurrency(0))
+	assert.Error(t, err)
+}
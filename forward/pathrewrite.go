@@ -0,0 +1,182 @@
+package forward
+
+import (
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// RewriterChain is a ReqRewriter applying its rewriters in order, e.g. a HeaderRewriter followed by path rewriters.
+// The HeaderRewriter must come first so that the X-Forwarded-Prefix and X-Original-Uri headers
+// recorded by the path rewriters are not removed from untrusted requests.
+type RewriterChain []ReqRewriter
+
+// Rewrite applies the rewriters in order
+func (c RewriterChain) Rewrite(req *http.Request) {
+	for _, rw := range c {
+		rw.Rewrite(req)
+	}
+}
+
+// StripPrefixRewriter removes a path prefix from the requests, e.g. /api/users becomes /users with the /api prefix.
+// The prefix matches whole path segments, the stripped prefix is appended to the X-Forwarded-Prefix header.
+type StripPrefixRewriter struct {
+	Prefix string
+}
+
+// Rewrite strips the prefix from the request path
+func (rw *StripPrefixRewriter) Rewrite(req *http.Request) {
+	prefix := strings.TrimSuffix(escapePath(rw.Prefix), "/")
+	if prefix == "" {
+		return
+	}
+
+	path := req.URL.EscapedPath()
+	if path != prefix && !strings.HasPrefix(path, prefix+"/") {
+		return
+	}
+
+	recordOriginalURI(req)
+	req.Header.Set(XForwardedPrefix, strings.TrimSuffix(req.Header.Get(XForwardedPrefix), "/")+prefix)
+	setEscapedPath(req.URL, strings.TrimPrefix(path, prefix))
+}
+
+// AddPrefixRewriter adds a path prefix to the requests, e.g. /users becomes /api/users with the /api prefix
+type AddPrefixRewriter struct {
+	Prefix string
+}
+
+// Rewrite adds the prefix to the request path
+func (rw *AddPrefixRewriter) Rewrite(req *http.Request) {
+	prefix := strings.TrimSuffix(escapePath(rw.Prefix), "/")
+	if prefix == "" {
+		return
+	}
+
+	recordOriginalURI(req)
+	setEscapedPath(req.URL, prefix+req.URL.EscapedPath())
+}
+
+// RegexPathRewriter replaces the request paths matching a regular expression.
+// The regular expression is matched against the escaped path and the replacement, which can refer to
+// the capture groups as in regexp.Regexp.ReplaceAllString, is the new escaped path.
+type RegexPathRewriter struct {
+	Regex       *regexp.Regexp
+	Replacement string
+}
+
+// NewRegexPathRewriter creates a new RegexPathRewriter, e.g. NewRegexPathRewriter(`^/users/(\d+)$`, "/api/users/$1")
+func NewRegexPathRewriter(expr, replacement string) (*RegexPathRewriter, error) {
+	regex, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, err
+	}
+	return &RegexPathRewriter{Regex: regex, Replacement: replacement}, nil
+}
+
+// Rewrite replaces the request path when it matches the regular expression
+func (rw *RegexPathRewriter) Rewrite(req *http.Request) {
+	path := req.URL.EscapedPath()
+	if !rw.Regex.MatchString(path) {
+		return
+	}
+
+	recordOriginalURI(req)
+	setEscapedPath(req.URL, rw.Regex.ReplaceAllString(path, rw.Replacement))
+}
+
+// QueryRewriter removes, renames and adds query parameters, in that order.
+// The other parameters keep their position and encoding.
+type QueryRewriter struct {
+	// Remove lists the names of the parameters to remove
+	Remove []string
+	// Rename maps the names of the parameters to their new names
+	Rename map[string]string
+	// Add lists the parameters to add, after the existing ones
+	Add url.Values
+}
+
+// Rewrite rewrites the request query
+func (rw *QueryRewriter) Rewrite(req *http.Request) {
+	if len(rw.Remove) == 0 && len(rw.Rename) == 0 && len(rw.Add) == 0 {
+		return
+	}
+
+	remove := make(map[string]bool, len(rw.Remove))
+	for _, name := range rw.Remove {
+		remove[name] = true
+	}
+
+	var pairs []string
+	if req.URL.RawQuery != "" {
+		for _, pair := range strings.Split(req.URL.RawQuery, "&") {
+			rawName, rawValue, hasValue := pair, "", false
+			if i := strings.Index(pair, "="); i >= 0 {
+				rawName, rawValue, hasValue = pair[:i], pair[i+1:], true
+			}
+
+			name, err := url.QueryUnescape(rawName)
+			if err != nil {
+				// malformed parameters are passed through
+				pairs = append(pairs, pair)
+				continue
+			}
+			if remove[name] {
+				continue
+			}
+			if newName, ok := rw.Rename[name]; ok {
+				pair = url.QueryEscape(newName)
+				if hasValue {
+					pair += "=" + rawValue
+				}
+			}
+			pairs = append(pairs, pair)
+		}
+	}
+
+	names := make([]string, 0, len(rw.Add))
+	for name := range rw.Add {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, value := range rw.Add[name] {
+			pairs = append(pairs, url.QueryEscape(name)+"="+url.QueryEscape(value))
+		}
+	}
+
+	recordOriginalURI(req)
+	req.URL.RawQuery = strings.Join(pairs, "&")
+}
+
+// recordOriginalURI records the request URI in the X-Original-Uri header unless an earlier rewriter or proxy did
+func recordOriginalURI(req *http.Request) {
+	if req.Header.Get(XOriginalURI) == "" {
+		req.Header.Set(XOriginalURI, req.URL.RequestURI())
+	}
+}
+
+// escapePath returns the escaped form of a path
+func escapePath(path string) string {
+	return (&url.URL{Path: path}).EscapedPath()
+}
+
+// setEscapedPath sets the path of the URL from its escaped form, RawPath keeps the encoding when it differs from the default one
+func setEscapedPath(u *url.URL, escaped string) {
+	if !strings.HasPrefix(escaped, "/") {
+		escaped = "/" + escaped
+	}
+
+	path, err := url.PathUnescape(escaped)
+	if err != nil {
+		return
+	}
+
+	u.Path = path
+	u.RawPath = ""
+	if u.EscapedPath() != escaped {
+		u.RawPath = escaped
+	}
+}
@@ -0,0 +1,152 @@
+package forward
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/testutils"
+)
+
+func TestPathRewriters(t *testing.T) {
+	regex, err := NewRegexPathRewriter(`^/users/([^/]+)/posts$`, "/api/posts/$1")
+	require.NoError(t, err)
+
+	testCases := []struct {
+		desc           string
+		rewriter       ReqRewriter
+		url            string
+		header         http.Header
+		expectedURI    string
+		expectedHeader http.Header
+	}{
+		{
+			desc:           "strip prefix",
+			rewriter:       &StripPrefixRewriter{Prefix: "/api/"},
+			url:            "http://localhost/api/users?id=1",
+			expectedURI:    "/users?id=1",
+			expectedHeader: http.Header{XForwardedPrefix: {"/api"}, XOriginalURI: {"/api/users?id=1"}},
+		},
+		{
+			desc:           "strip whole path",
+			rewriter:       &StripPrefixRewriter{Prefix: "/api"},
+			url:            "http://localhost/api",
+			expectedURI:    "/",
+			expectedHeader: http.Header{XForwardedPrefix: {"/api"}, XOriginalURI: {"/api"}},
+		},
+		{
+			desc:           "strip prefix of another segment",
+			rewriter:       &StripPrefixRewriter{Prefix: "/api"},
+			url:            "http://localhost/apiv2/users",
+			expectedURI:    "/apiv2/users",
+			expectedHeader: http.Header{},
+		},
+		{
+			desc:           "strip prefix keeps encoding",
+			rewriter:       &StripPrefixRewriter{Prefix: "/files"},
+			url:            "http://localhost/files/a%2Fb%20c",
+			expectedURI:    "/a%2Fb%20c",
+			expectedHeader: http.Header{XForwardedPrefix: {"/files"}, XOriginalURI: {"/files/a%2Fb%20c"}},
+		},
+		{
+			desc:           "strip prefix appends forwarded prefix",
+			rewriter:       &StripPrefixRewriter{Prefix: "/api"},
+			url:            "http://localhost/api/users",
+			header:         http.Header{XForwardedPrefix: {"/outer/"}, XOriginalURI: {"/outer/api/users"}},
+			expectedURI:    "/users",
+			expectedHeader: http.Header{XForwardedPrefix: {"/outer/api"}, XOriginalURI: {"/outer/api/users"}},
+		},
+		{
+			desc:           "add prefix",
+			rewriter:       &AddPrefixRewriter{Prefix: "/v1 beta"},
+			url:            "http://localhost/a%2Fb?x=1",
+			expectedURI:    "/v1%20beta/a%2Fb?x=1",
+			expectedHeader: http.Header{XOriginalURI: {"/a%2Fb?x=1"}},
+		},
+		{
+			desc:           "regex",
+			rewriter:       regex,
+			url:            "http://localhost/users/j%2Fdoe/posts?page=2",
+			expectedURI:    "/api/posts/j%2Fdoe?page=2",
+			expectedHeader: http.Header{XOriginalURI: {"/users/j%2Fdoe/posts?page=2"}},
+		},
+		{
+			desc:           "regex no match",
+			rewriter:       regex,
+			url:            "http://localhost/users/jdoe",
+			expectedURI:    "/users/jdoe",
+			expectedHeader: http.Header{},
+		},
+		{
+			desc: "query",
+			rewriter: &QueryRewriter{
+				Remove: []string{"token"},
+				Rename: map[string]string{"q": "query"},
+				Add:    url.Values{"b": {"2"}, "a": {"1 2"}},
+			},
+			url:            "http://localhost/search?q=a%2Bb&token=secret&flag&x=%20",
+			expectedURI:    "/search?query=a%2Bb&flag&x=%20&a=1+2&b=2",
+			expectedHeader: http.Header{XOriginalURI: {"/search?q=a%2Bb&token=secret&flag&x=%20"}},
+		},
+		{
+			desc: "chain",
+			rewriter: RewriterChain{
+				&StripPrefixRewriter{Prefix: "/api"},
+				&AddPrefixRewriter{Prefix: "/internal"},
+				&QueryRewriter{Remove: []string{"debug"}},
+			},
+			url:            "http://localhost/api/users?debug=1",
+			expectedURI:    "/internal/users",
+			expectedHeader: http.Header{XForwardedPrefix: {"/api"}, XOriginalURI: {"/api/users?debug=1"}},
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			req := httptest.NewRequest(http.MethodGet, test.url, nil)
+			if test.header != nil {
+				req.Header = test.header
+			}
+
+			test.rewriter.Rewrite(req)
+
+			assert.Equal(t, test.expectedURI, req.URL.RequestURI())
+			assert.Equal(t, test.expectedHeader, req.Header)
+		})
+	}
+}
+
+func TestPathRewritersForward(t *testing.T) {
+	var outReq *http.Request
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		outReq = req
+		w.Write([]byte("hello"))
+	})
+	defer srv.Close()
+
+	f, err := New(Rewriter(RewriterChain{
+		&HeaderRewriter{TrustForwardHeader: false, Hostname: "proxy"},
+		&StripPrefixRewriter{Prefix: "/api"},
+	}))
+	require.NoError(t, err)
+
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		f.ServeHTTP(w, req)
+	}))
+	defer proxy.Close()
+
+	re, _, err := testutils.Get(proxy.URL+"/api/files/a%2Fb?x=1", testutils.Header(XOriginalURI, "/spoofed"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+
+	assert.Equal(t, "/files/a%2Fb?x=1", outReq.RequestURI)
+	assert.Equal(t, "/api", outReq.Header.Get(XForwardedPrefix))
+	assert.Equal(t, "/api/files/a%2Fb?x=1", outReq.Header.Get(XOriginalURI))
+}
@@ -0,0 +1,253 @@
+package forward
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"sync"
+
+	"golang.org/x/net/http2"
+)
+
+// Protocol is the HTTP protocol the forwarder speaks to an upstream server
+type Protocol int
+
+// Upstream protocols
+const (
+	// ProtocolHTTP1 speaks HTTP/1.1 using the configured RoundTripper, it's the default
+	ProtocolHTTP1 Protocol = iota
+	// ProtocolHTTP2 speaks HTTP/2 over TLS, the target URL must use the https scheme
+	ProtocolHTTP2
+	// ProtocolH2C speaks cleartext HTTP/2 with prior knowledge, the target URL must use the http scheme
+	ProtocolH2C
+)
+
+// ProtocolSelector chooses the protocol to speak to the specified target
+type ProtocolSelector func(target *url.URL) Protocol
+
+// UpstreamProtocol defines the protocol the HTTP forwarder speaks to every upstream
+func UpstreamProtocol(p Protocol) optSetter {
+	return UpstreamProtocolSelector(func(*url.URL) Protocol {
+		return p
+	})
+}
+
+// UpstreamProtocolSelector defines a function choosing the protocol the HTTP forwarder speaks to each target.
+// HTTP/2 connections are multiplexed and reused across requests to the same target.
+func UpstreamProtocolSelector(s ProtocolSelector) optSetter {
+	return func(f *Forwarder) error {
+		f.httpForwarder.protocolSelector = s
+		return nil
+	}
+}
+
+// upstreamProtocol returns the protocol to speak to the specified target
+func (f *httpForwarder) upstreamProtocol(target *url.URL) Protocol {
+	if f.protocolSelector == nil {
+		return ProtocolHTTP1
+	}
+	return f.protocolSelector(target)
+}
+
+// protocolTransports are the transports of each protocol to the same upstream connections, the HTTP/2 ones
+// share the settings of the HTTP/1.1 round tripper when it is an *http.Transport and dial with the dial function
+type protocolTransports struct {
+	http1 http.RoundTripper
+	http2 *http2.Transport
+	h2c   *http2.Transport
+}
+
+func newProtocolTransports(http1 http.RoundTripper, tlsClientConfig *tls.Config, dial dialContextFunc) *protocolTransports {
+	return &protocolTransports{
+		http1: http1,
+		http2: newHTTP2Transport(http1, dial, tlsClientConfig.Clone(), false),
+		h2c:   newHTTP2Transport(http1, dial, nil, true),
+	}
+}
+
+// roundTrip executes the round trip with the protocol
+func (t *protocolTransports) roundTrip(req *http.Request, protocol Protocol) (*http.Response, error) {
+	switch protocol {
+	case ProtocolHTTP2:
+		return t.http2.RoundTrip(req)
+	case ProtocolH2C:
+		return t.h2c.RoundTrip(req)
+	default:
+		return t.http1.RoundTrip(req)
+	}
+}
+
+// CloseIdleConnections closes the idle connections of every protocol
+func (t *protocolTransports) CloseIdleConnections() {
+	closeIdleConnections(t.http1)
+	t.http2.ConnPool.(*http2ConnPool).closeIdleConnections()
+	t.h2c.ConnPool.(*http2ConnPool).closeIdleConnections()
+}
+
+// newHTTP2Transport creates an HTTP/2 transport, over TLS or cleartext with prior knowledge (h2c)
+func newHTTP2Transport(base http.RoundTripper, dial dialContextFunc, tlsClientConfig *tls.Config, cleartext bool) *http2.Transport {
+	t := &http2.Transport{TLSClientConfig: tlsClientConfig, AllowHTTP: cleartext}
+	if ht, ok := base.(*http.Transport); ok {
+		t.DisableCompression = ht.DisableCompression
+		if ht.MaxResponseHeaderBytes > 0 && ht.MaxResponseHeaderBytes < math.MaxUint32 {
+			t.MaxHeaderListSize = uint32(ht.MaxResponseHeaderBytes)
+		}
+	}
+	t.ConnPool = &http2ConnPool{transport: t, dial: dial, cleartext: cleartext, conns: make(map[string][]*http2.ClientConn)}
+	return t
+}
+
+// http2ConnPool is the connection pool of the HTTP/2 transports, the connections are dialed with the context
+// of the requests so that canceled or timed out requests stop dialing
+type http2ConnPool struct {
+	transport *http2.Transport
+	dial      dialContextFunc
+	cleartext bool
+
+	mutex sync.Mutex
+	conns map[string][]*http2.ClientConn
+}
+
+// GetClientConn returns a connection to addr which can take the request, a new one if needed
+func (p *http2ConnPool) GetClientConn(req *http.Request, addr string) (*http2.ClientConn, error) {
+	p.mutex.Lock()
+	for _, cc := range p.conns[addr] {
+		if cc.CanTakeNewRequest() {
+			p.mutex.Unlock()
+			return cc, nil
+		}
+	}
+	p.mutex.Unlock()
+
+	cc, err := p.newClientConn(req.Context(), addr)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mutex.Lock()
+	p.conns[addr] = append(p.conns[addr], cc)
+	p.mutex.Unlock()
+	return cc, nil
+}
+
+// MarkDead removes the connection from the pool
+func (p *http2ConnPool) MarkDead(cc *http2.ClientConn) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	for addr, conns := range p.conns {
+		for i, c := range conns {
+			if c != cc {
+				continue
+			}
+			conns = append(conns[:i], conns[i+1:]...)
+			if len(conns) == 0 {
+				delete(p.conns, addr)
+			} else {
+				p.conns[addr] = conns
+			}
+			return
+		}
+	}
+}
+
+// closeIdleConnections closes the connections of the pool once their streams are done
+func (p *http2ConnPool) closeIdleConnections() {
+	p.mutex.Lock()
+	conns := p.conns
+	p.conns = make(map[string][]*http2.ClientConn)
+	p.mutex.Unlock()
+
+	for _, cs := range conns {
+		for _, cc := range cs {
+			go cc.Shutdown(context.Background())
+		}
+	}
+}
+
+// newClientConn dials addr and negotiates HTTP/2, the phases are reported to the client trace of the request
+func (p *http2ConnPool) newClientConn(ctx context.Context, addr string) (*http2.ClientConn, error) {
+	trace := httptrace.ContextClientTrace(ctx)
+	if trace != nil && trace.GetConn != nil {
+		trace.GetConn(addr)
+	}
+
+	if trace != nil && trace.ConnectStart != nil {
+		trace.ConnectStart("tcp", addr)
+	}
+	conn, err := p.dial(ctx, "tcp", addr)
+	if trace != nil && trace.ConnectDone != nil {
+		trace.ConnectDone("tcp", addr, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if !p.cleartext {
+		if conn, err = p.handshake(ctx, conn, addr); err != nil {
+			return nil, err
+		}
+	}
+
+	cc, err := p.transport.NewClientConn(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if trace != nil && trace.GotConn != nil {
+		trace.GotConn(httptrace.GotConnInfo{Conn: conn})
+	}
+	return cc, nil
+}
+
+// handshake negotiates TLS and HTTP/2 with ALPN on the connection, it is aborted when the context is done
+func (p *http2ConnPool) handshake(ctx context.Context, conn net.Conn, addr string) (net.Conn, error) {
+	cfg := p.transport.TLSClientConfig.Clone()
+	if cfg == nil {
+		cfg = &tls.Config{}
+	}
+	cfg.NextProtos = []string{http2.NextProtoTLS}
+	if cfg.ServerName == "" {
+		if host, _, err := net.SplitHostPort(addr); err == nil {
+			cfg.ServerName = host
+		}
+	}
+
+	trace := httptrace.ContextClientTrace(ctx)
+	if trace != nil && trace.TLSHandshakeStart != nil {
+		trace.TLSHandshakeStart()
+	}
+
+	tlsConn := tls.Client(conn, cfg)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- tlsConn.Handshake()
+	}()
+
+	var err error
+	select {
+	case err = <-errc:
+	case <-ctx.Done():
+		conn.Close()
+		<-errc
+		err = ctx.Err()
+	}
+
+	state := tlsConn.ConnectionState()
+	if trace != nil && trace.TLSHandshakeDone != nil {
+		trace.TLSHandshakeDone(state, err)
+	}
+	if err == nil && state.NegotiatedProtocol != http2.NextProtoTLS {
+		err = fmt.Errorf("http2: unexpected ALPN protocol %q, want %q", state.NegotiatedProtocol, http2.NextProtoTLS)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
@@ -0,0 +1,202 @@
+package forward
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/testutils"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+func TestForwardH2C(t *testing.T) {
+	var protos []string
+	var conns int32
+	srv := httptest.NewUnstartedServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		protos = append(protos, req.Proto)
+		w.Write([]byte("hello"))
+	}), &http2.Server{}))
+	srv.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+	srv.Start()
+	defer srv.Close()
+
+	f, err := New(UpstreamProtocol(ProtocolH2C))
+	require.NoError(t, err)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	for i := 0; i < 3; i++ {
+		re, body, err := testutils.Get(proxy.URL)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, re.StatusCode)
+		assert.Equal(t, "hello", string(body))
+	}
+
+	assert.Equal(t, []string{"HTTP/2.0", "HTTP/2.0", "HTTP/2.0"}, protos)
+	assert.EqualValues(t, 1, atomic.LoadInt32(&conns))
+}
+
+func TestForwardHTTP2TLS(t *testing.T) {
+	var proto string
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		proto = req.Proto
+		w.Write([]byte("hello"))
+	}))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+
+	f, err := New(
+		RoundTripper(&http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}),
+		UpstreamProtocol(ProtocolHTTP2),
+	)
+	require.NoError(t, err)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	re, body, err := testutils.Get(proxy.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, "hello", string(body))
+	assert.Equal(t, "HTTP/2.0", proto)
+}
+
+func TestUpstreamProtocolSelector(t *testing.T) {
+	var proto string
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		proto = req.Proto
+	})
+	h1 := httptest.NewServer(handler)
+	defer h1.Close()
+	h2 := httptest.NewServer(h2c.NewHandler(handler, &http2.Server{}))
+	defer h2.Close()
+
+	h2URL := testutils.ParseURI(h2.URL)
+	f, err := New(UpstreamProtocolSelector(func(target *url.URL) Protocol {
+		if target.Host == h2URL.Host {
+			return ProtocolH2C
+		}
+		return ProtocolHTTP1
+	}))
+	require.NoError(t, err)
+
+	testCases := []struct {
+		desc     string
+		target   string
+		expected string
+	}{
+		{desc: "http1", target: h1.URL, expected: "HTTP/1.1"},
+		{desc: "h2c", target: h2.URL, expected: "HTTP/2.0"},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.desc, func(t *testing.T) {
+			proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+				req.URL = testutils.ParseURI(test.target)
+				f.ServeHTTP(w, req)
+			})
+			defer proxy.Close()
+
+			re, _, err := testutils.Get(proxy.URL)
+			require.NoError(t, err)
+			assert.Equal(t, http.StatusOK, re.StatusCode)
+			assert.Equal(t, test.expected, proto)
+		})
+	}
+}
+
+func TestHTTP2TransportDial(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(req.Proto))
+	})
+	h2cSrv := httptest.NewServer(h2c.NewHandler(handler, &http2.Server{}))
+	defer h2cSrv.Close()
+	tlsSrv := httptest.NewUnstartedServer(handler)
+	tlsSrv.EnableHTTP2 = true
+	tlsSrv.StartTLS()
+	defer tlsSrv.Close()
+
+	testCases := []struct {
+		desc     string
+		protocol Protocol
+		target   string
+	}{
+		{desc: "h2c", protocol: ProtocolH2C, target: h2cSrv.URL},
+		{desc: "http2", protocol: ProtocolHTTP2, target: tlsSrv.URL},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			var dials int32
+			transport := &http.Transport{
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+				DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+					atomic.AddInt32(&dials, 1)
+					return (&net.Dialer{}).DialContext(ctx, network, addr)
+				},
+			}
+			f, err := New(RoundTripper(transport), UpstreamProtocol(test.protocol))
+			require.NoError(t, err)
+
+			proxy := createProxyWithForwarder(f, test.target)
+			defer proxy.Close()
+
+			for i := 0; i < 2; i++ {
+				re, body, err := testutils.Get(proxy.URL)
+				require.NoError(t, err)
+				assert.Equal(t, http.StatusOK, re.StatusCode)
+				assert.Equal(t, "HTTP/2.0", string(body))
+			}
+			// the connections are dialed with the transport and reused
+			assert.EqualValues(t, 1, atomic.LoadInt32(&dials))
+		})
+	}
+}
+
+func TestHTTP2TransportDialCanceled(t *testing.T) {
+	canceled := make(chan struct{}, 1)
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			<-ctx.Done()
+			canceled <- struct{}{}
+			return nil, ctx.Err()
+		},
+	}
+	f, err := New(RoundTripper(transport), UpstreamProtocol(ProtocolH2C), DialTimeout(50*time.Millisecond))
+	require.NoError(t, err)
+
+	proxy := createProxyWithForwarder(f, "http://backend.example.com")
+	defer proxy.Close()
+
+	re, _, err := testutils.Get(proxy.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusGatewayTimeout, re.StatusCode)
+
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		t.Fatal("the dial was not canceled")
+	}
+}
@@ -0,0 +1,99 @@
+package forward
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// proxyProtocolV2Signature starts every PROXY protocol v2 header
+var proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// ProxyProtocol makes the forwarder prepend a PROXY protocol header of the given version (1 or 2)
+// on each new connection to the backends, see https://www.haproxy.org/download/2.0/doc/proxy-protocol.txt
+// It applies to HTTP/1.1, HTTP/2, websocket and tunnel connections, including to unix domain sockets and with upstream
+// TLS settings, the RoundTripper must be an *http.Transport. HTTP connections are pooled per client connection
+// so that they never carry requests of another client.
+func ProxyProtocol(version int) optSetter {
+	return func(f *Forwarder) error {
+		if version != 1 && version != 2 {
+			return fmt.Errorf("unsupported PROXY protocol version: %d", version)
+		}
+		f.httpForwarder.proxyProtocolVersion = version
+		return nil
+	}
+}
+
+type dialContextFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// proxyProtocolDialer returns a dial function writing the PROXY protocol header of the client connection on new connections
+func proxyProtocolDialer(version int, dial dialContextFunc, src, dst net.Addr) dialContextFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		if _, err = conn.Write(proxyProtocolHeader(version, src, dst)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+}
+
+// requestAddrs returns the client and the local addresses of the connection the request was received on
+func requestAddrs(req *http.Request) (src, dst net.Addr) {
+	if addr, err := net.ResolveTCPAddr("tcp", req.RemoteAddr); err == nil {
+		src = addr
+	}
+	if addr, ok := req.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		dst = addr
+	}
+	return src, dst
+}
+
+// proxyProtocolHeader builds the PROXY protocol header, the UNKNOWN/UNSPEC family is used
+// when the addresses are not both TCP addresses
+func proxyProtocolHeader(version int, src, dst net.Addr) []byte {
+	srcTCP, srcOk := src.(*net.TCPAddr)
+	dstTCP, dstOk := dst.(*net.TCPAddr)
+	known := srcOk && dstOk && srcTCP != nil && dstTCP != nil
+	ipv4 := known && srcTCP.IP.To4() != nil && dstTCP.IP.To4() != nil
+
+	if version == 1 {
+		switch {
+		case !known:
+			return []byte("PROXY UNKNOWN\r\n")
+		case ipv4:
+			return []byte(fmt.Sprintf("PROXY TCP4 %s %s %d %d\r\n", srcTCP.IP.To4(), dstTCP.IP.To4(), srcTCP.Port, dstTCP.Port))
+		default:
+			return []byte(fmt.Sprintf("PROXY TCP6 %s %s %d %d\r\n", srcTCP.IP.To16(), dstTCP.IP.To16(), srcTCP.Port, dstTCP.Port))
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	buf.Write(proxyProtocolV2Signature)
+	// version 2, PROXY command
+	buf.WriteByte(0x21)
+
+	var addrs []byte
+	switch {
+	case !known:
+		buf.WriteByte(0x00)
+	case ipv4:
+		buf.WriteByte(0x11)
+		addrs = append(append(addrs, srcTCP.IP.To4()...), dstTCP.IP.To4()...)
+	default:
+		buf.WriteByte(0x21)
+		addrs = append(append(addrs, srcTCP.IP.To16()...), dstTCP.IP.To16()...)
+	}
+	if addrs != nil {
+		addrs = append(addrs, byte(srcTCP.Port>>8), byte(srcTCP.Port), byte(dstTCP.Port>>8), byte(dstTCP.Port))
+	}
+	binary.Write(buf, binary.BigEndian, uint16(len(addrs)))
+	buf.Write(addrs)
+	return buf.Bytes()
+}
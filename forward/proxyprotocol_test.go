@@ -0,0 +1,397 @@
+package forward
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/testutils"
+	"github.com/vulcand/oxy/utils"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+func TestProxyProtocolHeader(t *testing.T) {
+	src4 := &net.TCPAddr{IP: net.ParseIP("192.168.0.1"), Port: 56324}
+	dst4 := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 443}
+	src6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 56324}
+	dst6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443}
+
+	sig := string(proxyProtocolV2Signature)
+
+	testCases := []struct {
+		desc     string
+		version  int
+		src, dst net.Addr
+		expected string
+	}{
+		{
+			desc:     "v1 ipv4",
+			version:  1,
+			src:      src4,
+			dst:      dst4,
+			expected: "PROXY TCP4 192.168.0.1 10.0.0.1 56324 443\r\n",
+		},
+		{
+			desc:     "v1 ipv6",
+			version:  1,
+			src:      src6,
+			dst:      dst6,
+			expected: "PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n",
+		},
+		{
+			desc:     "v1 unknown",
+			version:  1,
+			src:      src4,
+			expected: "PROXY UNKNOWN\r\n",
+		},
+		{
+			desc:     "v2 ipv4",
+			version:  2,
+			src:      src4,
+			dst:      dst4,
+			expected: sig + "\x21\x11\x00\x0c\xc0\xa8\x00\x01\x0a\x00\x00\x01\xdc\x04\x01\xbb",
+		},
+		{
+			desc:    "v2 ipv6",
+			version: 2,
+			src:     src6,
+			dst:     dst6,
+			expected: sig + "\x21\x21\x00\x24" +
+				"\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01" +
+				"\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02" +
+				"\xdc\x04\x01\xbb",
+		},
+		{
+			desc:     "v2 unknown",
+			version:  2,
+			dst:      dst6,
+			expected: sig + "\x21\x00\x00\x00",
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+			assert.Equal(t, test.expected, string(proxyProtocolHeader(test.version, test.src, test.dst)))
+		})
+	}
+}
+
+func TestProxyProtocolOption(t *testing.T) {
+	_, err := New(ProxyProtocol(3))
+	assert.Error(t, err)
+
+	_, err = New(ProxyProtocol(1), RoundTripper(http.RoundTripper(nil)))
+	assert.NoError(t, err)
+
+	_, err = New(ProxyProtocol(1), RoundTripper(http.NewFileTransport(http.Dir("."))))
+	assert.Error(t, err)
+}
+
+type proxyProtocolHeaderKey struct{}
+
+// proxyProtocolConn is a backend connection whose PROXY protocol v1 header has been read
+type proxyProtocolConn struct {
+	net.Conn
+	reader *bufio.Reader
+	header string
+}
+
+func (c *proxyProtocolConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+type proxyProtocolListener struct {
+	net.Listener
+	accepted int32
+	// headers are the PROXY protocol headers by remote address of the connections
+	headers sync.Map
+}
+
+// header returns the PROXY protocol header of the connection from the remote address
+func (l *proxyProtocolListener) header(remoteAddr string) string {
+	header, _ := l.headers.Load(remoteAddr)
+	s, _ := header.(string)
+	return s
+}
+
+func (l *proxyProtocolListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	atomic.AddInt32(&l.accepted, 1)
+	reader := bufio.NewReader(conn)
+	header, err := reader.ReadString('\n')
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	l.headers.Store(conn.RemoteAddr().String(), strings.TrimSpace(header))
+	return &proxyProtocolConn{Conn: conn, reader: reader, header: strings.TrimSpace(header)}, nil
+}
+
+// newProxyProtocolServer creates a backend expecting a PROXY protocol v1 header on each connection
+func newProxyProtocolServer(handler http.Handler) (*httptest.Server, *proxyProtocolListener) {
+	srv := httptest.NewUnstartedServer(handler)
+	listener := listenProxyProtocol(srv)
+	srv.Start()
+	return srv, listener
+}
+
+// listenProxyProtocol makes the unstarted server read a PROXY protocol v1 header on each connection, before TLS
+func listenProxyProtocol(srv *httptest.Server) *proxyProtocolListener {
+	listener := &proxyProtocolListener{Listener: srv.Listener}
+	srv.Listener = listener
+	srv.Config.ConnContext = func(ctx context.Context, c net.Conn) context.Context {
+		return context.WithValue(ctx, proxyProtocolHeaderKey{}, listener.header(c.RemoteAddr().String()))
+	}
+	return listener
+}
+
+// recordingClient is an http client remembering the local address of the connection it dialed
+type recordingClient struct {
+	*http.Client
+	localAddr string
+}
+
+func newRecordingClient() *recordingClient {
+	c := &recordingClient{}
+	c.Client = &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+			if err == nil {
+				c.localAddr = conn.LocalAddr().String()
+			}
+			return conn, err
+		},
+	}}
+	return c
+}
+
+func TestProxyProtocolForward(t *testing.T) {
+	srv, listener := newProxyProtocolServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(req.Context().Value(proxyProtocolHeaderKey{}).(string)))
+	}))
+	defer srv.Close()
+
+	f, err := New(ProxyProtocol(1))
+	require.NoError(t, err)
+
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		f.ServeHTTP(w, req)
+	}))
+	defer proxy.Close()
+
+	proxyHost, proxyPort, err := net.SplitHostPort(testutils.ParseURI(proxy.URL).Host)
+	require.NoError(t, err)
+
+	for i := 0; i < 2; i++ {
+		client := newRecordingClient()
+		for j := 0; j < 2; j++ {
+			resp, err := client.Get(proxy.URL)
+			require.NoError(t, err)
+			body, err := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			require.NoError(t, err)
+
+			clientHost, clientPort, err := net.SplitHostPort(client.localAddr)
+			require.NoError(t, err)
+			expected := fmt.Sprintf("PROXY TCP4 %s %s %s %s", clientHost, proxyHost, clientPort, proxyPort)
+			assert.Equal(t, expected, string(body), "client %d request %d", i, j)
+		}
+	}
+
+	// the connections to the backend are reused by the requests of a client but never shared between clients
+	assert.EqualValues(t, 2, atomic.LoadInt32(&listener.accepted))
+}
+
+func TestProxyProtocolWebsocket(t *testing.T) {
+	upgrader := websocket.Upgrader{}
+	srv, _ := newProxyProtocolServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		conn, err := upgrader.Upgrade(w, req, nil)
+		require.NoError(t, err)
+		defer conn.Close()
+		conn.WriteMessage(websocket.TextMessage, []byte(req.Context().Value(proxyProtocolHeaderKey{}).(string)))
+	}))
+	defer srv.Close()
+
+	f, err := New(ProxyProtocol(1))
+	require.NoError(t, err)
+
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		f.ServeHTTP(w, req)
+	}))
+	defer proxy.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial(strings.Replace(proxy.URL, "http://", "ws://", 1), nil)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, msg, err := conn.ReadMessage()
+	require.NoError(t, err)
+
+	clientHost, clientPort, err := net.SplitHostPort(conn.LocalAddr().String())
+	require.NoError(t, err)
+	proxyHost, proxyPort, err := net.SplitHostPort(testutils.ParseURI(proxy.URL).Host)
+	require.NoError(t, err)
+	assert.Equal(t, fmt.Sprintf("PROXY TCP4 %s %s %s %s", clientHost, proxyHost, clientPort, proxyPort), string(msg))
+}
+
+func TestProxyProtocolTransports(t *testing.T) {
+	upstreamTLS := func(srv *httptest.Server) optSetter {
+		roots := x509.NewCertPool()
+		roots.AddCert(srv.Certificate())
+		return UpstreamTLSConfig(testutils.ParseURI(srv.URL), &utils.UpstreamTLS{RootCAs: roots})
+	}
+	insecureTransport := RoundTripper(&http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}})
+
+	testCases := []struct {
+		desc          string
+		unixSocket    bool
+		tls           bool
+		h2c           bool
+		options       func(srv *httptest.Server) []optSetter
+		expectedProto string
+	}{
+		{
+			desc:          "unix socket",
+			unixSocket:    true,
+			expectedProto: "HTTP/1.1",
+		},
+		{
+			desc: "upstream TLS settings",
+			tls:  true,
+			options: func(srv *httptest.Server) []optSetter {
+				return []optSetter{upstreamTLS(srv)}
+			},
+			expectedProto: "HTTP/1.1",
+		},
+		{
+			desc: "http2",
+			tls:  true,
+			options: func(srv *httptest.Server) []optSetter {
+				return []optSetter{insecureTransport, UpstreamProtocol(ProtocolHTTP2)}
+			},
+			expectedProto: "HTTP/2.0",
+		},
+		{
+			desc: "http2 with upstream TLS settings",
+			tls:  true,
+			options: func(srv *httptest.Server) []optSetter {
+				return []optSetter{upstreamTLS(srv), UpstreamProtocol(ProtocolHTTP2)}
+			},
+			expectedProto: "HTTP/2.0",
+		},
+		{
+			desc: "h2c",
+			h2c:  true,
+			options: func(srv *httptest.Server) []optSetter {
+				return []optSetter{UpstreamProtocol(ProtocolH2C)}
+			},
+			expectedProto: "HTTP/2.0",
+		},
+		{
+			desc:       "h2c over unix socket",
+			unixSocket: true,
+			h2c:        true,
+			options: func(srv *httptest.Server) []optSetter {
+				return []optSetter{UpstreamProtocol(ProtocolH2C)}
+			},
+			expectedProto: "HTTP/2.0",
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			var listener *proxyProtocolListener
+			var handler http.Handler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				// h2c requests don't carry the context of the connection
+				fmt.Fprintf(w, "%s %s", listener.header(req.RemoteAddr), req.Proto)
+			})
+			if test.h2c {
+				handler = h2c.NewHandler(handler, &http2.Server{})
+			}
+
+			srv := httptest.NewUnstartedServer(handler)
+			var socketPath string
+			if test.unixSocket {
+				dir, err := ioutil.TempDir("", "oxy")
+				require.NoError(t, err)
+				defer os.RemoveAll(dir)
+
+				socketPath = filepath.Join(dir, "app.sock")
+				srv.Listener.Close()
+				srv.Listener, err = net.Listen("unix", socketPath)
+				require.NoError(t, err)
+			}
+			listener = listenProxyProtocol(srv)
+			if test.tls {
+				srv.EnableHTTP2 = test.expectedProto == "HTTP/2.0"
+				srv.StartTLS()
+			} else {
+				srv.Start()
+			}
+			defer srv.Close()
+
+			target := srv.URL
+			if test.unixSocket {
+				target = "unix://" + socketPath
+			}
+
+			options := []optSetter{ProxyProtocol(1)}
+			if test.options != nil {
+				options = append(options, test.options(srv)...)
+			}
+			f, err := New(options...)
+			require.NoError(t, err)
+
+			proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				req.URL = testutils.ParseURI(target)
+				f.ServeHTTP(w, req)
+			}))
+			defer proxy.Close()
+
+			proxyHost, proxyPort, err := net.SplitHostPort(testutils.ParseURI(proxy.URL).Host)
+			require.NoError(t, err)
+
+			for i := 0; i < 2; i++ {
+				client := newRecordingClient()
+				for j := 0; j < 2; j++ {
+					resp, err := client.Get(proxy.URL)
+					require.NoError(t, err)
+					body, err := ioutil.ReadAll(resp.Body)
+					resp.Body.Close()
+					require.NoError(t, err)
+
+					clientHost, clientPort, err := net.SplitHostPort(client.localAddr)
+					require.NoError(t, err)
+					expected := fmt.Sprintf("PROXY TCP4 %s %s %s %s %s", clientHost, proxyHost, clientPort, proxyPort, test.expectedProto)
+					assert.Equal(t, expected, string(body), "client %d request %d", i, j)
+				}
+			}
+
+			assert.EqualValues(t, 2, atomic.LoadInt32(&listener.accepted))
+		})
+	}
+}
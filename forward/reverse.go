@@ -0,0 +1,234 @@
+package forward
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// ReverseRewriter rewrites the responses of the upstream servers so that they refer to the public namespace,
+// like Apache's ProxyPassReverse, ProxyPassReverseCookieDomain and ProxyPassReverseCookiePath.
+// The Location, Content-Location and Refresh URLs of the upstream hosts are mapped to the public scheme, host and path prefix,
+// and so are the Domain and Path attributes of the Set-Cookie headers.
+//
+// The public namespace is read from the forwarding headers set by the HeaderRewriter on the upstream request:
+// X-Forwarded-Proto, X-Forwarded-Host and X-Forwarded-Prefix, or the Forwarded header in ForwardedModeStandard.
+// It plugs into the forwarder with ResponseModifier(rw.ModifyResponse).
+type ReverseRewriter struct {
+	// UpstreamPrefix is the path prefix of the upstream namespace mapped to the public prefix, e.g. "/internal/app"
+	UpstreamPrefix string
+	// PublicPrefix overrides the public path prefix read from the X-Forwarded-Prefix header, e.g. "/app"
+	PublicPrefix string
+	// CookieDomain overrides the domain set on the cookies of the upstream hosts, it defaults to the public host name
+	CookieDomain string
+}
+
+// ModifyResponse rewrites the headers of the response
+func (rw *ReverseRewriter) ModifyResponse(resp *http.Response) error {
+	if resp.Request == nil {
+		return nil
+	}
+	m := rw.mapping(resp.Request)
+
+	for _, name := range []string{Location, ContentLocation} {
+		if value := resp.Header.Get(name); value != "" {
+			resp.Header.Set(name, m.rewriteURL(value))
+		}
+	}
+
+	if value := resp.Header.Get(Refresh); value != "" {
+		resp.Header.Set(Refresh, m.rewriteRefresh(value))
+	}
+
+	for i, cookie := range resp.Header[SetCookie] {
+		resp.Header[SetCookie][i] = m.rewriteCookie(cookie)
+	}
+	return nil
+}
+
+// reverseMapping maps the upstream namespace of a request to its public one
+type reverseMapping struct {
+	upstreamScheme string
+	upstreamHosts  []string
+	publicScheme   string
+	publicHost     string
+	upstreamPrefix string
+	publicPrefix   string
+	cookieDomain   string
+}
+
+func (rw *ReverseRewriter) mapping(req *http.Request) *reverseMapping {
+	m := &reverseMapping{
+		upstreamScheme: req.URL.Scheme,
+		publicScheme:   req.Header.Get(XForwardedProto),
+		publicHost:     req.Header.Get(XForwardedHost),
+		upstreamPrefix: strings.TrimSuffix(rw.UpstreamPrefix, "/"),
+		publicPrefix:   strings.TrimSuffix(rw.PublicPrefix, "/"),
+		cookieDomain:   rw.CookieDomain,
+	}
+
+	for _, host := range []string{req.URL.Host, req.Host} {
+		if host != "" {
+			m.upstreamHosts = append(m.upstreamHosts, host)
+		}
+	}
+
+	if rw.PublicPrefix == "" {
+		m.publicPrefix = strings.TrimSuffix(req.Header.Get(XForwardedPrefix), "/")
+	}
+
+	if m.publicHost == "" {
+		// the last element of the Forwarded header describes the hop to this proxy
+		if elements, err := ParseForwarded(strings.Join(req.Header[Forwarded], ", ")); err == nil && len(elements) > 0 {
+			m.publicHost = elements[len(elements)-1].Host
+			m.publicScheme = elements[len(elements)-1].Proto
+		}
+	}
+
+	switch m.publicScheme {
+	case "ws":
+		m.publicScheme = "http"
+	case "wss":
+		m.publicScheme = "https"
+	case "":
+		m.publicScheme = "http"
+	}
+
+	if m.cookieDomain == "" {
+		m.cookieDomain = hostname(m.publicHost)
+	}
+	return m
+}
+
+// isUpstreamHost reports whether the host of a URL with the scheme is one of the upstream hosts
+func (m *reverseMapping) isUpstreamHost(host, scheme string) bool {
+	if scheme == "" {
+		scheme = m.upstreamScheme
+	}
+	host = normalizeHost(host, scheme)
+	for _, upstream := range m.upstreamHosts {
+		if host == normalizeHost(upstream, m.upstreamScheme) {
+			return true
+		}
+	}
+	return false
+}
+
+// isUpstreamDomain reports whether the cookie domain is the name of one of the upstream hosts
+func (m *reverseMapping) isUpstreamDomain(domain string) bool {
+	domain = strings.ToLower(strings.TrimPrefix(domain, "."))
+	for _, upstream := range m.upstreamHosts {
+		if domain == strings.ToLower(hostname(upstream)) {
+			return true
+		}
+	}
+	return false
+}
+
+// rewritePath maps a path of the upstream namespace to the public one, other paths are left untouched
+func (m *reverseMapping) rewritePath(p string) string {
+	if m.upstreamPrefix == m.publicPrefix || !strings.HasPrefix(p, "/") {
+		return p
+	}
+	if m.upstreamPrefix != "" && p != m.upstreamPrefix && !strings.HasPrefix(p, m.upstreamPrefix+"/") {
+		return p
+	}
+
+	rewritten := m.publicPrefix + strings.TrimPrefix(p, m.upstreamPrefix)
+	if rewritten == "" {
+		return "/"
+	}
+	return rewritten
+}
+
+// rewriteURL maps an absolute URL of an upstream host or an absolute path to the public namespace
+func (m *reverseMapping) rewriteURL(value string) string {
+	u, err := url.Parse(value)
+	if err != nil {
+		return value
+	}
+
+	if u.Host != "" {
+		if m.publicHost == "" || !m.isUpstreamHost(u.Host, u.Scheme) {
+			return value
+		}
+		u.Host = m.publicHost
+		if u.Scheme != "" {
+			u.Scheme = m.publicScheme
+		}
+	} else if u.Scheme != "" || !strings.HasPrefix(u.Path, "/") {
+		// relative references resolve against the public URL already
+		return value
+	}
+
+	rawPath := m.rewritePath(u.EscapedPath())
+	if path, err := url.PathUnescape(rawPath); err == nil {
+		u.Path = path
+		u.RawPath = rawPath
+	}
+	return u.String()
+}
+
+// rewriteRefresh maps the URL of a Refresh header value such as "5; url=http://backend/next"
+func (m *reverseMapping) rewriteRefresh(value string) string {
+	idx := strings.Index(strings.ToLower(value), "url=")
+	if idx < 0 {
+		return value
+	}
+
+	prefix, target := value[:idx+len("url=")], strings.TrimSpace(value[idx+len("url="):])
+	quote := ""
+	if len(target) >= 2 && (target[0] == '"' || target[0] == '\'') && target[len(target)-1] == target[0] {
+		quote = target[:1]
+		target = target[1 : len(target)-1]
+	}
+	return prefix + quote + m.rewriteURL(target) + quote
+}
+
+// rewriteCookie maps the Domain and Path attributes of a Set-Cookie header value
+func (m *reverseMapping) rewriteCookie(value string) string {
+	parts := strings.Split(value, ";")
+	for i := 1; i < len(parts); i++ {
+		attr := strings.TrimSpace(parts[i])
+		eq := strings.Index(attr, "=")
+		if eq < 0 {
+			continue
+		}
+
+		name, val := attr[:eq], attr[eq+1:]
+		switch strings.ToLower(name) {
+		case "domain":
+			if m.cookieDomain != "" && m.isUpstreamDomain(val) {
+				parts[i] = " " + name + "=" + m.cookieDomain
+			}
+		case "path":
+			parts[i] = " " + name + "=" + m.rewritePath(val)
+		}
+	}
+	return strings.Join(parts, ";")
+}
+
+// hostname returns the host without port
+func hostname(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+}
+
+// normalizeHost lowercases the host and removes the default port of the scheme
+func normalizeHost(host, scheme string) string {
+	host = strings.ToLower(host)
+	h, port, err := net.SplitHostPort(host)
+	if err != nil {
+		return host
+	}
+	if (port == "80" && (scheme == "http" || scheme == "ws")) || (port == "443" && (scheme == "https" || scheme == "wss")) {
+		if strings.Contains(h, ":") {
+			return "[" + h + "]"
+		}
+		return h
+	}
+	return host
+}
@@ -0,0 +1,152 @@
+package forward
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/testutils"
+)
+
+func TestReverseRewriter(t *testing.T) {
+	testCases := []struct {
+		desc      string
+		rewriter  ReverseRewriter
+		reqHeader http.Header
+		header    http.Header
+		expected  http.Header
+	}{
+		{
+			desc:      "absolute location",
+			reqHeader: http.Header{XForwardedProto: {"https"}, XForwardedHost: {"example.com"}},
+			header:    http.Header{Location: {"http://backend:8080/login?next=%2Fa"}},
+			expected:  http.Header{Location: {"https://example.com/login?next=%2Fa"}},
+		},
+		{
+			desc:      "host header location",
+			reqHeader: http.Header{XForwardedProto: {"https"}, XForwardedHost: {"example.com"}},
+			header:    http.Header{Location: {"http://internal.local/login"}},
+			expected:  http.Header{Location: {"https://example.com/login"}},
+		},
+		{
+			desc:      "default port",
+			reqHeader: http.Header{XForwardedProto: {"http"}, XForwardedHost: {"example.com:8000"}},
+			header:    http.Header{Location: {"http://INTERNAL.local:80/"}},
+			expected:  http.Header{Location: {"http://example.com:8000/"}},
+		},
+		{
+			desc:      "other host",
+			reqHeader: http.Header{XForwardedProto: {"https"}, XForwardedHost: {"example.com"}},
+			header:    http.Header{Location: {"https://auth.example.org/login"}, ContentLocation: {"http://backend:8080/doc"}},
+			expected:  http.Header{Location: {"https://auth.example.org/login"}, ContentLocation: {"https://example.com/doc"}},
+		},
+		{
+			desc:      "forwarded prefix",
+			reqHeader: http.Header{XForwardedProto: {"https"}, XForwardedHost: {"example.com"}, XForwardedPrefix: {"/app"}},
+			header:    http.Header{Location: {"/login"}, ContentLocation: {"http://backend:8080/"}},
+			expected:  http.Header{Location: {"/app/login"}, ContentLocation: {"https://example.com/app/"}},
+		},
+		{
+			desc:      "upstream prefix",
+			rewriter:  ReverseRewriter{UpstreamPrefix: "/internal/", PublicPrefix: "/app"},
+			reqHeader: http.Header{XForwardedHost: {"example.com"}},
+			header:    http.Header{Location: {"/internal/a%2Fb"}, ContentLocation: {"/internals"}},
+			expected:  http.Header{Location: {"/app/a%2Fb"}, ContentLocation: {"/internals"}},
+		},
+		{
+			desc:      "relative location",
+			reqHeader: http.Header{XForwardedHost: {"example.com"}, XForwardedPrefix: {"/app"}},
+			header:    http.Header{Location: {"next"}},
+			expected:  http.Header{Location: {"next"}},
+		},
+		{
+			desc:      "forwarded header",
+			reqHeader: http.Header{Forwarded: {"for=1.2.3.4;proto=http;host=proxy1, for=5.6.7.8;proto=wss;host=example.com"}},
+			header:    http.Header{Location: {"ws://backend:8080/ws"}},
+			expected:  http.Header{Location: {"https://example.com/ws"}},
+		},
+		{
+			desc:      "refresh",
+			reqHeader: http.Header{XForwardedProto: {"https"}, XForwardedHost: {"example.com"}},
+			header:    http.Header{Refresh: {"5; URL='http://backend:8080/next'"}},
+			expected:  http.Header{Refresh: {"5; URL='https://example.com/next'"}},
+		},
+		{
+			desc:      "cookies",
+			reqHeader: http.Header{XForwardedHost: {"example.com:8443"}, XForwardedPrefix: {"/app"}},
+			header: http.Header{SetCookie: {
+				"a=1; Path=/; Domain=.backend; HttpOnly",
+				"b=2; domain=internal.local; path=/account",
+				"c=3; Domain=example.org; Path=/",
+			}},
+			expected: http.Header{SetCookie: {
+				"a=1; Path=/app/; Domain=example.com; HttpOnly",
+				"b=2; domain=example.com; path=/app/account",
+				"c=3; Domain=example.org; Path=/app/",
+			}},
+		},
+		{
+			desc:      "cookie domain",
+			rewriter:  ReverseRewriter{CookieDomain: ".example.com"},
+			reqHeader: http.Header{XForwardedHost: {"www.example.com"}},
+			header:    http.Header{SetCookie: {"a=1; Domain=backend"}},
+			expected:  http.Header{SetCookie: {"a=1; Domain=.example.com"}},
+		},
+		{
+			desc:     "unknown public host",
+			header:   http.Header{Location: {"http://backend:8080/login"}},
+			expected: http.Header{Location: {"http://backend:8080/login"}},
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			req := httptest.NewRequest(http.MethodGet, "http://backend:8080/", nil)
+			req.Host = "internal.local"
+			if test.reqHeader != nil {
+				req.Header = test.reqHeader
+			}
+
+			resp := &http.Response{Header: test.header, Request: req}
+			require.NoError(t, test.rewriter.ModifyResponse(resp))
+			assert.Equal(t, test.expected, resp.Header)
+		})
+	}
+}
+
+func TestReverseRewriterForward(t *testing.T) {
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Add(SetCookie, "session=1; Path=/; Domain="+hostname(req.Host))
+		http.Redirect(w, req, "http://"+req.Host+"/login", http.StatusFound)
+	})
+	defer srv.Close()
+
+	rw := &ReverseRewriter{PublicPrefix: "/app"}
+	f, err := New(ResponseModifier(rw.ModifyResponse))
+	require.NoError(t, err)
+
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		f.ServeHTTP(w, req)
+	}))
+	defer proxy.Close()
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	req, err := http.NewRequest(http.MethodGet, proxy.URL, nil)
+	require.NoError(t, err)
+	req.Host = "example.com"
+
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	assert.Equal(t, "http://example.com/app/login", resp.Header.Get(Location))
+	assert.Equal(t, "session=1; Path=/app/; Domain=example.com", resp.Header.Get(SetCookie))
+}
@@ -12,6 +12,13 @@ import (
 type HeaderRewriter struct {
 	TrustForwardHeader bool
 	Hostname           string
+	// TrustedProxies restricts the trust of incoming forwarding headers to requests received from these proxies
+	// when TrustForwardHeader is false. The real client IP it resolves is used as X-Real-Ip.
+	TrustedProxies *utils.TrustedProxies
+	// ForwardedMode selects whether the RFC 7239 Forwarded header is emitted alongside or instead of the X-Forwarded-* headers
+	ForwardedMode ForwardedMode
+	// ForwardedBy is the identifier of this proxy in the by parameter of the Forwarded header, e.g. an obfuscated "_proxy1"
+	ForwardedBy string
 }
 
 // clean up IP in case if it is ipv6 address and it has {zone} information in it, like "[fe80::d806:a55d:eb1b:49cc%vEthernet (vmxnet3 Ethernet Adapter - Virtual Switch)]:64692"
@@ -21,12 +28,34 @@ func ipv6fix(clientIP string) string {
 
 // Rewrite rewrite request headers
 func (rw *HeaderRewriter) Rewrite(req *http.Request) {
-	if !rw.TrustForwardHeader {
+	if !rw.TrustForwardHeader && !rw.TrustedProxies.IsTrusted(req) {
 		utils.RemoveHeaders(req.Header, XHeaders...)
+		// the Forwarded header is passed through as is in legacy mode
+		if rw.ForwardedMode != ForwardedModeLegacy {
+			utils.RemoveHeaders(req.Header, Forwarded)
+		}
+	}
+
+	if rw.ForwardedMode != ForwardedModeLegacy {
+		rw.appendForwarded(req)
+	}
+
+	if rw.ForwardedMode == ForwardedModeStandard {
+		utils.RemoveHeaders(req.Header, XHeaders...)
+		// A nil value prevents httputil.ReverseProxy from setting X-Forwarded-For
+		req.Header[XForwardedFor] = nil
+		return
 	}
 
 	if clientIP, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
 		clientIP = ipv6fix(clientIP)
+
+		if rw.TrustedProxies != nil {
+			req.Header.Set(XRealIp, rw.TrustedProxies.ClientIP(req))
+		} else if req.Header.Get(XRealIp) == "" {
+			req.Header.Set(XRealIp, clientIP)
+		}
+
 		// If not websocket, done in http.ReverseProxy
 		if IsWebsocketRequest(req) {
 			if prior, ok := req.Header[XForwardedFor]; ok {
@@ -35,10 +64,6 @@ func (rw *HeaderRewriter) Rewrite(req *http.Request) {
 				req.Header.Set(XForwardedFor, clientIP)
 			}
 		}
-
-		if req.Header.Get(XRealIp) == "" {
-			req.Header.Set(XRealIp, clientIP)
-		}
 	}
 
 	xfProto := req.Header.Get(XForwardedProto)
@@ -71,6 +96,39 @@ func (rw *HeaderRewriter) Rewrite(req *http.Request) {
 	}
 }
 
+// appendForwarded appends the element describing this hop to the Forwarded header,
+// a malformed prior value is discarded.
+func (rw *HeaderRewriter) appendForwarded(req *http.Request) {
+	elem := ForwardedElement{
+		For:   "unknown",
+		Proto: "http",
+		Host:  req.Host,
+		By:    rw.ForwardedBy,
+	}
+
+	if clientIP, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		elem.For = forwardedNode(ipv6fix(clientIP))
+	}
+
+	if req.TLS != nil {
+		elem.Proto = "https"
+	}
+	if IsWebsocketRequest(req) {
+		if req.TLS != nil {
+			elem.Proto = "wss"
+		} else {
+			elem.Proto = "ws"
+		}
+	}
+
+	prior := strings.Join(req.Header[Forwarded], ", ")
+	if _, err := ParseForwarded(prior); err == nil && prior != "" {
+		req.Header.Set(Forwarded, prior+", "+elem.String())
+	} else {
+		req.Header.Set(Forwarded, elem.String())
+	}
+}
+
 func forwardedPort(req *http.Request) string {
 	if req == nil {
 		return ""
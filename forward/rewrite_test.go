@@ -1,9 +1,13 @@
 package forward
 
 import (
+	"net/http"
+	"net/http/httptest"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/utils"
 )
 
 func TestIPv6Fix(t *testing.T) {
@@ -59,3 +63,141 @@ func TestIPv6Fix(t *testing.T) {
 		})
 	}
 }
+
+func TestHeaderRewriterForwarded(t *testing.T) {
+	testCases := []struct {
+		desc              string
+		mode              ForwardedMode
+		trust             bool
+		remoteAddr        string
+		headers           http.Header
+		expectedForwarded string
+		expectXFFPresent  bool
+	}{
+		{
+			desc:       "legacy mode does not emit Forwarded",
+			mode:       ForwardedModeLegacy,
+			remoteAddr: "10.0.0.1:1234",
+		},
+		{
+			desc:              "legacy mode passes untrusted Forwarded through",
+			mode:              ForwardedModeLegacy,
+			remoteAddr:        "10.0.0.1:1234",
+			headers:           http.Header{Forwarded: []string{"for=1.2.3.4"}},
+			expectedForwarded: "for=1.2.3.4",
+		},
+		{
+			desc:              "both modes",
+			mode:              ForwardedModeBoth,
+			remoteAddr:        "10.0.0.1:1234",
+			expectedForwarded: "for=10.0.0.1;proto=http;host=example.com;by=_proxy",
+		},
+		{
+			desc:              "standard mode drops legacy headers",
+			mode:              ForwardedModeStandard,
+			trust:             true,
+			remoteAddr:        "[2001:db8::1]:1234",
+			headers:           http.Header{XForwardedFor: []string{"1.2.3.4"}},
+			expectedForwarded: `for="[2001:db8::1]";proto=http;host=example.com;by=_proxy`,
+			expectXFFPresent:  true,
+		},
+		{
+			desc:              "trusted prior value is appended",
+			mode:              ForwardedModeStandard,
+			trust:             true,
+			remoteAddr:        "10.0.0.1:1234",
+			headers:           http.Header{Forwarded: []string{"for=1.2.3.4"}},
+			expectedForwarded: "for=1.2.3.4, for=10.0.0.1;proto=http;host=example.com;by=_proxy",
+			expectXFFPresent:  true,
+		},
+		{
+			desc:              "untrusted prior value is removed",
+			mode:              ForwardedModeStandard,
+			remoteAddr:        "10.0.0.1:1234",
+			headers:           http.Header{Forwarded: []string{"for=1.2.3.4"}},
+			expectedForwarded: "for=10.0.0.1;proto=http;host=example.com;by=_proxy",
+			expectXFFPresent:  true,
+		},
+		{
+			desc:              "malformed prior value is replaced",
+			mode:              ForwardedModeStandard,
+			trust:             true,
+			remoteAddr:        "10.0.0.1:1234",
+			headers:           http.Header{Forwarded: []string{"for=[::1]"}},
+			expectedForwarded: "for=10.0.0.1;proto=http;host=example.com;by=_proxy",
+			expectXFFPresent:  true,
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			req := httptest.NewRequest(http.MethodGet, "http://example.com", nil)
+			req.RemoteAddr = test.remoteAddr
+			for k, v := range test.headers {
+				req.Header[k] = v
+			}
+
+			rw := &HeaderRewriter{TrustForwardHeader: test.trust, ForwardedMode: test.mode, ForwardedBy: "_proxy"}
+			rw.Rewrite(req)
+
+			assert.Equal(t, test.expectedForwarded, req.Header.Get(Forwarded))
+			// a nil X-Forwarded-For prevents httputil.ReverseProxy from setting it
+			xff, ok := req.Header[XForwardedFor]
+			assert.Equal(t, test.expectXFFPresent, ok)
+			assert.Nil(t, xff)
+			if test.mode == ForwardedModeStandard {
+				assert.Empty(t, req.Header.Get(XForwardedProto))
+				assert.Empty(t, req.Header.Get(XRealIp))
+			} else {
+				assert.Equal(t, "http", req.Header.Get(XForwardedProto))
+			}
+		})
+	}
+}
+
+func TestHeaderRewriterTrustedProxies(t *testing.T) {
+	trusted, err := utils.NewTrustedProxies("10.0.0.0/8")
+	require.NoError(t, err)
+
+	testCases := []struct {
+		desc           string
+		remoteAddr     string
+		expectedRealIP string
+		expectedXFHost string
+	}{
+		{
+			desc:           "trusted proxy keeps forwarding headers",
+			remoteAddr:     "10.0.0.1:1234",
+			expectedRealIP: "1.2.3.4",
+			expectedXFHost: "public.example.com",
+		},
+		{
+			desc:           "untrusted peer has forwarding headers removed",
+			remoteAddr:     "6.6.6.6:1234",
+			expectedRealIP: "6.6.6.6",
+			expectedXFHost: "example.com",
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			req := httptest.NewRequest(http.MethodGet, "http://example.com", nil)
+			req.RemoteAddr = test.remoteAddr
+			req.Header.Set(XForwardedFor, "9.9.9.9, 1.2.3.4, 10.0.0.2")
+			req.Header.Set(XForwardedHost, "public.example.com")
+			req.Header.Set(XRealIp, "9.9.9.9")
+
+			rw := &HeaderRewriter{TrustedProxies: trusted}
+			rw.Rewrite(req)
+
+			assert.Equal(t, test.expectedRealIP, req.Header.Get(XRealIp))
+			assert.Equal(t, test.expectedXFHost, req.Header.Get(XForwardedHost))
+		})
+	}
+}
@@ -0,0 +1,45 @@
+package forward
+
+import (
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// DefaultStreamingContentTypes are the content types of the responses flushed on every write by default
+var DefaultStreamingContentTypes = []string{
+	"text/event-stream",
+	"application/x-ndjson",
+}
+
+// StreamingContentTypes sets the content types of the streaming responses, e.g. Server-Sent Events.
+// The streaming responses, and the responses without Content-Length, are flushed on every write whatever
+// the Stream and StreamingFlushInterval settings, the other responses keep their flushing behaviour.
+func StreamingContentTypes(types ...string) optSetter {
+	return func(f *Forwarder) error {
+		f.httpForwarder.streamingContentTypes = make([]string, 0, len(types))
+		for _, t := range types {
+			f.httpForwarder.streamingContentTypes = append(f.httpForwarder.streamingContentTypes, strings.ToLower(strings.TrimSpace(t)))
+		}
+		return nil
+	}
+}
+
+// isStreamingResponse reports whether the response must be flushed on every write: either its content type
+// is a streaming one or its length is unknown, as long polling responses
+func (f *httpForwarder) isStreamingResponse(resp *http.Response) bool {
+	if resp.ContentLength == -1 && resp.Request != nil && resp.Request.Method != http.MethodHead {
+		return true
+	}
+
+	mediaType, _, err := mime.ParseMediaType(resp.Header.Get(ContentType))
+	if err != nil {
+		return false
+	}
+	for _, t := range f.streamingContentTypes {
+		if mediaType == t {
+			return true
+		}
+	}
+	return false
+}
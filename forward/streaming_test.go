@@ -0,0 +1,129 @@
+package forward
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/testutils"
+)
+
+func TestStreamingResponses(t *testing.T) {
+	const first, second = "data: 1\n\n", "data: 2\n\n"
+
+	testCases := []struct {
+		desc             string
+		options          []optSetter
+		contentType      string
+		contentLength    bool
+		expectedStreamed bool
+	}{
+		{
+			desc:             "server-sent events",
+			contentType:      "text/event-stream; charset=utf-8",
+			contentLength:    true,
+			expectedStreamed: true,
+		},
+		{
+			desc:             "ndjson",
+			contentType:      "application/x-ndjson",
+			contentLength:    true,
+			expectedStreamed: true,
+		},
+		{
+			desc:             "configured content type",
+			options:          []optSetter{StreamingContentTypes("Application/JSON")},
+			contentType:      "application/json",
+			contentLength:    true,
+			expectedStreamed: true,
+		},
+		{
+			desc:             "unknown length",
+			contentType:      "application/octet-stream",
+			expectedStreamed: true,
+		},
+		{
+			desc:             "buffered",
+			contentType:      "application/octet-stream",
+			contentLength:    true,
+			expectedStreamed: false,
+		},
+		{
+			desc:             "buffered with stream",
+			options:          []optSetter{Stream(true), StreamingFlushInterval(time.Hour)},
+			contentType:      "application/octet-stream",
+			contentLength:    true,
+			expectedStreamed: false,
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			release := make(chan struct{})
+			srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+				w.Header().Set(ContentType, test.contentType)
+				if test.contentLength {
+					w.Header().Set(ContentLength, strconv.Itoa(len(first)+len(second)))
+				}
+				w.Write([]byte(first))
+				w.(http.Flusher).Flush()
+				<-release
+				w.Write([]byte(second))
+			})
+			defer srv.Close()
+
+			f, err := New(test.options...)
+			require.NoError(t, err)
+
+			proxy := createProxyWithForwarder(f, srv.URL)
+			defer proxy.Close()
+
+			// the headers of the buffered responses are held back as well
+			received := make(chan string, 1)
+			rest := make(chan string, 1)
+			go func() {
+				defer close(rest)
+				re, err := http.Get(proxy.URL)
+				if err != nil {
+					close(received)
+					return
+				}
+				defer re.Body.Close()
+
+				buf := make([]byte, len(first))
+				io.ReadFull(re.Body, buf)
+				received <- string(buf)
+				data, _ := ioutil.ReadAll(re.Body)
+				rest <- string(data)
+			}()
+
+			if test.expectedStreamed {
+				select {
+				case data := <-received:
+					assert.Equal(t, first, data)
+				case <-time.After(time.Second):
+					t.Error("the first event was not flushed")
+				}
+				close(release)
+			} else {
+				select {
+				case <-received:
+					t.Error("the response was flushed")
+				case <-time.After(100 * time.Millisecond):
+				}
+				close(release)
+				assert.Equal(t, first, <-received)
+			}
+
+			assert.Equal(t, second, <-rest)
+		})
+	}
+}
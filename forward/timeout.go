@@ -0,0 +1,260 @@
+package forward
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+
+	"github.com/vulcand/oxy/utils"
+)
+
+// upstreamTimeouts holds the time budgets of the phases of the requests to the upstream servers
+type upstreamTimeouts struct {
+	dial           time.Duration
+	tlsHandshake   time.Duration
+	responseHeader time.Duration
+	idleRead       time.Duration
+	total          time.Duration
+}
+
+func (t upstreamTimeouts) enabled() bool {
+	return t.dial > 0 || t.tlsHandshake > 0 || t.responseHeader > 0 || t.idleRead > 0 || t.total > 0
+}
+
+func (t upstreamTimeouts) timeout(phase utils.TimeoutPhase) time.Duration {
+	switch phase {
+	case utils.TimeoutPhaseDial:
+		return t.dial
+	case utils.TimeoutPhaseTLSHandshake:
+		return t.tlsHandshake
+	case utils.TimeoutPhaseResponseHeader:
+		return t.responseHeader
+	case utils.TimeoutPhaseIdleRead:
+		return t.idleRead
+	case utils.TimeoutPhaseTotal:
+		return t.total
+	}
+	return 0
+}
+
+// DialTimeout limits the time to connect to the upstream servers, name resolution included.
+// Expiries are reported as a *utils.UpstreamTimeoutError with the utils.TimeoutPhaseDial phase.
+func DialTimeout(d time.Duration) optSetter {
+	return func(f *Forwarder) error {
+		f.httpForwarder.timeouts.dial = d
+		return nil
+	}
+}
+
+// TLSHandshakeTimeout limits the time to negotiate TLS with the upstream servers.
+// Expiries are reported as a *utils.UpstreamTimeoutError with the utils.TimeoutPhaseTLSHandshake phase.
+func TLSHandshakeTimeout(d time.Duration) optSetter {
+	return func(f *Forwarder) error {
+		f.httpForwarder.timeouts.tlsHandshake = d
+		return nil
+	}
+}
+
+// ResponseHeaderTimeout limits the time to receive the response headers once the request is written.
+// Expiries are reported as a *utils.UpstreamTimeoutError with the utils.TimeoutPhaseResponseHeader phase.
+func ResponseHeaderTimeout(d time.Duration) optSetter {
+	return func(f *Forwarder) error {
+		f.httpForwarder.timeouts.responseHeader = d
+		return nil
+	}
+}
+
+// IdleReadTimeout limits the time waiting for the next bytes of a response body.
+// Expiries are reported as a *utils.UpstreamTimeoutError with the utils.TimeoutPhaseIdleRead phase.
+func IdleReadTimeout(d time.Duration) optSetter {
+	return func(f *Forwarder) error {
+		f.httpForwarder.timeouts.idleRead = d
+		return nil
+	}
+}
+
+// TotalTimeout limits the time of a whole request, from the dial to the end of the response body.
+// Expiries are reported as a *utils.UpstreamTimeoutError with the utils.TimeoutPhaseTotal phase.
+func TotalTimeout(d time.Duration) optSetter {
+	return func(f *Forwarder) error {
+		f.httpForwarder.timeouts.total = d
+		return nil
+	}
+}
+
+// timeoutTracker runs the timers of the phases of a request and cancels it when one expires
+type timeoutTracker struct {
+	timeouts upstreamTimeouts
+	cancel   context.CancelFunc
+
+	mutex  sync.Mutex
+	timers map[utils.TimeoutPhase]*time.Timer
+	err    *utils.UpstreamTimeoutError
+}
+
+// start starts the timer of the phase unless it is already running
+func (t *timeoutTracker) start(phase utils.TimeoutPhase) {
+	d := t.timeouts.timeout(phase)
+	if d <= 0 {
+		return
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if _, ok := t.timers[phase]; ok || t.err != nil {
+		return
+	}
+
+	var timer *time.Timer
+	timer = time.AfterFunc(d, func() {
+		t.mutex.Lock()
+		if t.timers[phase] != timer || t.err != nil {
+			t.mutex.Unlock()
+			return
+		}
+		t.err = &utils.UpstreamTimeoutError{Phase: phase, Duration: d}
+		t.mutex.Unlock()
+		t.cancel()
+	})
+	t.timers[phase] = timer
+}
+
+// stop stops the timers of the phases
+func (t *timeoutTracker) stop(phases ...utils.TimeoutPhase) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for _, phase := range phases {
+		if timer, ok := t.timers[phase]; ok {
+			timer.Stop()
+			delete(t.timers, phase)
+		}
+	}
+}
+
+// finish stops all the timers and releases the request context
+func (t *timeoutTracker) finish() {
+	t.mutex.Lock()
+	for phase, timer := range t.timers {
+		timer.Stop()
+		delete(t.timers, phase)
+	}
+	t.mutex.Unlock()
+	t.cancel()
+}
+
+// timeoutError returns the error of the expired phase, or err when no phase expired
+func (t *timeoutTracker) timeoutError(err error) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.err != nil {
+		return t.err
+	}
+	return err
+}
+
+// timeoutRoundTripper enforces the time budgets of the phases of the requests
+type timeoutRoundTripper struct {
+	http.RoundTripper
+	timeouts upstreamTimeouts
+}
+
+// RoundTrip executes the round trip
+func (rt *timeoutRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, cancel := context.WithCancel(req.Context())
+	t := &timeoutTracker{
+		timeouts: rt.timeouts,
+		cancel:   cancel,
+		timers:   make(map[utils.TimeoutPhase]*time.Timer),
+	}
+	t.start(utils.TimeoutPhaseTotal)
+
+	// the dial phase lasts until a connection is obtained, custom dial functions may not report the connection
+	trace := &httptrace.ClientTrace{
+		GetConn: func(string) {
+			t.start(utils.TimeoutPhaseDial)
+		},
+		ConnectDone: func(_, _ string, err error) {
+			if err == nil {
+				t.stop(utils.TimeoutPhaseDial)
+			}
+		},
+		TLSHandshakeStart: func() {
+			t.stop(utils.TimeoutPhaseDial)
+			t.start(utils.TimeoutPhaseTLSHandshake)
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			t.stop(utils.TimeoutPhaseTLSHandshake)
+		},
+		GotConn: func(httptrace.GotConnInfo) {
+			t.stop(utils.TimeoutPhaseDial, utils.TimeoutPhaseTLSHandshake)
+		},
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			t.start(utils.TimeoutPhaseResponseHeader)
+		},
+	}
+
+	resp, err := rt.RoundTripper.RoundTrip(req.WithContext(httptrace.WithClientTrace(ctx, trace)))
+	t.stop(utils.TimeoutPhaseDial, utils.TimeoutPhaseTLSHandshake, utils.TimeoutPhaseResponseHeader)
+	if err != nil {
+		err = t.timeoutError(err)
+		t.finish()
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		// the upgraded connection must outlive the time budgets
+		t.stop(utils.TimeoutPhaseTotal)
+		return resp, nil
+	}
+
+	resp.Body = &timeoutBody{ReadCloser: resp.Body, req: req, tracker: t}
+	return resp, nil
+}
+
+// timeoutBody is a response body enforcing the idle read and total time budgets
+type timeoutBody struct {
+	io.ReadCloser
+	req     *http.Request
+	tracker *timeoutTracker
+}
+
+func (b *timeoutBody) Read(p []byte) (int, error) {
+	b.tracker.start(utils.TimeoutPhaseIdleRead)
+	n, err := b.ReadCloser.Read(p)
+	b.tracker.stop(utils.TimeoutPhaseIdleRead)
+
+	if err != nil && err != io.EOF {
+		err = b.tracker.timeoutError(err)
+		utils.RecordError(b.req, err)
+	}
+	return n, err
+}
+
+// Close closes the body and releases the request context
+func (b *timeoutBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.tracker.finish()
+	return err
+}
+
+// timeoutDialer returns a dial function reporting a *utils.UpstreamTimeoutError when it exceeds the dial time budget
+func timeoutDialer(dial dialContextFunc, timeout time.Duration) dialContextFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dialCtx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+
+		conn, err := dial(dialCtx, network, addr)
+		if err != nil && ctx.Err() == nil && dialCtx.Err() == context.DeadlineExceeded {
+			return nil, &utils.UpstreamTimeoutError{Phase: utils.TimeoutPhaseDial, Duration: timeout}
+		}
+		return conn, err
+	}
+}
@@ -0,0 +1,151 @@
+package forward
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/testutils"
+	"github.com/vulcand/oxy/utils"
+)
+
+func TestUpstreamTimeouts(t *testing.T) {
+	slowDial := &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			select {
+			case <-time.After(time.Second):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+			return (&net.Dialer{}).DialContext(ctx, network, addr)
+		},
+	}
+
+	// silent accepts connections and never answers, e.g. to TLS handshakes
+	silent, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer silent.Close()
+	go func() {
+		var conns []net.Conn
+		defer func() {
+			for _, c := range conns {
+				c.Close()
+			}
+		}()
+		for {
+			conn, err := silent.Accept()
+			if err != nil {
+				return
+			}
+			conns = append(conns, conn)
+		}
+	}()
+
+	testCases := []struct {
+		desc     string
+		target   string
+		options  []optSetter
+		handler  http.HandlerFunc
+		expected utils.TimeoutPhase
+		status   int
+	}{
+		{
+			desc:     "dial",
+			options:  []optSetter{RoundTripper(slowDial), DialTimeout(50 * time.Millisecond)},
+			expected: utils.TimeoutPhaseDial,
+			status:   http.StatusGatewayTimeout,
+		},
+		{
+			desc:     "tls handshake",
+			target:   "https://" + silent.Addr().String(),
+			options:  []optSetter{TLSHandshakeTimeout(50 * time.Millisecond)},
+			expected: utils.TimeoutPhaseTLSHandshake,
+			status:   http.StatusGatewayTimeout,
+		},
+		{
+			desc:    "response header",
+			options: []optSetter{ResponseHeaderTimeout(50 * time.Millisecond)},
+			handler: func(w http.ResponseWriter, req *http.Request) {
+				time.Sleep(200 * time.Millisecond)
+			},
+			expected: utils.TimeoutPhaseResponseHeader,
+			status:   http.StatusGatewayTimeout,
+		},
+		{
+			desc:    "idle read",
+			options: []optSetter{IdleReadTimeout(50 * time.Millisecond), ResponseHeaderTimeout(time.Second)},
+			handler: func(w http.ResponseWriter, req *http.Request) {
+				w.Write([]byte("hello"))
+				w.(http.Flusher).Flush()
+				time.Sleep(200 * time.Millisecond)
+				w.Write([]byte("world"))
+			},
+			expected: utils.TimeoutPhaseIdleRead,
+		},
+		{
+			desc:    "total",
+			options: []optSetter{TotalTimeout(150 * time.Millisecond), IdleReadTimeout(100 * time.Millisecond)},
+			handler: func(w http.ResponseWriter, req *http.Request) {
+				for i := 0; i < 5; i++ {
+					w.Write([]byte("hello"))
+					w.(http.Flusher).Flush()
+					time.Sleep(50 * time.Millisecond)
+				}
+			},
+			expected: utils.TimeoutPhaseTotal,
+		},
+		{
+			desc:    "within budgets",
+			options: []optSetter{DialTimeout(time.Second), ResponseHeaderTimeout(time.Second), IdleReadTimeout(time.Second), TotalTimeout(time.Second)},
+			handler: func(w http.ResponseWriter, req *http.Request) {
+				w.Write([]byte("hello"))
+			},
+			status: http.StatusOK,
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			target := test.target
+			if target == "" {
+				handler := test.handler
+				if handler == nil {
+					handler = func(w http.ResponseWriter, req *http.Request) {}
+				}
+				srv := httptest.NewServer(handler)
+				defer srv.Close()
+				target = srv.URL
+			}
+
+			f, err := New(test.options...)
+			require.NoError(t, err)
+
+			phases := make(chan utils.TimeoutPhase, 1)
+			proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				req, record := utils.WithErrorRecord(req)
+				defer func() {
+					phases <- utils.UpstreamTimeoutPhase(record.Err())
+				}()
+				req.URL = testutils.ParseURI(target)
+				f.ServeHTTP(w, req)
+			}))
+			defer proxy.Close()
+
+			re, _, err := testutils.Get(proxy.URL)
+			if test.status != 0 {
+				require.NoError(t, err)
+				assert.Equal(t, test.status, re.StatusCode)
+			} else {
+				// the response was interrupted while its body was copied
+				assert.Error(t, err)
+			}
+			assert.Equal(t, test.expected, <-phases)
+		})
+	}
+}
@@ -0,0 +1,105 @@
+package forward
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+
+	"github.com/vulcand/oxy/utils"
+)
+
+// UpstreamTimingHook defines a hook called with the timing breakdown of each HTTP request forwarded to an upstream server,
+// once the response body is transferred. The timing is recorded in the utils.TimingRecord of the request as well, if any.
+func UpstreamTimingHook(hook func(req *http.Request, timing utils.UpstreamTiming)) optSetter {
+	return func(f *Forwarder) error {
+		f.httpForwarder.timingHook = hook
+		return nil
+	}
+}
+
+// timingTracker measures the phases of a round trip with httptrace hooks
+type timingTracker struct {
+	mutex sync.Mutex
+
+	start        time.Time
+	dnsStart     time.Time
+	connectStart time.Time
+	tlsStart     time.Time
+	firstByte    time.Time
+
+	timing utils.UpstreamTiming
+}
+
+func newTimingTracker() *timingTracker {
+	return &timingTracker{start: time.Now()}
+}
+
+func (t *timingTracker) clientTrace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			t.mutex.Lock()
+			defer t.mutex.Unlock()
+			t.dnsStart = time.Now()
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			t.mutex.Lock()
+			defer t.mutex.Unlock()
+			if !t.dnsStart.IsZero() {
+				t.timing.DNSLookup = time.Since(t.dnsStart)
+			}
+		},
+		ConnectStart: func(string, string) {
+			t.mutex.Lock()
+			defer t.mutex.Unlock()
+			// the addresses of a host may be dialed in parallel, the connection starts with the first dial
+			if t.connectStart.IsZero() {
+				t.connectStart = time.Now()
+			}
+		},
+		ConnectDone: func(_, _ string, err error) {
+			t.mutex.Lock()
+			defer t.mutex.Unlock()
+			if err == nil && !t.connectStart.IsZero() && t.timing.Connect == 0 {
+				t.timing.Connect = time.Since(t.connectStart)
+			}
+		},
+		TLSHandshakeStart: func() {
+			t.mutex.Lock()
+			defer t.mutex.Unlock()
+			t.tlsStart = time.Now()
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			t.mutex.Lock()
+			defer t.mutex.Unlock()
+			if !t.tlsStart.IsZero() {
+				t.timing.TLSHandshake = time.Since(t.tlsStart)
+			}
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			t.mutex.Lock()
+			defer t.mutex.Unlock()
+			t.timing.Reused = info.Reused
+		},
+		GotFirstResponseByte: func() {
+			t.mutex.Lock()
+			defer t.mutex.Unlock()
+			t.firstByte = time.Now()
+			t.timing.FirstByte = t.firstByte.Sub(t.start)
+		},
+	}
+}
+
+// finish returns the timing once the response body is transferred
+func (t *timingTracker) finish() utils.UpstreamTiming {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	end := time.Now()
+	t.timing.Total = end.Sub(t.start)
+	if !t.firstByte.IsZero() {
+		t.timing.BodyTransfer = end.Sub(t.firstByte)
+	}
+	return t.timing
+}
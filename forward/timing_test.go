@@ -0,0 +1,89 @@
+package forward
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/testutils"
+	"github.com/vulcand/oxy/utils"
+)
+
+func TestUpstreamTimingHook(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+		w.(http.Flusher).Flush()
+		time.Sleep(20 * time.Millisecond)
+		w.Write([]byte(" world"))
+	}))
+	defer srv.Close()
+
+	timings := make(chan utils.UpstreamTiming, 2)
+	f, err := New(
+		RoundTripper(&http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}),
+		UpstreamTimingHook(func(req *http.Request, timing utils.UpstreamTiming) {
+			timings <- timing
+		}))
+	require.NoError(t, err)
+
+	target := strings.Replace(srv.URL, "127.0.0.1", "localhost", 1)
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(target)
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	re, body, err := testutils.Get(proxy.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, "hello world", string(body))
+
+	timing := <-timings
+	assert.False(t, timing.Reused)
+	assert.True(t, timing.DNSLookup > 0)
+	assert.True(t, timing.Connect > 0)
+	assert.True(t, timing.TLSHandshake > 0)
+	assert.True(t, timing.FirstByte > timing.TLSHandshake)
+	assert.True(t, timing.BodyTransfer >= 20*time.Millisecond)
+	assert.True(t, timing.Total >= timing.FirstByte+timing.BodyTransfer)
+
+	_, _, err = testutils.Get(proxy.URL)
+	require.NoError(t, err)
+
+	timing = <-timings
+	assert.True(t, timing.Reused)
+	assert.Equal(t, time.Duration(0), timing.DNSLookup)
+	assert.Equal(t, time.Duration(0), timing.Connect)
+	assert.Equal(t, time.Duration(0), timing.TLSHandshake)
+	assert.True(t, timing.FirstByte > 0)
+}
+
+func TestUpstreamTimingRecord(t *testing.T) {
+	srv := testutils.NewResponder("hello")
+	defer srv.Close()
+
+	f, err := New()
+	require.NoError(t, err)
+
+	var record *utils.TimingRecord
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		req, record = utils.WithTimingRecord(req)
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	re, _, err := testutils.Get(proxy.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+
+	timing, ok := record.Timing()
+	require.True(t, ok)
+	assert.True(t, timing.FirstByte > 0)
+	assert.True(t, timing.Total >= timing.FirstByte)
+}
@@ -0,0 +1,238 @@
+package forward
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/vulcand/oxy/utils"
+)
+
+// defaultTransportIdleTimeout is the idle timeout of the transports dedicated to some upstream connections,
+// when the one of the configured *http.Transport is not set
+const defaultTransportIdleTimeout = 90 * time.Second
+
+// transportIdleTimeout returns the idle timeout of the transports cloned from base
+func transportIdleTimeout(base *http.Transport) time.Duration {
+	if base == nil || base.IdleConnTimeout == 0 {
+		return defaultTransportIdleTimeout
+	}
+	return base.IdleConnTimeout
+}
+
+// upstreamDialer returns the dial function of the connections to the upstream servers: it connects to the socket
+// for unix domain socket backends, writes the PROXY protocol header of the client connection of req, if enabled
+// and req is set, and reports the dial timeout
+func (f *httpForwarder) upstreamDialer(dial dialContextFunc, socketPath string, req *http.Request) dialContextFunc {
+	if socketPath != "" {
+		dial = unixSocketDialer(dial, socketPath)
+	}
+	if f.proxyProtocolVersion != 0 && req != nil {
+		src, dst := requestAddrs(req)
+		dial = proxyProtocolDialer(f.proxyProtocolVersion, dial, src, dst)
+	}
+	if f.timeouts.dial > 0 {
+		dial = timeoutDialer(dial, f.timeouts.dial)
+	}
+	return dial
+}
+
+// upstreamKey identifies the upstream connections whose dial function or TLS settings differ from the ones
+// of the configured RoundTripper
+type upstreamKey struct {
+	// client is the client connection described by the PROXY protocol header
+	client string
+	// socketPath is the unix domain socket of the backend
+	socketPath string
+	// tls are the upstream TLS settings of the server
+	tls *utils.UpstreamTLS
+}
+
+// upstreamRoundTripper sends the requests with the protocol selected for their target, through the configured
+// RoundTripper or, for the connections of an upstreamKey, through transports cloned from it and dialing with
+// upstreamDialer. HTTP connections are thus pooled per client connection when the PROXY protocol is enabled.
+type upstreamRoundTripper struct {
+	f    *httpForwarder
+	base *http.Transport
+
+	transports *protocolTransports
+	dedicated  *transportCache
+}
+
+func newUpstreamRoundTripper(f *httpForwarder, rt http.RoundTripper) (*upstreamRoundTripper, error) {
+	base, _ := rt.(*http.Transport)
+	if f.proxyProtocolVersion != 0 && base == nil {
+		return nil, errors.New("the PROXY protocol requires the RoundTripper to be an *http.Transport")
+	}
+
+	return &upstreamRoundTripper{
+		f:          f,
+		base:       base,
+		transports: newProtocolTransports(rt, f.tlsClientConfig, f.upstreamDialer(f.dialContext, "", nil)),
+		dedicated:  newTransportCache(transportIdleTimeout(base)),
+	}, nil
+}
+
+// RoundTrip executes the round trip
+func (rt *upstreamRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	protocol := rt.f.upstreamProtocol(req.URL)
+
+	var key upstreamKey
+	if rt.f.proxyProtocolVersion != 0 {
+		src, dst := requestAddrs(req)
+		key.client = fmt.Sprintf("%v|%v", src, dst)
+	}
+	switch req.URL.Scheme {
+	case unixSocketScheme:
+		key.socketPath = req.URL.Host
+
+		outReq := new(http.Request)
+		*outReq = *req
+		outReq.URL = utils.CopyURL(req.URL)
+		outReq.URL.Scheme = "http"
+		outReq.URL.Host = rt.f.unixSocketHost
+		req = outReq
+	case "https":
+		key.tls = rt.f.upstreamTLSSettings(req, req.URL)
+	}
+
+	if key == (upstreamKey{}) {
+		return rt.transports.roundTrip(req, protocol)
+	}
+	if rt.base == nil && key.socketPath != "" {
+		return nil, errors.New("unix domain socket backends require the RoundTripper to be an *http.Transport")
+	}
+	if rt.base == nil {
+		return nil, errors.New("upstream TLS settings require the RoundTripper to be an *http.Transport")
+	}
+
+	transports, err := rt.dedicated.get(key, func() (*protocolTransports, error) {
+		return rt.newTransports(key, req)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return transports.roundTrip(req, protocol)
+}
+
+// CloseIdleConnections closes the idle connections of every transport
+func (rt *upstreamRoundTripper) CloseIdleConnections() {
+	rt.transports.CloseIdleConnections()
+	rt.dedicated.closeIdleConnections()
+}
+
+// newTransports creates the transports of the key, their idle connections are closed once they are evicted
+func (rt *upstreamRoundTripper) newTransports(key upstreamKey, req *http.Request) (*protocolTransports, error) {
+	tlsClientConfig := rt.f.tlsClientConfig
+	if key.tls != nil {
+		cfg, err := rt.f.tlsConfigs.get(key.tls)
+		if err != nil {
+			return nil, err
+		}
+		tlsClientConfig = cfg
+	}
+
+	dial := rt.f.upstreamDialer(rt.f.dialContext, key.socketPath, req)
+
+	t := rt.base.Clone()
+	t.TLSClientConfig = tlsClientConfig.Clone()
+	t.IdleConnTimeout = rt.dedicated.idleTimeout
+	t.DialContext = dial
+	if key.socketPath != "" {
+		t.Proxy = nil
+	}
+	return newProtocolTransports(t, tlsClientConfig, dial), nil
+}
+
+// transportCache holds the transports dedicated to some upstream connections, e.g. per unix domain socket.
+// The transports unused for longer than the idle timeout have no idle connection left: they are evicted.
+type transportCache struct {
+	idleTimeout time.Duration
+
+	mutex        sync.Mutex
+	transports   map[upstreamKey]*cachedTransport
+	lastEviction time.Time
+}
+
+type cachedTransport struct {
+	*protocolTransports
+	lastUsed time.Time
+}
+
+func newTransportCache(idleTimeout time.Duration) *transportCache {
+	return &transportCache{
+		idleTimeout:  idleTimeout,
+		transports:   make(map[upstreamKey]*cachedTransport),
+		lastEviction: time.Now(),
+	}
+}
+
+// get returns the transports of the key, newTransports builds them the first time
+func (c *transportCache) get(key upstreamKey, newTransports func() (*protocolTransports, error)) (*protocolTransports, error) {
+	now := time.Now()
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if now.Sub(c.lastEviction) > c.idleTimeout {
+		c.evict(now)
+	}
+
+	if t, ok := c.transports[key]; ok {
+		t.lastUsed = now
+		return t.protocolTransports, nil
+	}
+
+	t, err := newTransports()
+	if err != nil {
+		return nil, err
+	}
+	c.transports[key] = &cachedTransport{protocolTransports: t, lastUsed: now}
+	return t, nil
+}
+
+// evict closes and removes the transports unused for longer than the idle timeout
+func (c *transportCache) evict(now time.Time) {
+	for key, t := range c.transports {
+		if now.Sub(t.lastUsed) > c.idleTimeout {
+			t.CloseIdleConnections()
+			delete(c.transports, key)
+		}
+	}
+	c.lastEviction = now
+}
+
+// closeIdleConnections closes the idle connections of every cached transport
+func (c *transportCache) closeIdleConnections() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for _, t := range c.transports {
+		t.CloseIdleConnections()
+	}
+}
+
+// len returns the number of cached transports
+func (c *transportCache) len() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return len(c.transports)
+}
+
+// closeIdleConnections closes the idle connections of the round tripper, if it supports it
+func closeIdleConnections(rt http.RoundTripper) {
+	if c, ok := rt.(interface{ CloseIdleConnections() }); ok {
+		c.CloseIdleConnections()
+	}
+}
+
+// contextDialer adapts a dial function without context
+func contextDialer(dial func(network, addr string) (net.Conn, error)) dialContextFunc {
+	return func(_ context.Context, network, addr string) (net.Conn, error) {
+		return dial(network, addr)
+	}
+}
@@ -0,0 +1,284 @@
+package forward
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vulcand/oxy/utils"
+)
+
+// TunnelStats holds the number of bytes transferred through a tunnel
+type TunnelStats struct {
+	ClientToBackendBytes int64
+	BackendToClientBytes int64
+}
+
+// UrlTunnelStateListener URL tunnel state listener, it is called with StateConnected when a tunnel is established
+// and with StateDisconnected and the bytes transferred when it is closed
+type UrlTunnelStateListener func(u *url.URL, state int, stats TunnelStats)
+
+// Tunnel enables raw bidirectional tunnelling of CONNECT requests and of upgrades to protocols other than websocket,
+// e.g. SPDY. The request is forwarded to the backend and both connections are hijacked once it accepts it.
+func Tunnel(b bool) optSetter {
+	return func(f *Forwarder) error {
+		f.httpForwarder.tunnel = b
+		return nil
+	}
+}
+
+// TunnelStateListener defines a state listener for the tunnels
+func TunnelStateListener(l UrlTunnelStateListener) optSetter {
+	return func(f *Forwarder) error {
+		f.httpForwarder.tunnelStateListener = l
+		return nil
+	}
+}
+
+// IsUpgradeRequest determines if the specified HTTP request asks for a protocol upgrade
+func IsUpgradeRequest(req *http.Request) bool {
+	return req.Header.Get(Upgrade) != "" && headerContainsToken(req.Header, Connection, "upgrade")
+}
+
+// headerContainsToken reports whether the comma separated values of the header contain the token
+func headerContainsToken(h http.Header, name, token string) bool {
+	for _, value := range h[name] {
+		for _, item := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(item), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// dialUpstream opens a connection to the target for the request, TLS is negotiated for the https and wss schemes
+func (f *httpForwarder) dialUpstream(req *http.Request, target *url.URL) (net.Conn, error) {
+	ctx := req.Context()
+	secure := target.Scheme == "https" || target.Scheme == "wss"
+
+	addr := target.Host
+	if target.Port() == "" {
+		port := "80"
+		if secure {
+			port = "443"
+		}
+		addr = net.JoinHostPort(target.Hostname(), port)
+	}
+
+	var socketPath string
+	if utils.IsUnixSocketURL(target) {
+		socketPath = utils.UnixSocketPath(target)
+	}
+
+	conn, err := f.upstreamDialer(f.dialContext, socketPath, req)(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if !secure {
+		return conn, nil
+	}
+
+	cfg, err := f.upstreamTLSConfig(req, target)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	cfg = cfg.Clone()
+	if cfg == nil {
+		cfg = &tls.Config{}
+	}
+	if cfg.ServerName == "" {
+		cfg.ServerName = target.Hostname()
+	}
+	// Tunnels are only established over http/1.1
+	cfg.NextProtos = []string{"http/1.1"}
+
+	tlsConn := tls.Client(conn, cfg)
+	deadline, hasDeadline := ctx.Deadline()
+	handshakeTimeout := f.timeouts.tlsHandshake > 0 && (!hasDeadline || time.Until(deadline) > f.timeouts.tlsHandshake)
+	if handshakeTimeout {
+		deadline, hasDeadline = time.Now().Add(f.timeouts.tlsHandshake), true
+	}
+	if hasDeadline {
+		tlsConn.SetDeadline(deadline)
+	}
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() && handshakeTimeout {
+			return nil, &utils.UpstreamTimeoutError{Phase: utils.TimeoutPhaseTLSHandshake, Duration: f.timeouts.tlsHandshake}
+		}
+		return nil, err
+	}
+	tlsConn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
+
+// serveTunnel forwards CONNECT and upgrade requests, and tunnels raw bytes once the backend accepted them
+func (f *httpForwarder) serveTunnel(w http.ResponseWriter, req *http.Request, ctx *handlerContext) {
+	if f.log.GetLevel() >= log.DebugLevel {
+		logEntry := f.log.WithField("Request", utils.DumpHttpRequest(req))
+		logEntry.Debug("vulcand/oxy/forward/tunnel: begin ServeHttp on request")
+		defer logEntry.Debug("vulcand/oxy/forward/tunnel: completed ServeHttp on request")
+	}
+
+	target := req.URL
+	outReq := f.copyTunnelRequest(req)
+
+	backendConn, err := f.dialUpstream(req, target)
+	if err != nil {
+		utils.RecordError(req, err)
+		ctx.errHandler.ServeHTTP(w, req, err)
+		return
+	}
+	defer backendConn.Close()
+
+	if err = outReq.Write(backendConn); err != nil {
+		ctx.errHandler.ServeHTTP(w, req, err)
+		return
+	}
+
+	backendReader := bufio.NewReader(backendConn)
+	resp, err := http.ReadResponse(backendReader, outReq)
+	if err != nil {
+		ctx.errHandler.ServeHTTP(w, req, err)
+		return
+	}
+
+	accepted := resp.StatusCode == http.StatusSwitchingProtocols
+	if req.Method == http.MethodConnect {
+		accepted = resp.StatusCode/100 == 2
+	}
+	if !accepted {
+		defer resp.Body.Close()
+		removeHopHeaders(resp.Header)
+		f.stampResponse(resp.Header, resp.ProtoMajor, resp.ProtoMinor)
+		utils.CopyHeaders(w.Header(), resp.Header)
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+		return
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		f.log.Errorf("vulcand/oxy/forward/tunnel: %s can not be hijack", reflect.TypeOf(w))
+		ctx.errHandler.ServeHTTP(w, req, fmt.Errorf("%s can not be hijack", reflect.TypeOf(w)))
+		return
+	}
+
+	clientConn, clientBuf, err := hijacker.Hijack()
+	if err != nil {
+		f.log.Errorf("vulcand/oxy/forward/tunnel: Failed to hijack responseWriter: %v", err)
+		ctx.errHandler.ServeHTTP(w, req, err)
+		return
+	}
+	defer clientConn.Close()
+
+	upgrade := resp.Header.Get(Upgrade)
+	removeHopHeaders(resp.Header)
+	f.stampResponse(resp.Header, resp.ProtoMajor, resp.ProtoMinor)
+	if req.Method != http.MethodConnect {
+		resp.Header.Set(Connection, "Upgrade")
+		resp.Header.Set(Upgrade, upgrade)
+	}
+
+	if err = writeResponseHead(clientBuf.Writer, resp); err != nil {
+		f.log.Errorf("vulcand/oxy/forward/tunnel: Failed to forward response: %v", err)
+		return
+	}
+
+	if f.tunnelStateListener != nil {
+		f.tunnelStateListener(req.URL, StateConnected, TunnelStats{})
+	}
+
+	stats := tunnelConns(clientConn, clientBuf.Reader, backendConn, backendReader)
+
+	if f.tunnelStateListener != nil {
+		f.tunnelStateListener(req.URL, StateDisconnected, stats)
+	}
+}
+
+// copyTunnelRequest makes a copy of the request to send to the backend.
+// Hop-by-hop headers are removed except those asking for the upgrade.
+func (f *httpForwarder) copyTunnelRequest(req *http.Request) *http.Request {
+	outReq := new(http.Request)
+	*outReq = *req
+	outReq.Header = make(http.Header)
+	utils.CopyHeaders(outReq.Header, req.Header)
+	outReq.Body = nil
+	outReq.ContentLength = 0
+
+	authority := req.Host
+	if req.Method == http.MethodConnect {
+		// the request-target of CONNECT is not a path
+		outReq.RequestURI = ""
+	}
+	f.modifyRequest(outReq, req.URL)
+	utils.RemoveHeaders(outReq.Header, HopHeaders...)
+
+	// done by httputil.ReverseProxy for the other requests, a nil value means it must be omitted
+	if clientIP, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		if prior, ok := outReq.Header[XForwardedFor]; !ok || prior != nil {
+			outReq.Header.Set(XForwardedFor, strings.Join(append(prior, ipv6fix(clientIP)), ", "))
+		}
+	}
+
+	if req.Method == http.MethodConnect {
+		// the request-target of CONNECT is the authority of the tunnel
+		outReq.URL = &url.URL{Opaque: authority}
+		outReq.Host = authority
+		return outReq
+	}
+
+	outReq.Header.Set(Connection, "Upgrade")
+	outReq.Header.Set(Upgrade, req.Header.Get(Upgrade))
+	return outReq
+}
+
+// writeResponseHead writes the status line and the headers of the response
+func writeResponseHead(w *bufio.Writer, resp *http.Response) error {
+	if _, err := fmt.Fprintf(w, "HTTP/1.1 %s\r\n", resp.Status); err != nil {
+		return err
+	}
+	if err := resp.Header.Write(w); err != nil {
+		return err
+	}
+	if _, err := w.WriteString("\r\n"); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// tunnelConns copies bytes in both directions until one of them ends, then closes both connections
+func tunnelConns(clientConn net.Conn, clientReader io.Reader, backendConn net.Conn, backendReader io.Reader) TunnelStats {
+	var stats TunnelStats
+	var once sync.Once
+	closeBoth := func() {
+		clientConn.Close()
+		backendConn.Close()
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		stats.ClientToBackendBytes, _ = io.Copy(backendConn, clientReader)
+		once.Do(closeBoth)
+	}()
+	go func() {
+		defer wg.Done()
+		stats.BackendToClientBytes, _ = io.Copy(clientConn, backendReader)
+		once.Do(closeBoth)
+	}()
+	wg.Wait()
+	return stats
+}
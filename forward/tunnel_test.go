@@ -0,0 +1,144 @@
+package forward
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/testutils"
+)
+
+// newTunnelServer creates a backend accepting CONNECT requests and upgrades to the echo protocol, then echoing bytes
+func newTunnelServer(t *testing.T, check func(req *http.Request)) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		check(req)
+		if req.Method != http.MethodConnect && req.Header.Get(Upgrade) != "echo" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("upgrade required"))
+			return
+		}
+
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		require.NoError(t, err)
+		defer conn.Close()
+
+		if req.Method == http.MethodConnect {
+			rw.WriteString("HTTP/1.1 200 Connection established\r\n\r\n")
+		} else {
+			rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade, X-Backend\r\nUpgrade: echo\r\nX-Backend: secret\r\n\r\n")
+		}
+		rw.Flush()
+		io.Copy(conn, rw)
+	}))
+}
+
+func TestTunnel(t *testing.T) {
+	testCases := []struct {
+		desc    string
+		request string
+		check   func(t *testing.T, req *http.Request)
+		status  int
+	}{
+		{
+			desc:    "upgrade",
+			request: "GET /exec HTTP/1.1\r\nHost: example.com\r\nConnection: keep-alive, Upgrade, X-Secret\r\nUpgrade: echo\r\nKeep-Alive: timeout=5\r\nX-Secret: secret\r\n\r\n",
+			check: func(t *testing.T, req *http.Request) {
+				assert.Equal(t, http.MethodGet, req.Method)
+				assert.Equal(t, "/exec", req.URL.Path)
+				assert.Equal(t, "Upgrade", req.Header.Get(Connection))
+				assert.Empty(t, req.Header.Get(KeepAlive))
+				assert.Empty(t, req.Header.Get("X-Secret"))
+				assert.Equal(t, "127.0.0.1", req.Header.Get(XForwardedFor))
+			},
+			status: http.StatusSwitchingProtocols,
+		},
+		{
+			desc:    "connect",
+			request: "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n",
+			check: func(t *testing.T, req *http.Request) {
+				assert.Equal(t, http.MethodConnect, req.Method)
+				assert.Equal(t, "example.com:443", req.Host)
+			},
+			status: http.StatusOK,
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			srv := newTunnelServer(t, func(req *http.Request) {
+				test.check(t, req)
+			})
+			defer srv.Close()
+
+			stats := make(chan TunnelStats, 1)
+			f, err := New(Tunnel(true), PassHostHeader(true), TunnelStateListener(func(u *url.URL, state int, s TunnelStats) {
+				if state == StateDisconnected {
+					stats <- s
+				}
+			}))
+			require.NoError(t, err)
+
+			proxy := createProxyWithForwarder(f, srv.URL)
+			defer proxy.Close()
+
+			conn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+			require.NoError(t, err)
+			defer conn.Close()
+
+			_, err = conn.Write([]byte(test.request))
+			require.NoError(t, err)
+
+			br := bufio.NewReader(conn)
+			resp, err := http.ReadResponse(br, nil)
+			require.NoError(t, err)
+			assert.Equal(t, test.status, resp.StatusCode)
+			assert.Empty(t, resp.Header.Get("X-Backend"))
+
+			_, err = conn.Write([]byte("hello"))
+			require.NoError(t, err)
+
+			buf := make([]byte, 5)
+			_, err = io.ReadFull(br, buf)
+			require.NoError(t, err)
+			assert.Equal(t, "hello", string(buf))
+
+			conn.Close()
+			assert.Equal(t, TunnelStats{ClientToBackendBytes: 5, BackendToClientBytes: 5}, <-stats)
+		})
+	}
+}
+
+func TestTunnelUpgradeRefused(t *testing.T) {
+	srv := newTunnelServer(t, func(req *http.Request) {})
+	defer srv.Close()
+
+	f, err := New(Tunnel(true))
+	require.NoError(t, err)
+
+	proxy := createProxyWithForwarder(f, srv.URL)
+	defer proxy.Close()
+
+	re, body, err := testutils.Get(proxy.URL, testutils.Header(Connection, "Upgrade"), testutils.Header(Upgrade, "spdy/3.1"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, re.StatusCode)
+	assert.Equal(t, "upgrade required", string(body))
+}
+
+func TestTunnelUnreachableBackend(t *testing.T) {
+	f, err := New(Tunnel(true))
+	require.NoError(t, err)
+
+	proxy := createProxyWithForwarder(f, "http://localhost:63450")
+	defer proxy.Close()
+
+	re, _, err := testutils.Get(proxy.URL, testutils.Header(Connection, "Upgrade"), testutils.Header(Upgrade, "echo"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadGateway, re.StatusCode)
+}
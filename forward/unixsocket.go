@@ -0,0 +1,30 @@
+package forward
+
+import (
+	"context"
+	"net"
+)
+
+// unixSocketScheme is the scheme of the outgoing requests to unix domain sockets,
+// their URL host is the socket path until the round trip
+const unixSocketScheme = "http+unix"
+
+// defaultUnixSocketHost is the Host header sent to unix domain socket backends
+const defaultUnixSocketHost = "localhost"
+
+// UnixSocketHost defines the Host header sent to the backends listening on a unix domain socket,
+// it defaults to localhost and is ignored when PassHostHeader is set.
+// Unix domain socket backends are targeted with URLs such as unix:///run/app.sock or http+unix:///run/app.sock.
+func UnixSocketHost(host string) optSetter {
+	return func(f *Forwarder) error {
+		f.httpForwarder.unixSocketHost = host
+		return nil
+	}
+}
+
+// unixSocketDialer returns a dial function connecting to the socket whatever the address
+func unixSocketDialer(dial dialContextFunc, socketPath string) dialContextFunc {
+	return func(ctx context.Context, _, _ string) (net.Conn, error) {
+		return dial(ctx, "unix", socketPath)
+	}
+}
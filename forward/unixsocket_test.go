@@ -0,0 +1,177 @@
+package forward
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/testutils"
+)
+
+// newUnixSocketServer starts a backend listening on a unix domain socket and returns the socket path
+func newUnixSocketServer(t *testing.T, handler http.Handler) (string, func()) {
+	dir, err := ioutil.TempDir("", "oxy")
+	require.NoError(t, err)
+
+	socketPath := filepath.Join(dir, "app.sock")
+	listener, err := net.Listen("unix", socketPath)
+	require.NoError(t, err)
+
+	srv := &httptest.Server{Listener: listener, Config: &http.Server{Handler: handler}}
+	srv.Start()
+	return socketPath, func() {
+		srv.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestUnixSocketForward(t *testing.T) {
+	socketPath, closeSrv := newUnixSocketServer(t, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(w, "%s %s", req.Host, req.URL.RequestURI())
+	}))
+	defer closeSrv()
+
+	testCases := []struct {
+		desc     string
+		target   string
+		options  []optSetter
+		expected string
+	}{
+		{
+			desc:     "unix scheme",
+			target:   "unix://" + socketPath,
+			expected: "localhost /api?q=1",
+		},
+		{
+			desc:     "http+unix scheme",
+			target:   "http+unix://" + socketPath,
+			expected: "localhost /api?q=1",
+		},
+		{
+			desc:     "configured host",
+			target:   "unix://" + socketPath,
+			options:  []optSetter{UnixSocketHost("app.internal")},
+			expected: "app.internal /api?q=1",
+		},
+		{
+			desc:    "pass host header",
+			target:  "unix://" + socketPath,
+			options: []optSetter{UnixSocketHost("app.internal"), PassHostHeader(true)},
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			f, err := New(test.options...)
+			require.NoError(t, err)
+
+			proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				req.URL = testutils.ParseURI(test.target)
+				f.ServeHTTP(w, req)
+			}))
+			defer proxy.Close()
+
+			expected := test.expected
+			if expected == "" {
+				expected = testutils.ParseURI(proxy.URL).Host + " /api?q=1"
+			}
+
+			re, body, err := testutils.Get(proxy.URL + "/api?q=1")
+			require.NoError(t, err)
+			assert.Equal(t, http.StatusOK, re.StatusCode)
+			assert.Equal(t, expected, string(body))
+		})
+	}
+}
+
+func TestUnixSocketWebsocket(t *testing.T) {
+	upgrader := websocket.Upgrader{}
+	socketPath, closeSrv := newUnixSocketServer(t, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		conn, err := upgrader.Upgrade(w, req, nil)
+		require.NoError(t, err)
+		defer conn.Close()
+		conn.WriteMessage(websocket.TextMessage, []byte(req.Host+" "+req.URL.Path))
+	}))
+	defer closeSrv()
+
+	f, err := New()
+	require.NoError(t, err)
+
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI("unix://" + socketPath)
+		f.ServeHTTP(w, req)
+	}))
+	defer proxy.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial(strings.Replace(proxy.URL, "http://", "ws://", 1)+"/ws", nil)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, msg, err := conn.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, "localhost /ws", string(msg))
+}
+
+func TestUnixSocketRequiresTransport(t *testing.T) {
+	f, err := New(RoundTripper(http.NewFileTransport(http.Dir("."))))
+	require.NoError(t, err)
+
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI("unix:///run/app.sock")
+		f.ServeHTTP(w, req)
+	}))
+	defer proxy.Close()
+
+	re, _, err := testutils.Get(proxy.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusInternalServerError, re.StatusCode)
+}
+
+func TestUnixSocketTransportEviction(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	})
+	socketA, closeA := newUnixSocketServer(t, handler)
+	defer closeA()
+	socketB, closeB := newUnixSocketServer(t, handler)
+	defer closeB()
+
+	base := &http.Transport{IdleConnTimeout: 50 * time.Millisecond}
+	f, err := New(RoundTripper(base))
+	require.NoError(t, err)
+	rt, err := newUpstreamRoundTripper(f.httpForwarder, base)
+	require.NoError(t, err)
+
+	roundTrip := func(socketPath string) {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RequestURI = ""
+		req.URL = &url.URL{Scheme: unixSocketScheme, Host: socketPath, Path: "/"}
+		re, err := rt.RoundTrip(req)
+		require.NoError(t, err)
+		body, err := ioutil.ReadAll(re.Body)
+		re.Body.Close()
+		require.NoError(t, err)
+		assert.Equal(t, "hello", string(body))
+	}
+
+	roundTrip(socketA)
+	roundTrip(socketB)
+	assert.Equal(t, 2, rt.dedicated.len())
+
+	// the transport of the socket no longer used is closed and evicted
+	time.Sleep(100 * time.Millisecond)
+	roundTrip(socketB)
+	assert.Equal(t, 1, rt.dedicated.len())
+}
@@ -0,0 +1,114 @@
+package forward
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vulcand/oxy/utils"
+)
+
+// UpstreamTLSConfig defines the TLS settings of the connections to the upstream server of the target URL,
+// matched on its host and port. They apply to HTTP and websocket requests and to tunnels, on top of the TLS configuration
+// of the forwarder. The settings attached to a request with utils.WithUpstreamTLS, e.g. by roundrobin.ServerTLS, take precedence.
+func UpstreamTLSConfig(target *url.URL, u *utils.UpstreamTLS) optSetter {
+	return func(f *Forwarder) error {
+		if target == nil || u == nil {
+			return errors.New("upstream TLS target URL and settings can't be nil")
+		}
+		if _, err := u.Config(nil); err != nil {
+			return err
+		}
+		if f.httpForwarder.upstreamTLS == nil {
+			f.httpForwarder.upstreamTLS = make(map[string]*utils.UpstreamTLS)
+		}
+		f.httpForwarder.upstreamTLS[upstreamTLSTarget(target)] = u
+		return nil
+	}
+}
+
+// upstreamTLSTarget returns the host and port identifying the upstream server of a URL
+func upstreamTLSTarget(u *url.URL) string {
+	port := u.Port()
+	if port == "" {
+		port = "443"
+		if u.Scheme == "http" || u.Scheme == "ws" {
+			port = "80"
+		}
+	}
+	return net.JoinHostPort(strings.ToLower(u.Hostname()), port)
+}
+
+// upstreamTLSSettings returns the TLS settings of the request to the target, nil when the forwarder configuration applies
+func (f *httpForwarder) upstreamTLSSettings(req *http.Request, target *url.URL) *utils.UpstreamTLS {
+	if u := utils.GetUpstreamTLS(req); u != nil {
+		return u
+	}
+	return f.upstreamTLS[upstreamTLSTarget(target)]
+}
+
+// upstreamTLSConfig returns the TLS configuration of the request to the target
+func (f *httpForwarder) upstreamTLSConfig(req *http.Request, target *url.URL) (*tls.Config, error) {
+	if u := f.upstreamTLSSettings(req, target); u != nil {
+		return f.tlsConfigs.get(u)
+	}
+	return f.tlsClientConfig, nil
+}
+
+// tlsConfigCache holds the TLS configurations built from the upstream TLS settings, by settings.
+// The configurations unused for longer than the idle timeout are evicted, so are the settings of removed servers.
+type tlsConfigCache struct {
+	base        *tls.Config
+	idleTimeout time.Duration
+
+	mutex        sync.Mutex
+	configs      map[*utils.UpstreamTLS]*cachedTLSConfig
+	lastEviction time.Time
+}
+
+type cachedTLSConfig struct {
+	*tls.Config
+	lastUsed time.Time
+}
+
+func newTLSConfigCache(base *tls.Config, idleTimeout time.Duration) *tlsConfigCache {
+	return &tlsConfigCache{
+		base:         base,
+		idleTimeout:  idleTimeout,
+		configs:      make(map[*utils.UpstreamTLS]*cachedTLSConfig),
+		lastEviction: time.Now(),
+	}
+}
+
+func (c *tlsConfigCache) get(u *utils.UpstreamTLS) (*tls.Config, error) {
+	now := time.Now()
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if now.Sub(c.lastEviction) > c.idleTimeout {
+		for key, cfg := range c.configs {
+			if now.Sub(cfg.lastUsed) > c.idleTimeout {
+				delete(c.configs, key)
+			}
+		}
+		c.lastEviction = now
+	}
+
+	if cfg, ok := c.configs[u]; ok {
+		cfg.lastUsed = now
+		return cfg.Config, nil
+	}
+
+	cfg, err := u.Config(c.base)
+	if err != nil {
+		return nil, err
+	}
+	c.configs[u] = &cachedTLSConfig{Config: cfg, lastUsed: now}
+	return cfg, nil
+}
@@ -0,0 +1,232 @@
+package forward
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	gorillawebsocket "github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/testutils"
+	"github.com/vulcand/oxy/utils"
+)
+
+type tlsRequest struct {
+	serverName  string
+	clientCerts int
+}
+
+// newClientCertServer creates a TLS server requiring a client certificate, it reports the TLS state of the requests
+func newClientCertServer(handler http.Handler) (*httptest.Server, chan tlsRequest) {
+	requests := make(chan tlsRequest, 10)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requests <- tlsRequest{serverName: req.TLS.ServerName, clientCerts: len(req.TLS.PeerCertificates)}
+		handler.ServeHTTP(w, req)
+	}))
+	srv.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	srv.StartTLS()
+	return srv, requests
+}
+
+func newClientCertificate(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "client"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestUpstreamTLSConfig(t *testing.T) {
+	srv, requests := newClientCertServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer srv.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(srv.Certificate())
+	clientCert := newClientCertificate(t)
+
+	testCases := []struct {
+		desc     string
+		settings *utils.UpstreamTLS
+		expected int
+	}{
+		{
+			desc:     "no settings",
+			expected: http.StatusInternalServerError,
+		},
+		{
+			desc:     "client certificate and server name",
+			settings: &utils.UpstreamTLS{Certificates: []tls.Certificate{clientCert}, RootCAs: roots, ServerName: "example.com", MinVersion: tls.VersionTLS12},
+			expected: http.StatusOK,
+		},
+		{
+			desc:     "pinned public key",
+			settings: &utils.UpstreamTLS{Certificates: []tls.Certificate{clientCert}, RootCAs: roots, ServerName: "example.com", PinnedSPKI: []string{utils.SPKIPin(srv.Certificate())}},
+			expected: http.StatusOK,
+		},
+		{
+			desc:     "other pinned public key",
+			settings: &utils.UpstreamTLS{Certificates: []tls.Certificate{clientCert}, RootCAs: roots, ServerName: "example.com", PinnedSPKI: []string{"47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU="}},
+			expected: http.StatusInternalServerError,
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			setters := []optSetter{RoundTripper(&http.Transport{})}
+			if test.settings != nil {
+				setters = append(setters, UpstreamTLSConfig(testutils.ParseURI(srv.URL), test.settings))
+			}
+			f, err := New(setters...)
+			require.NoError(t, err)
+
+			proxy := createProxyWithForwarder(f, srv.URL)
+			defer proxy.Close()
+
+			re, _, err := testutils.Get(proxy.URL)
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, re.StatusCode)
+
+			if test.expected == http.StatusOK {
+				assert.Equal(t, tlsRequest{serverName: "example.com", clientCerts: 1}, <-requests)
+			}
+		})
+	}
+}
+
+func TestUpstreamTLSConfigFromRequest(t *testing.T) {
+	srv, requests := newClientCertServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer srv.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(srv.Certificate())
+	settings := &utils.UpstreamTLS{Certificates: []tls.Certificate{newClientCertificate(t)}, RootCAs: roots, ServerName: "example.com"}
+
+	f, err := New(RoundTripper(&http.Transport{}), UpstreamTLSConfig(testutils.ParseURI(srv.URL), &utils.UpstreamTLS{ServerName: "other.example.com"}))
+	require.NoError(t, err)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		f.ServeHTTP(w, utils.WithUpstreamTLS(req, settings))
+	})
+	defer proxy.Close()
+
+	for i := 0; i < 2; i++ {
+		re, body, err := testutils.Get(proxy.URL)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, re.StatusCode)
+		assert.Equal(t, "hello", string(body))
+		assert.Equal(t, tlsRequest{serverName: "example.com", clientCerts: 1}, <-requests)
+	}
+}
+
+func TestUpstreamTLSTransportEviction(t *testing.T) {
+	srv, requests := newClientCertServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer srv.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(srv.Certificate())
+	clientCert := newClientCertificate(t)
+
+	base := &http.Transport{IdleConnTimeout: 50 * time.Millisecond}
+	f, err := New(RoundTripper(base))
+	require.NoError(t, err)
+	rt, err := newUpstreamRoundTripper(f.httpForwarder, base)
+	require.NoError(t, err)
+
+	roundTrip := func() {
+		// the settings of a server upserted again
+		settings := &utils.UpstreamTLS{Certificates: []tls.Certificate{clientCert}, RootCAs: roots, ServerName: "example.com"}
+		req := utils.WithUpstreamTLS(httptest.NewRequest(http.MethodGet, srv.URL, nil), settings)
+		req.RequestURI = ""
+		re, err := rt.RoundTrip(req)
+		require.NoError(t, err)
+		re.Body.Close()
+		assert.Equal(t, http.StatusOK, re.StatusCode)
+		<-requests
+	}
+
+	roundTrip()
+	roundTrip()
+	assert.Equal(t, 2, rt.dedicated.len())
+
+	// the transports and configurations of the settings no longer used are evicted
+	time.Sleep(100 * time.Millisecond)
+	roundTrip()
+	assert.Equal(t, 1, rt.dedicated.len())
+	f.tlsConfigs.mutex.Lock()
+	assert.Len(t, f.tlsConfigs.configs, 1)
+	f.tlsConfigs.mutex.Unlock()
+}
+
+func TestUpstreamTLSConfigWebsocket(t *testing.T) {
+	upgrader := gorillawebsocket.Upgrader{}
+	srv, requests := newClientCertServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		conn, err := upgrader.Upgrade(w, req, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		mt, message, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		conn.WriteMessage(mt, message)
+	}))
+	defer srv.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(srv.Certificate())
+
+	f, err := New(PassHostHeader(true), RoundTripper(&http.Transport{}), UpstreamTLSConfig(testutils.ParseURI(srv.URL), &utils.UpstreamTLS{
+		Certificates: []tls.Certificate{newClientCertificate(t)},
+		RootCAs:      roots,
+		ServerName:   "example.com",
+		PinnedSPKI:   []string{utils.SPKIPin(srv.Certificate())},
+	}))
+	require.NoError(t, err)
+
+	proxy := createProxyWithForwarder(f, srv.URL)
+	defer proxy.Close()
+
+	resp, err := newWebsocketRequest(
+		withServer(proxy.Listener.Addr().String()),
+		withPath("/ws"),
+		withData("ok"),
+	).send()
+	require.NoError(t, err)
+	assert.Equal(t, "ok", resp)
+	assert.Equal(t, tlsRequest{serverName: "example.com", clientCerts: 1}, <-requests)
+}
+
+func TestUpstreamTLSConfigInvalid(t *testing.T) {
+	_, err := New(UpstreamTLSConfig(testutils.ParseURI("https://localhost"), &utils.UpstreamTLS{PinnedSPKI: []string{"invalid"}}))
+	assert.Error(t, err)
+
+	_, err = New(UpstreamTLSConfig(nil, &utils.UpstreamTLS{}))
+	assert.Error(t, err)
+}
@@ -0,0 +1,307 @@
+package forward
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/vulcand/oxy/utils"
+	"golang.org/x/net/http/httpguts"
+)
+
+// RequestValidationMode defines what the forwarder does with the requests the proxies and the servers of a chain
+// could interpret differently, e.g. to smuggle a request behind another one
+type RequestValidationMode int
+
+const (
+	// ValidationDisabled forwards the requests without validating them, it's the default
+	ValidationDisabled RequestValidationMode = iota
+	// ValidationStrict rejects the malformed requests with utils.MalformedRequestError
+	ValidationStrict
+	// ValidationLenient repairs the malformed requests having a safe fix (a Content-Length along with a chunked
+	// Transfer-Encoding, repeated identical Content-Length values, folded header values, a Host differing from
+	// the authority of an absolute-form request) and rejects the others
+	ValidationLenient
+	// ValidationLogOnly logs the malformed requests and forwards them unchanged
+	ValidationLogOnly
+)
+
+// RequestValidation enables the validation of the requests and defines how the malformed ones are handled,
+// the requests are not validated by default
+func RequestValidation(mode RequestValidationMode) optSetter {
+	return func(f *Forwarder) error {
+		if mode != ValidationDisabled && mode != ValidationStrict && mode != ValidationLenient && mode != ValidationLogOnly {
+			return fmt.Errorf("invalid request validation mode: %d", mode)
+		}
+		f.httpForwarder.validationMode = mode
+		return nil
+	}
+}
+
+// MaxRequestHeaders limits the number of header fields of the requests, there is no limit by default.
+// The limit applies even when the requests are not validated otherwise.
+func MaxRequestHeaders(max int) optSetter {
+	return func(f *Forwarder) error {
+		if max < 1 {
+			return fmt.Errorf("max request headers should be >= 1")
+		}
+		f.httpForwarder.maxRequestHeaders = max
+		return nil
+	}
+}
+
+// requestCheck returns the violation of the request, if any, and the function repairing it, nil if it can't be repaired
+type requestCheck func(f *httpForwarder, req *http.Request) (*utils.MalformedRequestError, func())
+
+// requestChecks are run in order, the repair of a violation is applied before the next check
+var requestChecks = []requestCheck{
+	checkHeaderCount,
+	checkLineFolding,
+	checkHeaderFields,
+	checkTransferEncoding,
+	checkContentLength,
+	checkHost,
+}
+
+// validateRequest checks the request before it is forwarded, according to the validation mode
+func (f *httpForwarder) validateRequest(req *http.Request) error {
+	if f.validationMode == ValidationDisabled {
+		if err, _ := checkHeaderCount(f, req); err != nil {
+			return err
+		}
+		return nil
+	}
+
+	for _, check := range requestChecks {
+		err, repair := check(f, req)
+		if err == nil {
+			continue
+		}
+
+		switch {
+		case f.validationMode == ValidationLogOnly:
+			f.log.Warnf("vulcand/oxy/forward: forwarding %s %s despite: %v", req.Method, req.URL, err)
+		case f.validationMode == ValidationLenient && repair != nil:
+			f.log.Debugf("vulcand/oxy/forward: repairing %s %s: %v", req.Method, req.URL, err)
+			repair()
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+func checkHeaderCount(f *httpForwarder, req *http.Request) (*utils.MalformedRequestError, func()) {
+	if f.maxRequestHeaders == 0 {
+		return nil, nil
+	}
+	count := 0
+	for _, values := range req.Header {
+		count += len(values)
+	}
+	if count <= f.maxRequestHeaders {
+		return nil, nil
+	}
+	return &utils.MalformedRequestError{
+		Violation: utils.ViolationTooManyHeaders,
+		Reason:    fmt.Sprintf("%d header fields exceed the limit of %d", count, f.maxRequestHeaders),
+	}, nil
+}
+
+// checkLineFolding detects the obs-fold of the header values, a proxy may replace them with spaces (RFC 7230 section 3.2.4)
+func checkLineFolding(_ *httpForwarder, req *http.Request) (*utils.MalformedRequestError, func()) {
+	for name, values := range req.Header {
+		for _, value := range values {
+			if !hasLineFolding(value) {
+				continue
+			}
+			return &utils.MalformedRequestError{
+				Violation: utils.ViolationObsoleteLineFolding,
+				Reason:    fmt.Sprintf("value of %s spans several lines", name),
+			}, func() {
+				for _, values := range req.Header {
+					for i, value := range values {
+						values[i] = unfoldLines(value)
+					}
+				}
+			}
+		}
+	}
+	return nil, nil
+}
+
+func checkHeaderFields(_ *httpForwarder, req *http.Request) (*utils.MalformedRequestError, func()) {
+	for name, values := range req.Header {
+		if !httpguts.ValidHeaderFieldName(name) {
+			return &utils.MalformedRequestError{
+				Violation: utils.ViolationInvalidHeaderName,
+				Reason:    fmt.Sprintf("invalid header name %q", name),
+			}, nil
+		}
+		for _, value := range values {
+			if !httpguts.ValidHeaderFieldValue(value) {
+				return &utils.MalformedRequestError{
+					Violation: utils.ViolationInvalidHeaderValue,
+					Reason:    fmt.Sprintf("invalid value of %s", name),
+				}, nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+// checkTransferEncoding only accepts the chunked coding, without Content-Length (RFC 7230 section 3.3.3)
+func checkTransferEncoding(_ *httpForwarder, req *http.Request) (*utils.MalformedRequestError, func()) {
+	values := append(append([]string{}, req.TransferEncoding...), req.Header["Transfer-Encoding"]...)
+
+	var codings []string
+	for _, value := range values {
+		for _, coding := range strings.Split(value, ",") {
+			if coding = strings.TrimSpace(coding); coding != "" {
+				codings = append(codings, coding)
+			}
+		}
+	}
+	if len(codings) == 0 {
+		return nil, nil
+	}
+
+	if len(codings) > 1 || !strings.EqualFold(codings[0], "chunked") {
+		return &utils.MalformedRequestError{
+			Violation: utils.ViolationUnsupportedTransferEncoding,
+			Reason:    fmt.Sprintf("unsupported transfer encoding %q", strings.Join(codings, ", ")),
+		}, nil
+	}
+
+	if _, ok := req.Header[ContentLength]; !ok {
+		return nil, nil
+	}
+	return &utils.MalformedRequestError{
+		Violation: utils.ViolationTransferEncodingConflict,
+		Reason:    "chunked transfer encoding with a Content-Length",
+	}, func() {
+		req.Header.Del(ContentLength)
+		req.ContentLength = -1
+	}
+}
+
+func checkContentLength(_ *httpForwarder, req *http.Request) (*utils.MalformedRequestError, func()) {
+	var lengths []string
+	for _, value := range req.Header[ContentLength] {
+		for _, length := range strings.Split(value, ",") {
+			lengths = append(lengths, strings.TrimSpace(length))
+		}
+	}
+	if len(lengths) == 0 {
+		return nil, nil
+	}
+
+	for _, length := range lengths {
+		if _, err := strconv.ParseUint(length, 10, 63); err != nil {
+			return &utils.MalformedRequestError{
+				Violation: utils.ViolationInvalidContentLength,
+				Reason:    fmt.Sprintf("invalid Content-Length %q", length),
+			}, nil
+		}
+	}
+	if len(lengths) == 1 {
+		return nil, nil
+	}
+
+	err := &utils.MalformedRequestError{
+		Violation: utils.ViolationDuplicateContentLength,
+		Reason:    fmt.Sprintf("several Content-Length values %q", strings.Join(lengths, ", ")),
+	}
+	for _, length := range lengths[1:] {
+		if length != lengths[0] {
+			return err, nil
+		}
+	}
+	return err, func() {
+		req.Header.Set(ContentLength, lengths[0])
+	}
+}
+
+// checkHost detects the absolute-form requests whose Host differs from the authority of their request-target,
+// a proxy must ignore their Host (RFC 7230 section 5.4). The URL of the request is not checked as it is usually
+// rewritten to the one of the backend before it is forwarded.
+func checkHost(_ *httpForwarder, req *http.Request) (*utils.MalformedRequestError, func()) {
+	if len(req.Header["Host"]) > 1 {
+		return &utils.MalformedRequestError{
+			Violation: utils.ViolationHostMismatch,
+			Reason:    "several Host headers",
+		}, nil
+	}
+
+	target, err := url.ParseRequestURI(req.RequestURI)
+	if err != nil || !target.IsAbs() || target.Host == "" {
+		return nil, nil
+	}
+
+	authority := canonicalAuthority(target.Scheme, target.Host)
+	for _, host := range append([]string{req.Host}, req.Header["Host"]...) {
+		if host == "" || canonicalAuthority(target.Scheme, host) == authority {
+			continue
+		}
+		return &utils.MalformedRequestError{
+			Violation: utils.ViolationHostMismatch,
+			Reason:    fmt.Sprintf("Host %q differs from the authority of the request-target %q", host, target.Host),
+		}, func() {
+			req.Host = target.Host
+			req.Header.Del("Host")
+		}
+	}
+	return nil, nil
+}
+
+// canonicalAuthority lowercases the host and removes the default port of the scheme
+func canonicalAuthority(scheme, host string) string {
+	host = strings.ToLower(host)
+	if h, port, err := net.SplitHostPort(host); err == nil {
+		if (port == "80" && strings.EqualFold(scheme, "http")) || (port == "443" && strings.EqualFold(scheme, "https")) {
+			host = h
+			if strings.Contains(host, ":") {
+				host = "[" + host + "]"
+			}
+		}
+	}
+	return host
+}
+
+// hasLineFolding reports whether the value has a line break followed by a space or a tab
+func hasLineFolding(value string) bool {
+	for i := 0; i < len(value)-1; i++ {
+		if value[i] == '\n' && isWhitespace(value[i+1]) {
+			return true
+		}
+	}
+	return false
+}
+
+// unfoldLines replaces the line breaks followed by spaces or tabs, and these, with a single space
+func unfoldLines(value string) string {
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		fold := 0
+		if strings.HasPrefix(value[i:], "\r\n") {
+			fold = 2
+		} else if value[i] == '\n' {
+			fold = 1
+		}
+		if fold == 0 || i+fold >= len(value) || !isWhitespace(value[i+fold]) {
+			b.WriteByte(value[i])
+			continue
+		}
+		for i += fold; i+1 < len(value) && isWhitespace(value[i+1]); i++ {
+		}
+		b.WriteByte(' ')
+	}
+	return b.String()
+}
+
+func isWhitespace(c byte) bool {
+	return c == ' ' || c == '\t'
+}
@@ -0,0 +1,276 @@
+package forward
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/testutils"
+	"github.com/vulcand/oxy/utils"
+)
+
+func TestValidateRequest(t *testing.T) {
+	testCases := []struct {
+		desc              string
+		target            string
+		headers           http.Header
+		transferEncoding  []string
+		expectedViolation utils.RequestViolation
+		repairable        bool
+		expectedHeaders   http.Header
+		expectedHost      string
+	}{
+		{
+			desc:            "valid",
+			target:          "http://example.com/",
+			headers:         http.Header{ContentLength: {"4"}, "X-Test": {"a\tb"}},
+			expectedHeaders: http.Header{ContentLength: {"4"}, "X-Test": {"a\tb"}},
+			expectedHost:    "example.com",
+		},
+		{
+			desc:              "too many headers",
+			target:            "/",
+			headers:           http.Header{"A": {"1", "2"}, "B": {"3", "4"}},
+			expectedViolation: utils.ViolationTooManyHeaders,
+		},
+		{
+			desc:              "obsolete line folding",
+			target:            "/",
+			headers:           http.Header{"X-Test": {"a\r\n \t b\n\tc"}},
+			expectedViolation: utils.ViolationObsoleteLineFolding,
+			repairable:        true,
+			expectedHeaders:   http.Header{"X-Test": {"a b c"}},
+			expectedHost:      "example.com",
+		},
+		{
+			desc:              "invalid header name",
+			target:            "/",
+			headers:           http.Header{"X Test": {"a"}},
+			expectedViolation: utils.ViolationInvalidHeaderName,
+		},
+		{
+			desc:              "invalid header value",
+			target:            "/",
+			headers:           http.Header{"X-Test": {"a\r\nX-Injected: b"}},
+			expectedViolation: utils.ViolationInvalidHeaderValue,
+		},
+		{
+			desc:              "chunked with a content length",
+			target:            "/",
+			headers:           http.Header{ContentLength: {"4"}},
+			transferEncoding:  []string{"chunked"},
+			expectedViolation: utils.ViolationTransferEncodingConflict,
+			repairable:        true,
+			expectedHeaders:   http.Header{},
+			expectedHost:      "example.com",
+		},
+		{
+			desc:              "unsupported transfer encoding",
+			target:            "/",
+			headers:           http.Header{"Transfer-Encoding": {"gzip, chunked"}},
+			expectedViolation: utils.ViolationUnsupportedTransferEncoding,
+		},
+		{
+			desc:              "identical content lengths",
+			target:            "/",
+			headers:           http.Header{ContentLength: {"4, 4", "4"}},
+			expectedViolation: utils.ViolationDuplicateContentLength,
+			repairable:        true,
+			expectedHeaders:   http.Header{ContentLength: {"4"}},
+			expectedHost:      "example.com",
+		},
+		{
+			desc:              "different content lengths",
+			target:            "/",
+			headers:           http.Header{ContentLength: {"4", "40"}},
+			expectedViolation: utils.ViolationDuplicateContentLength,
+		},
+		{
+			desc:              "invalid content length",
+			target:            "/",
+			headers:           http.Header{ContentLength: {"+4"}},
+			expectedViolation: utils.ViolationInvalidContentLength,
+		},
+		{
+			desc:              "host mismatch",
+			target:            "http://example.com/",
+			headers:           http.Header{"Host": {"internal.example.com"}},
+			expectedViolation: utils.ViolationHostMismatch,
+			repairable:        true,
+			expectedHeaders:   http.Header{},
+			expectedHost:      "example.com",
+		},
+		{
+			desc:            "host with the default port",
+			target:          "https://example.com/",
+			headers:         http.Header{"Host": {"EXAMPLE.com:443"}},
+			expectedHeaders: http.Header{"Host": {"EXAMPLE.com:443"}},
+			expectedHost:    "example.com",
+		},
+		{
+			desc:              "several hosts",
+			target:            "/",
+			headers:           http.Header{"Host": {"example.com", "internal.example.com"}},
+			expectedViolation: utils.ViolationHostMismatch,
+		},
+	}
+
+	modes := map[string]RequestValidationMode{
+		"strict":   ValidationStrict,
+		"lenient":  ValidationLenient,
+		"log only": ValidationLogOnly,
+	}
+
+	for _, test := range testCases {
+		test := test
+		for name, mode := range modes {
+			mode := mode
+			t.Run(test.desc+" "+name, func(t *testing.T) {
+				f, err := New(RequestValidation(mode), MaxRequestHeaders(3))
+				require.NoError(t, err)
+
+				req := httptest.NewRequest(http.MethodPost, test.target, strings.NewReader("body"))
+				req.Host = "example.com"
+				req.Header = http.Header{}
+				for k, v := range test.headers {
+					req.Header[k] = append([]string{}, v...)
+				}
+				req.TransferEncoding = test.transferEncoding
+
+				err = f.validateRequest(req)
+
+				switch {
+				case test.expectedViolation == "", mode == ValidationLogOnly:
+					require.NoError(t, err)
+					if test.expectedViolation == "" {
+						assert.Equal(t, test.expectedHeaders, req.Header)
+						assert.Equal(t, test.expectedHost, req.Host)
+					} else {
+						assert.Equal(t, test.headers, req.Header)
+					}
+				case mode == ValidationLenient && test.repairable:
+					require.NoError(t, err)
+					assert.Equal(t, test.expectedHeaders, req.Header)
+					assert.Equal(t, test.expectedHost, req.Host)
+				default:
+					var malformedErr *utils.MalformedRequestError
+					require.True(t, errors.As(err, &malformedErr))
+					assert.Equal(t, test.expectedViolation, malformedErr.Violation)
+				}
+			})
+		}
+	}
+
+	_, err := New(RequestValidation(RequestValidationMode(42)))
+	assert.Error(t, err)
+
+	_, err = New(MaxRequestHeaders(0))
+	assert.Error(t, err)
+}
+
+func TestMalformedRequestRejected(t *testing.T) {
+	called := false
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		called = true
+		w.Write([]byte("hello"))
+	})
+	defer srv.Close()
+
+	f, err := New(RequestValidation(ValidationStrict), MaxRequestHeaders(10))
+	require.NoError(t, err)
+
+	testCases := []struct {
+		desc               string
+		headers            http.Header
+		expectedStatusCode int
+	}{
+		{
+			desc:               "valid",
+			headers:            http.Header{"X-Test": {"a"}},
+			expectedStatusCode: http.StatusOK,
+		},
+		{
+			desc:               "duplicate content length",
+			headers:            http.Header{ContentLength: {"4", "5"}},
+			expectedStatusCode: http.StatusBadRequest,
+		},
+		{
+			desc:               "too many headers",
+			headers:            http.Header{"X-Test": strings.Split(strings.Repeat("a", 11), "")},
+			expectedStatusCode: http.StatusRequestHeaderFieldsTooLarge,
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			called = false
+
+			req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("body"))
+			req.URL = testutils.ParseURI(srv.URL)
+			req.RequestURI = ""
+			req.Header = test.headers
+
+			rec := httptest.NewRecorder()
+			f.ServeHTTP(rec, req)
+
+			assert.Equal(t, test.expectedStatusCode, rec.Code)
+			assert.Equal(t, test.expectedStatusCode == http.StatusOK, called)
+		})
+	}
+}
+
+func TestValidationDisabledByDefault(t *testing.T) {
+	var contentLength int64
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		contentLength = req.ContentLength
+		w.Write([]byte("hello"))
+	})
+	defer srv.Close()
+
+	testCases := []struct {
+		desc               string
+		options            []optSetter
+		headers            http.Header
+		expectedStatusCode int
+	}{
+		{
+			desc:               "repeated identical content length",
+			headers:            http.Header{ContentLength: {"4", "4"}},
+			expectedStatusCode: http.StatusOK,
+		},
+		{
+			desc:               "header limit without validation",
+			options:            []optSetter{MaxRequestHeaders(2)},
+			headers:            http.Header{"X-Test": {"a", "b", "c"}},
+			expectedStatusCode: http.StatusRequestHeaderFieldsTooLarge,
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			contentLength = 0
+
+			f, err := New(test.options...)
+			require.NoError(t, err)
+
+			req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("body"))
+			req.URL = testutils.ParseURI(srv.URL)
+			req.RequestURI = ""
+			req.Header = test.headers
+
+			rec := httptest.NewRecorder()
+			f.ServeHTTP(rec, req)
+
+			assert.Equal(t, test.expectedStatusCode, rec.Code)
+			if test.expectedStatusCode == http.StatusOK {
+				assert.EqualValues(t, 4, contentLength)
+			}
+		})
+	}
+}
@@ -0,0 +1,190 @@
+package forward
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// WebsocketDirection is the direction of a message proxied on a websocket connection
+type WebsocketDirection int
+
+// Websocket message directions
+const (
+	WebsocketClientToBackend WebsocketDirection = iota
+	WebsocketBackendToClient
+)
+
+func (d WebsocketDirection) String() string {
+	if d == WebsocketBackendToClient {
+		return "backend to client"
+	}
+	return "client to backend"
+}
+
+// ErrWebsocketDropMessage is returned by a WebsocketInterceptor to drop the message instead of forwarding it
+var ErrWebsocketDropMessage = errors.New("websocket message dropped")
+
+// WebsocketMessage is a data message proxied on a websocket connection
+type WebsocketMessage struct {
+	Direction WebsocketDirection
+	// Type is websocket.TextMessage or websocket.BinaryMessage
+	Type    int
+	Payload []byte
+}
+
+// WebsocketInterceptor intercepts the data messages proxied on websocket connections.
+// Control messages (ping, pong and close) are not intercepted. The messages are buffered before they are intercepted,
+// see WebsocketMaxMessageSize to bound their size.
+type WebsocketInterceptor interface {
+	// InterceptMessage is called with each data message before it is forwarded, the message can be rewritten in place.
+	// It is called concurrently for both directions of a connection, and for all the connections.
+	// The type of a rewritten message must remain websocket.TextMessage or websocket.BinaryMessage.
+	// It returns nil to forward the message, ErrWebsocketDropMessage to drop it, or a *websocket.CloseError
+	// to close both sides of the connection with the given code. Any other error closes the connection
+	// with websocket.CloseInternalServerErr.
+	InterceptMessage(req *http.Request, msg *WebsocketMessage) error
+}
+
+// WebsocketInterceptorFunc is an adapter allowing the use of ordinary functions as WebsocketInterceptor
+type WebsocketInterceptorFunc func(req *http.Request, msg *WebsocketMessage) error
+
+// InterceptMessage calls f(req, msg).
+func (f WebsocketInterceptorFunc) InterceptMessage(req *http.Request, msg *WebsocketMessage) error {
+	return f(req, msg)
+}
+
+// WebsocketMessageInterceptor defines the interceptor of the messages proxied on websocket connections
+func WebsocketMessageInterceptor(i WebsocketInterceptor) optSetter {
+	return func(f *Forwarder) error {
+		f.httpForwarder.websocketInterceptor = i
+		return nil
+	}
+}
+
+// WebsocketMaxMessageSize limits the size of the messages proxied on websocket connections, there is no limit by default.
+// A peer sending a larger message gets a close frame with websocket.CloseMessageTooBig, which is relayed to the other peer.
+func WebsocketMaxMessageSize(n int64) optSetter {
+	return func(f *Forwarder) error {
+		if n < 1 {
+			return fmt.Errorf("websocket max message size should be >= 1")
+		}
+		f.httpForwarder.websocketMaxMessageSize = n
+		return nil
+	}
+}
+
+// closeTooBig relays to dst the close frame sent by the websocket connection whose read limit was exceeded
+func closeTooBig(dst *websocket.Conn, err error) {
+	if err == websocket.ErrReadLimit {
+		m := websocket.FormatCloseMessage(websocket.CloseMessageTooBig, "")
+		dst.WriteControl(websocket.CloseMessage, m, time.Now().Add(time.Second))
+	}
+}
+
+// maxCloseTextLength is the maximum length of a close frame reason: 125 bytes of payload minus the status code
+const maxCloseTextLength = 123
+
+// interceptorCloseError converts an error returned by a WebsocketInterceptor into the close error sent to both sides
+func interceptorCloseError(err error) *websocket.CloseError {
+	closeErr, ok := err.(*websocket.CloseError)
+	if !ok {
+		return &websocket.CloseError{Code: websocket.CloseInternalServerErr}
+	}
+	if len(closeErr.Text) > maxCloseTextLength {
+		return &websocket.CloseError{Code: closeErr.Code, Text: closeErr.Text[:maxCloseTextLength]}
+	}
+	return closeErr
+}
+
+// WebsocketIdleTimeout closes the websocket connections on which no message was proxied for the duration
+func WebsocketIdleTimeout(d time.Duration) optSetter {
+	return func(f *Forwarder) error {
+		f.httpForwarder.websocketIdleTimeout = d
+		return nil
+	}
+}
+
+// WebsocketMaxLifetime closes the websocket connections open for longer than the duration,
+// e.g. to rebalance them during deployments
+func WebsocketMaxLifetime(d time.Duration) optSetter {
+	return func(f *Forwarder) error {
+		f.httpForwarder.websocketMaxLifetime = d
+		return nil
+	}
+}
+
+// WebsocketPingInterval makes the forwarder send its own pings to both the client and the backend at the interval.
+// A connection is closed when one of its peers does not answer with a pong before the next ping.
+func WebsocketPingInterval(d time.Duration) optSetter {
+	return func(f *Forwarder) error {
+		f.httpForwarder.websocketPingInterval = d
+		return nil
+	}
+}
+
+// websocketPingPayload identifies the pings sent by the forwarder, the matching pongs are not forwarded
+const websocketPingPayload = "vulcand/oxy/forward/websocket: ping"
+
+// WebsocketCloseReason tells why a proxied websocket connection was closed
+type WebsocketCloseReason int
+
+// Websocket close reasons
+const (
+	// WebsocketClosedByClient the client closed the connection or the connection to the client failed
+	WebsocketClosedByClient WebsocketCloseReason = iota
+	// WebsocketClosedByBackend the backend closed the connection or the connection to the backend failed
+	WebsocketClosedByBackend
+	// WebsocketClosedBackendRejected the backend rejected the websocket handshake
+	WebsocketClosedBackendRejected
+	// WebsocketClosedByInterceptor the WebsocketInterceptor closed the connection
+	WebsocketClosedByInterceptor
+	// WebsocketClosedIdleTimeout no message was proxied for the duration of WebsocketIdleTimeout
+	WebsocketClosedIdleTimeout
+	// WebsocketClosedMaxLifetime the connection was open for longer than WebsocketMaxLifetime
+	WebsocketClosedMaxLifetime
+	// WebsocketClosedPingTimeout a peer did not answer the pings sent every WebsocketPingInterval
+	WebsocketClosedPingTimeout
+)
+
+func (r WebsocketCloseReason) String() string {
+	switch r {
+	case WebsocketClosedByClient:
+		return "closed by client"
+	case WebsocketClosedByBackend:
+		return "closed by backend"
+	case WebsocketClosedBackendRejected:
+		return "backend rejected handshake"
+	case WebsocketClosedByInterceptor:
+		return "closed by interceptor"
+	case WebsocketClosedIdleTimeout:
+		return "idle timeout"
+	case WebsocketClosedMaxLifetime:
+		return "max lifetime"
+	case WebsocketClosedPingTimeout:
+		return "ping timeout"
+	}
+	return fmt.Sprintf("unknown close reason %d", int(r))
+}
+
+type websocketCloseReasonKey struct{}
+
+// WebsocketCloseReasonFromRequest returns why the websocket connection was closed
+// from the request given to the WebsocketConnectionClosedHook
+func WebsocketCloseReasonFromRequest(req *http.Request) (WebsocketCloseReason, bool) {
+	reason, ok := req.Context().Value(websocketCloseReasonKey{}).(WebsocketCloseReason)
+	return reason, ok
+}
+
+func withWebsocketCloseReason(req *http.Request, reason WebsocketCloseReason) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), websocketCloseReasonKey{}, reason))
+}
+
+// interceptedCloseError is reported when a WebsocketInterceptor closes the connection
+type interceptedCloseError struct {
+	*websocket.CloseError
+}
@@ -0,0 +1,321 @@
+package forward
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	gorillawebsocket "github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWebsocketMessageInterceptor(t *testing.T) {
+	backendErr := make(chan error, 1)
+	upgrader := gorillawebsocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			mt, message, err := conn.ReadMessage()
+			if err != nil {
+				backendErr <- err
+				return
+			}
+			if err = conn.WriteMessage(mt, append([]byte("echo "), message...)); err != nil {
+				return
+			}
+		}
+	}))
+	defer srv.Close()
+
+	var directions []WebsocketDirection
+	interceptor := WebsocketInterceptorFunc(func(req *http.Request, msg *WebsocketMessage) error {
+		directions = append(directions, msg.Direction)
+		switch {
+		case len(msg.Payload) > 16:
+			return &gorillawebsocket.CloseError{Code: gorillawebsocket.CloseMessageTooBig, Text: "message too big"}
+		case bytes.Contains(msg.Payload, []byte("secret")):
+			return ErrWebsocketDropMessage
+		case msg.Direction == WebsocketBackendToClient:
+			msg.Payload = bytes.ToUpper(msg.Payload)
+		}
+		return nil
+	})
+
+	f, err := New(WebsocketMessageInterceptor(interceptor))
+	require.NoError(t, err)
+
+	proxy := createProxyWithForwarder(f, srv.URL)
+	defer proxy.Close()
+
+	conn, _, err := gorillawebsocket.DefaultDialer.Dial("ws://"+proxy.Listener.Addr().String()+"/ws", nil)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// dropped messages never reach the backend
+	require.NoError(t, conn.WriteMessage(gorillawebsocket.TextMessage, []byte("secret")))
+	require.NoError(t, conn.WriteMessage(gorillawebsocket.TextMessage, []byte("hello")))
+
+	_, msg, err := conn.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, "ECHO HELLO", string(msg))
+	assert.Equal(t, []WebsocketDirection{WebsocketClientToBackend, WebsocketClientToBackend, WebsocketBackendToClient}, directions)
+
+	require.NoError(t, conn.WriteMessage(gorillawebsocket.BinaryMessage, []byte(strings.Repeat("a", 17))))
+
+	_, _, err = conn.ReadMessage()
+	closeErr, ok := err.(*gorillawebsocket.CloseError)
+	require.True(t, ok, "%v", err)
+	assert.Equal(t, gorillawebsocket.CloseMessageTooBig, closeErr.Code)
+	assert.Equal(t, "message too big", closeErr.Text)
+
+	closeErr, ok = (<-backendErr).(*gorillawebsocket.CloseError)
+	require.True(t, ok)
+	assert.Equal(t, gorillawebsocket.CloseMessageTooBig, closeErr.Code)
+}
+
+func TestWebsocketMaxMessageSize(t *testing.T) {
+	testCases := []struct {
+		desc        string
+		interceptor WebsocketInterceptor
+	}{
+		{
+			desc: "streamed",
+		},
+		{
+			desc: "intercepted",
+			interceptor: WebsocketInterceptorFunc(func(req *http.Request, msg *WebsocketMessage) error {
+				return nil
+			}),
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			srv, backendErr := newWebsocketEchoServer()
+			defer srv.Close()
+
+			options := []optSetter{WebsocketMaxMessageSize(8)}
+			if test.interceptor != nil {
+				options = append(options, WebsocketMessageInterceptor(test.interceptor))
+			}
+			f, err := New(options...)
+			require.NoError(t, err)
+
+			proxy := createProxyWithForwarder(f, srv.URL)
+			defer proxy.Close()
+
+			conn, _, err := gorillawebsocket.DefaultDialer.Dial("ws://"+proxy.Listener.Addr().String()+"/ws", nil)
+			require.NoError(t, err)
+			defer conn.Close()
+
+			require.NoError(t, conn.WriteMessage(gorillawebsocket.TextMessage, []byte("hello")))
+			_, msg, err := conn.ReadMessage()
+			require.NoError(t, err)
+			assert.Equal(t, "hello", string(msg))
+
+			require.NoError(t, conn.WriteMessage(gorillawebsocket.BinaryMessage, []byte(strings.Repeat("a", 9))))
+			_, _, err = conn.ReadMessage()
+			closeErr, ok := err.(*gorillawebsocket.CloseError)
+			require.True(t, ok, "%v", err)
+			assert.Equal(t, gorillawebsocket.CloseMessageTooBig, closeErr.Code)
+
+			closeErr, ok = (<-backendErr).(*gorillawebsocket.CloseError)
+			require.True(t, ok)
+			assert.Equal(t, gorillawebsocket.CloseMessageTooBig, closeErr.Code)
+		})
+	}
+
+	_, err := New(WebsocketMaxMessageSize(0))
+	assert.Error(t, err)
+}
+
+func TestWebsocketInterceptorInvalidType(t *testing.T) {
+	srv, backendErr := newWebsocketEchoServer()
+	defer srv.Close()
+
+	f, err := New(WebsocketMessageInterceptor(WebsocketInterceptorFunc(func(req *http.Request, msg *WebsocketMessage) error {
+		msg.Type = gorillawebsocket.PingMessage
+		return nil
+	})))
+	require.NoError(t, err)
+
+	proxy := createProxyWithForwarder(f, srv.URL)
+	defer proxy.Close()
+
+	conn, _, err := gorillawebsocket.DefaultDialer.Dial("ws://"+proxy.Listener.Addr().String()+"/ws", nil)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	require.NoError(t, conn.WriteMessage(gorillawebsocket.TextMessage, []byte("hello")))
+	_, _, err = conn.ReadMessage()
+	closeErr, ok := err.(*gorillawebsocket.CloseError)
+	require.True(t, ok, "%v", err)
+	assert.Equal(t, gorillawebsocket.CloseInternalServerErr, closeErr.Code)
+
+	closeErr, ok = (<-backendErr).(*gorillawebsocket.CloseError)
+	require.True(t, ok)
+	assert.Equal(t, gorillawebsocket.CloseInternalServerErr, closeErr.Code)
+}
+
+func TestInterceptorCloseError(t *testing.T) {
+	closeErr := interceptorCloseError(assert.AnError)
+	assert.Equal(t, gorillawebsocket.CloseInternalServerErr, closeErr.Code)
+	assert.Empty(t, closeErr.Text)
+
+	closeErr = interceptorCloseError(&gorillawebsocket.CloseError{Code: gorillawebsocket.ClosePolicyViolation, Text: strings.Repeat("a", 200)})
+	assert.Equal(t, gorillawebsocket.ClosePolicyViolation, closeErr.Code)
+	assert.Len(t, closeErr.Text, maxCloseTextLength)
+}
+
+// newWebsocketEchoServer creates a websocket server echoing messages, the error ending each connection is sent to the channel
+func newWebsocketEchoServer() (*httptest.Server, chan error) {
+	backendErr := make(chan error, 1)
+	upgrader := gorillawebsocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			mt, message, err := conn.ReadMessage()
+			if err != nil {
+				backendErr <- err
+				return
+			}
+			if err = conn.WriteMessage(mt, message); err != nil {
+				return
+			}
+		}
+	}))
+	return srv, backendErr
+}
+
+func TestWebsocketProxyClose(t *testing.T) {
+	testCases := []struct {
+		desc           string
+		opts           []optSetter
+		activity       time.Duration
+		readPings      bool
+		expectedReason WebsocketCloseReason
+	}{
+		{
+			desc:           "idle timeout",
+			opts:           []optSetter{WebsocketIdleTimeout(100 * time.Millisecond)},
+			readPings:      true,
+			expectedReason: WebsocketClosedIdleTimeout,
+		},
+		{
+			desc:           "max lifetime",
+			opts:           []optSetter{WebsocketIdleTimeout(100 * time.Millisecond), WebsocketMaxLifetime(300 * time.Millisecond)},
+			activity:       20 * time.Millisecond,
+			readPings:      true,
+			expectedReason: WebsocketClosedMaxLifetime,
+		},
+		{
+			desc:           "ping timeout",
+			opts:           []optSetter{WebsocketPingInterval(50 * time.Millisecond)},
+			expectedReason: WebsocketClosedPingTimeout,
+		},
+		{
+			desc:           "pings answered",
+			opts:           []optSetter{WebsocketPingInterval(20 * time.Millisecond), WebsocketMaxLifetime(200 * time.Millisecond)},
+			readPings:      true,
+			expectedReason: WebsocketClosedMaxLifetime,
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			srv, backendErr := newWebsocketEchoServer()
+			defer srv.Close()
+
+			reasons := make(chan WebsocketCloseReason, 1)
+			opts := append(test.opts, WebsocketConnectionClosedHook(func(req *http.Request, conn net.Conn) {
+				reason, _ := WebsocketCloseReasonFromRequest(req)
+				reasons <- reason
+			}))
+			f, err := New(opts...)
+			require.NoError(t, err)
+
+			proxy := createProxyWithForwarder(f, srv.URL)
+			defer proxy.Close()
+
+			conn, _, err := gorillawebsocket.DefaultDialer.Dial("ws://"+proxy.Listener.Addr().String()+"/ws", nil)
+			require.NoError(t, err)
+			defer conn.Close()
+
+			start := time.Now()
+			if test.activity > 0 {
+				go func() {
+					for {
+						time.Sleep(test.activity)
+						if conn.WriteMessage(gorillawebsocket.TextMessage, []byte("ping")) != nil {
+							return
+						}
+					}
+				}()
+			}
+
+			if !test.readPings {
+				// pings are only answered while reading
+				reason := <-reasons
+				assert.Equal(t, test.expectedReason, reason)
+				return
+			}
+
+			for {
+				_, _, err = conn.ReadMessage()
+				if err != nil {
+					break
+				}
+			}
+			closeErr, ok := err.(*gorillawebsocket.CloseError)
+			require.True(t, ok, "%v", err)
+			assert.Equal(t, gorillawebsocket.CloseGoingAway, closeErr.Code)
+			assert.Equal(t, test.expectedReason.String(), closeErr.Text)
+			assert.Equal(t, test.expectedReason, <-reasons)
+			assert.True(t, time.Since(start) < 2*time.Second)
+
+			closeErr, ok = (<-backendErr).(*gorillawebsocket.CloseError)
+			require.True(t, ok)
+			assert.Equal(t, gorillawebsocket.CloseGoingAway, closeErr.Code)
+		})
+	}
+}
+
+func TestWebsocketCloseReasonClient(t *testing.T) {
+	srv, _ := newWebsocketEchoServer()
+	defer srv.Close()
+
+	reasons := make(chan WebsocketCloseReason, 1)
+	f, err := New(WebsocketConnectionClosedHook(func(req *http.Request, conn net.Conn) {
+		reason, ok := WebsocketCloseReasonFromRequest(req)
+		assert.True(t, ok)
+		reasons <- reason
+	}))
+	require.NoError(t, err)
+
+	proxy := createProxyWithForwarder(f, srv.URL)
+	defer proxy.Close()
+
+	conn, _, err := gorillawebsocket.DefaultDialer.Dial("ws://"+proxy.Listener.Addr().String()+"/ws", nil)
+	require.NoError(t, err)
+	conn.WriteMessage(gorillawebsocket.CloseMessage, gorillawebsocket.FormatCloseMessage(gorillawebsocket.CloseNormalClosure, ""))
+	conn.Close()
+
+	assert.Equal(t, WebsocketClosedByClient, <-reasons)
+}
@@ -21,6 +21,8 @@ type RTMetrics struct {
 	statusCodesLock sync.RWMutex
 	histogram       *RollingHDRHistogram
 	histogramLock   sync.RWMutex
+	timeouts        map[string]*RollingCounter
+	timeoutsLock    sync.RWMutex
 
 	newCounter NewCounterFn
 	newHist    NewRollingHistogramFn
@@ -67,6 +69,7 @@ func NewRTMetrics(settings ...rrOptSetter) (*RTMetrics, error) {
 	m := &RTMetrics{
 		statusCodes:     make(map[int]*RollingCounter),
 		statusCodesLock: sync.RWMutex{},
+		timeouts:        make(map[string]*RollingCounter),
 	}
 	for _, s := range settings {
 		if err := s(m); err != nil {
@@ -128,6 +131,13 @@ func (m *RTMetrics) Export() *RTMetrics {
 		exportStatusCodes[code] = rollingCounter.Clone()
 	}
 	export.statusCodes = exportStatusCodes
+	m.timeoutsLock.RLock()
+	exportTimeouts := map[string]*RollingCounter{}
+	for phase, rollingCounter := range m.timeouts {
+		exportTimeouts[phase] = rollingCounter.Clone()
+	}
+	m.timeoutsLock.RUnlock()
+	export.timeouts = exportTimeouts
 	if m.histogram != nil {
 		export.histogram = m.histogram.Export()
 	}
@@ -203,6 +213,19 @@ func (m *RTMetrics) Append(other *RTMetrics) error {
 		}
 	}
 
+	m.timeoutsLock.Lock()
+	defer m.timeoutsLock.Unlock()
+	for phase, c := range copied.timeouts {
+		o, ok := m.timeouts[phase]
+		if ok {
+			if err := o.Append(c); err != nil {
+				return err
+			}
+		} else {
+			m.timeouts[phase] = c.Clone()
+		}
+	}
+
 	return m.histogram.Append(copied.histogram)
 }
 
@@ -216,6 +239,45 @@ func (m *RTMetrics) Record(code int, duration time.Duration) {
 	m.recordLatency(duration)
 }
 
+// RecordTimeout records an upstream timeout of the phase, e.g. "dial", for a request recorded with Record
+func (m *RTMetrics) RecordTimeout(phase string) {
+	m.timeoutsLock.Lock()
+	defer m.timeoutsLock.Unlock()
+
+	c, ok := m.timeouts[phase]
+	if !ok {
+		var err error
+		if c, err = m.newCounter(); err != nil {
+			return
+		}
+		m.timeouts[phase] = c
+	}
+	c.Inc(1)
+}
+
+// TimeoutCount returns the count of upstream timeouts of the phase, of all the phases for an empty phase
+func (m *RTMetrics) TimeoutCount(phase string) int64 {
+	m.timeoutsLock.RLock()
+	defer m.timeoutsLock.RUnlock()
+
+	var count int64
+	for p, c := range m.timeouts {
+		if phase == "" || p == phase {
+			count += c.Count()
+		}
+	}
+	return count
+}
+
+// TimeoutRatio calculates the amount of upstream timeouts of the phase, of all the phases for an empty phase,
+// that occurred in the given time window compared to the total requests count.
+func (m *RTMetrics) TimeoutRatio(phase string) float64 {
+	if m.total.Count() == 0 {
+		return 0
+	}
+	return float64(m.TimeoutCount(phase)) / float64(m.total.Count())
+}
+
 // TotalCount returns total count of processed requests collected.
 func (m *RTMetrics) TotalCount() int64 {
 	return m.total.Count()
@@ -256,6 +318,9 @@ func (m *RTMetrics) Reset() {
 	m.total.Reset()
 	m.netErrors.Reset()
 	m.statusCodes = make(map[int]*RollingCounter)
+	m.timeoutsLock.Lock()
+	defer m.timeoutsLock.Unlock()
+	m.timeouts = make(map[string]*RollingCounter)
 }
 
 func (m *RTMetrics) recordLatency(d time.Duration) error {
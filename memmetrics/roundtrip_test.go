@@ -74,6 +74,40 @@ func TestAppend(t *testing.T) {
 	assert.EqualValues(t, 3, h.LatencyAtQuantile(100)/time.Second)
 }
 
+func TestTimeouts(t *testing.T) {
+	clock := testutils.GetClock()
+
+	rr, err := NewRTMetrics(RTClock(clock))
+	require.NoError(t, err)
+
+	rr.Record(200, time.Second)
+	rr.Record(504, time.Second)
+	rr.RecordTimeout("dial")
+	rr.Record(504, time.Second)
+	rr.RecordTimeout("response_header")
+	rr.Record(504, time.Second)
+	rr.RecordTimeout("dial")
+
+	assert.EqualValues(t, 2, rr.TimeoutCount("dial"))
+	assert.EqualValues(t, 3, rr.TimeoutCount(""))
+	assert.Equal(t, 0.5, rr.TimeoutRatio("dial"))
+	assert.Equal(t, 0.25, rr.TimeoutRatio("response_header"))
+	assert.Equal(t, float64(0), rr.TimeoutRatio("idle_read"))
+
+	rr2, err := NewRTMetrics(RTClock(clock))
+	require.NoError(t, err)
+	rr2.Record(504, time.Second)
+	rr2.RecordTimeout("dial")
+
+	require.NoError(t, rr2.Append(rr))
+	assert.EqualValues(t, 3, rr2.TimeoutCount("dial"))
+	assert.EqualValues(t, 3, rr.Export().TimeoutCount("dial")+rr.Export().TimeoutCount("response_header"))
+
+	rr.Reset()
+	assert.EqualValues(t, 0, rr.TimeoutCount(""))
+	assert.Equal(t, float64(0), rr.TimeoutRatio(""))
+}
+
 func TestConcurrentRecords(t *testing.T) {
 	// This test asserts a race condition which requires parallelism
 	runtime.GOMAXPROCS(100)
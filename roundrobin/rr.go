@@ -22,6 +22,20 @@ func Weight(w int) ServerOption {
 	}
 }
 
+// ServerTLS is an optional functional argument that sets the TLS settings of the connections to the server,
+// they are attached to the requests forwarded to it with utils.WithUpstreamTLS
+func ServerTLS(u *utils.UpstreamTLS) ServerOption {
+	return func(s *server) error {
+		if u != nil {
+			if _, err := u.Config(nil); err != nil {
+				return err
+			}
+		}
+		s.tls = u
+		return nil
+	}
+}
+
 // ErrorHandler is a functional argument that sets error handler of the server
 func ErrorHandler(h utils.ErrorHandler) LBOption {
 	return func(s *RoundRobin) error {
@@ -139,12 +153,17 @@ func (r *RoundRobin) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		r.log.WithFields(log.Fields{"Request": utils.DumpHttpRequest(req), "ForwardURL": newReq.URL}).Debugf("vulcand/oxy/roundrobin/rr: Forwarding this request to URL")
 	}
 
+	outReq := &newReq
+	if u := r.serverTLS(newReq.URL); u != nil {
+		outReq = utils.WithUpstreamTLS(outReq, u)
+	}
+
 	// Emit event to a listener if one exists
 	if r.requestRewriteListener != nil {
-		r.requestRewriteListener(req, &newReq)
+		r.requestRewriteListener(req, outReq)
 	}
 
-	r.next.ServeHTTP(w, &newReq)
+	r.next.ServeHTTP(w, outReq)
 }
 
 // NextServer gets the next server
@@ -191,6 +210,17 @@ func (r *RoundRobin) nextServer() (*server, error) {
 	}
 }
 
+// serverTLS returns the TLS settings of the server, nil if none
+func (r *RoundRobin) serverTLS(u *url.URL) *utils.UpstreamTLS {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if s, _ := r.findServerByURL(u); s != nil {
+		return s.tls
+	}
+	return nil
+}
+
 // RemoveServer remove a server
 func (r *RoundRobin) RemoveServer(u *url.URL) error {
 	r.mutex.Lock()
@@ -229,6 +259,7 @@ func (r *RoundRobin) ServerWeight(u *url.URL) (int, bool) {
 }
 
 // UpsertServer In case if server is already present in the load balancer, returns error
+// Servers listening on a unix domain socket are added with URLs such as unix:///run/app.sock or http+unix:///run/app.sock
 func (r *RoundRobin) UpsertServer(u *url.URL, options ...ServerOption) error {
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
@@ -324,6 +355,8 @@ type server struct {
 	url *url.URL
 	// Relative weight for the enpoint to other enpoints in the load balancer
 	weight int
+	// TLS settings of the connections to the server
+	tls *utils.UpstreamTLS
 }
 
 var defaultWeight = 1
@@ -338,6 +371,10 @@ func SetDefaultWeight(weight int) error {
 }
 
 func sameURL(a, b *url.URL) bool {
+	if utils.IsUnixSocketURL(a) || utils.IsUnixSocketURL(b) {
+		// unix:// and http+unix:// URLs target the same server when they share the socket path
+		return utils.IsUnixSocketURL(a) && utils.IsUnixSocketURL(b) && utils.UnixSocketPath(a) == utils.UnixSocketPath(b)
+	}
 	return a.Path == b.Path && a.Host == b.Host && a.Scheme == b.Scheme
 }
 
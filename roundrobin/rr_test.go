@@ -3,6 +3,7 @@ package roundrobin
 import (
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -140,6 +141,23 @@ func TestUpsertSame(t *testing.T) {
 	assert.Equal(t, []string{"a", "a", "a"}, seq(t, proxy.URL, 3))
 }
 
+func TestUpsertSameUnixSocket(t *testing.T) {
+	fwd, err := forward.New()
+	require.NoError(t, err)
+
+	lb, err := New(fwd)
+	require.NoError(t, err)
+
+	require.NoError(t, lb.UpsertServer(testutils.ParseURI("unix:///run/a.sock")))
+	require.NoError(t, lb.UpsertServer(testutils.ParseURI("http+unix:///run/a.sock")))
+	require.NoError(t, lb.UpsertServer(testutils.ParseURI("unix:///run/b.sock")))
+
+	assert.Len(t, lb.Servers(), 2)
+
+	require.NoError(t, lb.RemoveServer(testutils.ParseURI("unix:///run/./a.sock")))
+	assert.Equal(t, []*url.URL{testutils.ParseURI("unix:///run/b.sock")}, lb.Servers())
+}
+
 func TestUpsertWeight(t *testing.T) {
 	a := testutils.NewResponder("a")
 	defer a.Close()
@@ -237,3 +255,26 @@ func seq(t *testing.T, url string, repeat int) []string {
 	}
 	return out
 }
+
+func TestServerTLS(t *testing.T) {
+	settings := &utils.UpstreamTLS{ServerName: "a.example.com"}
+
+	var got []*utils.UpstreamTLS
+	lb, err := New(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		got = append(got, utils.GetUpstreamTLS(req))
+	}))
+	require.NoError(t, err)
+
+	require.NoError(t, lb.UpsertServer(testutils.ParseURI("https://a"), ServerTLS(settings)))
+	require.NoError(t, lb.UpsertServer(testutils.ParseURI("https://b")))
+	assert.Error(t, lb.UpsertServer(testutils.ParseURI("https://c"), ServerTLS(&utils.UpstreamTLS{PinnedSPKI: []string{"invalid"}})))
+
+	proxy := httptest.NewServer(lb)
+	defer proxy.Close()
+
+	for i := 0; i < 2; i++ {
+		_, _, err := testutils.Get(proxy.URL)
+		require.NoError(t, err)
+	}
+	assert.Equal(t, []*utils.UpstreamTLS{settings, nil}, got)
+}
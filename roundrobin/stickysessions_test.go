@@ -3,8 +3,11 @@ package roundrobin
 import (
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -411,3 +414,62 @@ func TestBadCookieVal(t *testing.T) {
 	require.NoError(t, err)
 	assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
 }
+
+func TestStickyCookieUnixSocket(t *testing.T) {
+	var closers []func()
+	defer func() {
+		for _, c := range closers {
+			c()
+		}
+	}()
+
+	var servers []string
+	for _, name := range []string{"a", "b"} {
+		name := name
+		dir, err := ioutil.TempDir("", "oxy")
+		require.NoError(t, err)
+		socketPath := filepath.Join(dir, name+".sock")
+
+		listener, err := net.Listen("unix", socketPath)
+		require.NoError(t, err)
+		srv := &httptest.Server{Listener: listener, Config: &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.Write([]byte(name))
+		})}}
+		srv.Start()
+		closers = append(closers, srv.Close, func() { os.RemoveAll(dir) })
+		servers = append(servers, "unix://"+socketPath)
+	}
+
+	fwd, err := forward.New()
+	require.NoError(t, err)
+
+	lb, err := New(fwd, EnableStickySession(NewStickySession("test")))
+	require.NoError(t, err)
+
+	for _, s := range servers {
+		require.NoError(t, lb.UpsertServer(testutils.ParseURI(s)))
+	}
+
+	proxy := httptest.NewServer(lb)
+	defer proxy.Close()
+
+	resp, err := http.Get(proxy.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	cookie := resp.Cookies()[0]
+	assert.Equal(t, servers[0], cookie.Value)
+
+	for i := 0; i < 3; i++ {
+		req, err := http.NewRequest(http.MethodGet, proxy.URL, nil)
+		require.NoError(t, err)
+		req.AddCookie(&http.Cookie{Name: "test", Value: "http+unix://" + testutils.ParseURI(servers[1]).Path})
+
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		require.NoError(t, err)
+		assert.Equal(t, "b", string(body))
+	}
+}
@@ -86,9 +86,11 @@ func Logger(l *log.Logger) Option {
 func (t *Tracer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	start := time.Now()
 	pw := utils.NewProxyWriterWithLogger(w, t.log)
+	req, timing := utils.WithTimingRecord(req)
 	t.next.ServeHTTP(pw, req)
 
 	l := t.newRecord(req, pw, time.Since(start))
+	l.Upstream = newUpstream(timing)
 	if err := json.NewEncoder(t.writer).Encode(l); err != nil {
 		t.log.Errorf("Failed to marshal request: %v", err)
 	}
@@ -112,6 +114,25 @@ func (t *Tracer) newRecord(req *http.Request, pw *utils.ProxyWriter, diff time.D
 	}
 }
 
+func newUpstream(record *utils.TimingRecord) *Upstream {
+	timing, ok := record.Timing()
+	if !ok {
+		return nil
+	}
+	return &Upstream{
+		DNSLookup:    milliseconds(timing.DNSLookup),
+		Connect:      milliseconds(timing.Connect),
+		TLSHandshake: milliseconds(timing.TLSHandshake),
+		Reused:       timing.Reused,
+		FirstByte:    milliseconds(timing.FirstByte),
+		BodyTransfer: milliseconds(timing.BodyTransfer),
+	}
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
 func newTLS(req *http.Request) *TLS {
 	if req.TLS == nil {
 		return nil
@@ -143,8 +164,9 @@ func captureHeaders(in http.Header, headers []string) http.Header {
 
 // Record represents a structured request and response record
 type Record struct {
-	Request  Request  `json:"request"`
-	Response Response `json:"response"`
+	Request  Request   `json:"request"`
+	Response Response  `json:"response"`
+	Upstream *Upstream `json:"upstream,omitempty"` // Upstream - optional timing of the request to the upstream server, will be recorded if forwarded
 }
 
 // Request contains information about an HTTP request
@@ -164,6 +186,16 @@ type Response struct {
 	BodyBytes int64       `json:"body_bytes"`        // BodyBytes - size of response body in bytes
 }
 
+// Upstream contains the timing breakdown of the request to the upstream server, in milliseconds
+type Upstream struct {
+	DNSLookup    float64 `json:"dns_lookup"`    // DNSLookup - host name resolution time
+	Connect      float64 `json:"connect"`       // Connect - connection time
+	TLSHandshake float64 `json:"tls_handshake"` // TLSHandshake - TLS handshake time
+	Reused       bool    `json:"reused"`        // Reused tells if the connection was reused from a previous request
+	FirstByte    float64 `json:"first_byte"`    // FirstByte - time to the first response byte
+	BodyTransfer float64 `json:"body_transfer"` // BodyTransfer - response body transfer time
+}
+
 // TLS contains information about this TLS connection
 type TLS struct {
 	Version     string `json:"version"`      // Version - TLS version
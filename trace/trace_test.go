@@ -13,6 +13,7 @@ import (
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/forward"
 	"github.com/vulcand/oxy/testutils"
 	"github.com/vulcand/oxy/utils"
 )
@@ -109,3 +110,34 @@ func TestTraceTLS(t *testing.T) {
 	require.NoError(t, json.Unmarshal(trace.Bytes(), &r))
 	assert.Equal(t, versionToString(state.Version), r.Request.TLS.Version)
 }
+
+func TestTraceUpstreamTiming(t *testing.T) {
+	backend := testutils.NewResponder("hello")
+	defer backend.Close()
+
+	fwd, err := forward.New()
+	require.NoError(t, err)
+
+	trace := &bytes.Buffer{}
+	tr, err := New(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(backend.URL)
+		fwd.ServeHTTP(w, req)
+	}), trace)
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(tr)
+	defer srv.Close()
+
+	re, _, err := testutils.Get(srv.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+
+	var r *Record
+	require.NoError(t, json.Unmarshal(trace.Bytes(), &r))
+
+	require.NotNil(t, r.Upstream)
+	assert.False(t, r.Upstream.Reused)
+	assert.NotEqual(t, float64(0), r.Upstream.Connect)
+	assert.NotEqual(t, float64(0), r.Upstream.FirstByte)
+	assert.Equal(t, float64(0), r.Upstream.TLSHandshake)
+}
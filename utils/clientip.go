@@ -0,0 +1,105 @@
+package utils
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+const xForwardedFor = "X-Forwarded-For"
+
+// TrustedProxies is a list of proxy networks trusted to set forwarding headers such as X-Forwarded-For
+type TrustedProxies struct {
+	nets []*net.IPNet
+}
+
+// NewTrustedProxies creates a new TrustedProxies from CIDRs or single IP addresses, e.g. "10.0.0.0/8" or "192.168.1.1"
+func NewTrustedProxies(cidrs ...string) (*TrustedProxies, error) {
+	t := &TrustedProxies{}
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy address: %q", cidr)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			t.nets = append(t.nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy network: %v", err)
+		}
+		t.nets = append(t.nets, ipNet)
+	}
+	return t, nil
+}
+
+// Contains reports whether the IP address belongs to a trusted proxy network
+func (t *TrustedProxies) Contains(ip net.IP) bool {
+	if t == nil || ip == nil {
+		return false
+	}
+	for _, n := range t.nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsTrusted reports whether the request was received directly from a trusted proxy
+func (t *TrustedProxies) IsTrusted(req *http.Request) bool {
+	return t.Contains(net.ParseIP(remoteIP(req)))
+}
+
+// ClientIP returns the real client IP of the request.
+// It is the peer address when the peer is not a trusted proxy, otherwise the right-most
+// X-Forwarded-For hop that is not a trusted proxy.
+func (t *TrustedProxies) ClientIP(req *http.Request) string {
+	clientIP := remoteIP(req)
+	if !t.Contains(net.ParseIP(clientIP)) {
+		return clientIP
+	}
+
+	hops := strings.Split(strings.Join(req.Header[xForwardedFor], ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		ip := net.ParseIP(hop)
+		if ip == nil {
+			// a malformed hop can't be trusted to tell where the request comes from
+			break
+		}
+		clientIP = hop
+		if !t.Contains(ip) {
+			break
+		}
+	}
+	return clientIP
+}
+
+// NewTrustedClientIPExtractor creates a SourceExtractor using the real client IP resolved by the trusted proxies
+func NewTrustedClientIPExtractor(t *TrustedProxies) SourceExtractor {
+	return ExtractorFunc(func(req *http.Request) (string, int64, error) {
+		clientIP := t.ClientIP(req)
+		if clientIP == "" {
+			return "", 0, fmt.Errorf("failed to parse client IP: %v", req.RemoteAddr)
+		}
+		return clientIP, 1, nil
+	})
+}
+
+// remoteIP returns the IP of the request peer without port nor IPv6 zone
+func remoteIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	return strings.Split(host, "%")[0]
+}
@@ -0,0 +1,111 @@
+package utils
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewTrustedProxies(t *testing.T) {
+	trusted, err := NewTrustedProxies("10.0.0.0/8", "192.168.1.1", "2001:db8::/32", "::1")
+	require.NoError(t, err)
+
+	testCases := []struct {
+		ip       string
+		expected bool
+	}{
+		{ip: "10.1.2.3", expected: true},
+		{ip: "192.168.1.1", expected: true},
+		{ip: "192.168.1.2", expected: false},
+		{ip: "2001:db8::5", expected: true},
+		{ip: "::1", expected: true},
+		{ip: "::2", expected: false},
+		{ip: "8.8.8.8", expected: false},
+	}
+
+	for _, test := range testCases {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+		req.RemoteAddr = "[" + test.ip + "]:1234"
+		assert.Equal(t, test.expected, trusted.IsTrusted(req), test.ip)
+	}
+
+	_, err = NewTrustedProxies("10.0.0.0/33")
+	assert.Error(t, err)
+	_, err = NewTrustedProxies("localhost")
+	assert.Error(t, err)
+}
+
+func TestTrustedProxiesClientIP(t *testing.T) {
+	trusted, err := NewTrustedProxies("10.0.0.0/8")
+	require.NoError(t, err)
+
+	testCases := []struct {
+		desc       string
+		trusted    *TrustedProxies
+		remoteAddr string
+		xff        []string
+		expected   string
+	}{
+		{
+			desc:       "untrusted peer",
+			trusted:    trusted,
+			remoteAddr: "1.2.3.4:1234",
+			xff:        []string{"5.6.7.8"},
+			expected:   "1.2.3.4",
+		},
+		{
+			desc:       "trusted peer without header",
+			trusted:    trusted,
+			remoteAddr: "10.0.0.1:1234",
+			expected:   "10.0.0.1",
+		},
+		{
+			desc:       "right-most untrusted hop",
+			trusted:    trusted,
+			remoteAddr: "10.0.0.1:1234",
+			xff:        []string{"6.6.6.6, 1.2.3.4", "10.0.0.2"},
+			expected:   "1.2.3.4",
+		},
+		{
+			desc:       "all hops trusted",
+			trusted:    trusted,
+			remoteAddr: "10.0.0.1:1234",
+			xff:        []string{"10.0.0.3, 10.0.0.2"},
+			expected:   "10.0.0.3",
+		},
+		{
+			desc:       "malformed hop",
+			trusted:    trusted,
+			remoteAddr: "10.0.0.1:1234",
+			xff:        []string{"1.2.3.4, garbage, 10.0.0.2"},
+			expected:   "10.0.0.2",
+		},
+		{
+			desc:       "nil trusted proxies",
+			remoteAddr: "[fe80::1%eth0]:1234",
+			xff:        []string{"1.2.3.4"},
+			expected:   "fe80::1",
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+			req.RemoteAddr = test.remoteAddr
+			req.Header["X-Forwarded-For"] = test.xff
+
+			assert.Equal(t, test.expected, test.trusted.ClientIP(req))
+
+			token, amount, err := NewTrustedClientIPExtractor(test.trusted).Extract(req)
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, token)
+			assert.EqualValues(t, 1, amount)
+		})
+	}
+}
@@ -0,0 +1,183 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// TimeoutPhase is the phase of a request to an upstream server that exceeded its time budget
+type TimeoutPhase string
+
+// Upstream request phases
+const (
+	// TimeoutPhaseDial connecting to the upstream server, name resolution included
+	TimeoutPhaseDial TimeoutPhase = "dial"
+	// TimeoutPhaseTLSHandshake negotiating TLS with the upstream server
+	TimeoutPhaseTLSHandshake TimeoutPhase = "tls_handshake"
+	// TimeoutPhaseResponseHeader waiting for the response headers once the request is written
+	TimeoutPhaseResponseHeader TimeoutPhase = "response_header"
+	// TimeoutPhaseIdleRead waiting for the next bytes of the response body
+	TimeoutPhaseIdleRead TimeoutPhase = "idle_read"
+	// TimeoutPhaseTotal the whole request, from the dial to the end of the response body
+	TimeoutPhaseTotal TimeoutPhase = "total"
+)
+
+// UpstreamTimeoutError is returned when a phase of a request to an upstream server exceeded its time budget.
+// It is a net.Error reporting a timeout.
+type UpstreamTimeoutError struct {
+	Phase    TimeoutPhase
+	Duration time.Duration
+}
+
+func (e *UpstreamTimeoutError) Error() string {
+	return fmt.Sprintf("upstream %s timeout after %v", e.Phase, e.Duration)
+}
+
+// Timeout is always true, it implements net.Error
+func (e *UpstreamTimeoutError) Timeout() bool {
+	return true
+}
+
+// Temporary is always true, it implements net.Error
+func (e *UpstreamTimeoutError) Temporary() bool {
+	return true
+}
+
+// UpstreamTimeoutPhase returns the phase of an UpstreamTimeoutError, or an empty phase for other errors
+func UpstreamTimeoutPhase(err error) TimeoutPhase {
+	var timeoutErr *UpstreamTimeoutError
+	if errors.As(err, &timeoutErr) {
+		return timeoutErr.Phase
+	}
+	return ""
+}
+
+type errorRecordKey struct{}
+
+// ErrorRecord holds the last error that occurred while forwarding a request to an upstream server,
+// it lets middlewares tell why the response they observe failed.
+type ErrorRecord struct {
+	parent *ErrorRecord
+
+	mutex sync.Mutex
+	err   error
+}
+
+// Err returns the recorded error, nil if none was recorded
+func (r *ErrorRecord) Err() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.err
+}
+
+func (r *ErrorRecord) record(err error) {
+	for ; r != nil; r = r.parent {
+		r.mutex.Lock()
+		r.err = err
+		r.mutex.Unlock()
+	}
+}
+
+// WithErrorRecord returns a shallow copy of the request whose forwarding errors are recorded in the returned ErrorRecord,
+// the errors are recorded in the records of the enclosing middlewares as well
+func WithErrorRecord(req *http.Request) (*http.Request, *ErrorRecord) {
+	parent, _ := req.Context().Value(errorRecordKey{}).(*ErrorRecord)
+	record := &ErrorRecord{parent: parent}
+	return req.WithContext(context.WithValue(req.Context(), errorRecordKey{}, record)), record
+}
+
+// RecordError records the error in the ErrorRecord of the request, if any
+func RecordError(req *http.Request, err error) {
+	if record, ok := req.Context().Value(errorRecordKey{}).(*ErrorRecord); ok {
+		record.record(err)
+	}
+}
+
+// BadRequestError is returned when a request can't be forwarded as it is malformed, it is answered with 400
+type BadRequestError struct {
+	Reason string
+}
+
+func (e *BadRequestError) Error() string {
+	return fmt.Sprintf("bad request: %s", e.Reason)
+}
+
+// ProxyAuthError is returned when a client of a forward proxy is not authorized, it is answered with 407
+type ProxyAuthError struct {
+	// Challenge is the value of the Proxy-Authenticate header of the response, e.g. `Basic realm="proxy"`
+	Challenge string
+	// Err is the reason of the failure, if any
+	Err error
+}
+
+func (e *ProxyAuthError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("proxy authentication required: %v", e.Err)
+	}
+	return "proxy authentication required"
+}
+
+// Unwrap returns the reason of the failure
+func (e *ProxyAuthError) Unwrap() error {
+	return e.Err
+}
+
+// DestinationNotAllowedError is returned when a forward proxy is not allowed to reach a destination, it is answered with 403
+type DestinationNotAllowedError struct {
+	// Destination is the host:port the client asked for
+	Destination string
+}
+
+func (e *DestinationNotAllowedError) Error() string {
+	return fmt.Sprintf("destination %s is not allowed", e.Destination)
+}
+
+// LoopDetectedError is returned when a request loops through a proxy, or went through too many proxies,
+// it is answered with 508
+type LoopDetectedError struct {
+	Reason string
+}
+
+func (e *LoopDetectedError) Error() string {
+	return fmt.Sprintf("loop detected: %s", e.Reason)
+}
+
+// RequestViolation is a flaw of a request which the proxies and the servers of a chain could interpret differently
+type RequestViolation string
+
+// Request violations
+const (
+	// ViolationTransferEncodingConflict the request has both a Transfer-Encoding and a Content-Length
+	ViolationTransferEncodingConflict RequestViolation = "transfer_encoding_conflict"
+	// ViolationUnsupportedTransferEncoding the Transfer-Encoding of the request is not a single chunked coding
+	ViolationUnsupportedTransferEncoding RequestViolation = "unsupported_transfer_encoding"
+	// ViolationDuplicateContentLength the request has several Content-Length values
+	ViolationDuplicateContentLength RequestViolation = "duplicate_content_length"
+	// ViolationInvalidContentLength the Content-Length of the request is not a non-negative integer
+	ViolationInvalidContentLength RequestViolation = "invalid_content_length"
+	// ViolationInvalidHeaderName a header name of the request is not a token
+	ViolationInvalidHeaderName RequestViolation = "invalid_header_name"
+	// ViolationInvalidHeaderValue a header value of the request has control characters
+	ViolationInvalidHeaderValue RequestViolation = "invalid_header_value"
+	// ViolationObsoleteLineFolding a header value of the request spans several lines
+	ViolationObsoleteLineFolding RequestViolation = "obsolete_line_folding"
+	// ViolationHostMismatch the Host of an absolute-form request differs from the authority of its URI, or is repeated
+	ViolationHostMismatch RequestViolation = "host_mismatch"
+	// ViolationTooManyHeaders the request has more header fields than allowed
+	ViolationTooManyHeaders RequestViolation = "too_many_headers"
+)
+
+// MalformedRequestError is returned when a request is rejected by the validation of a forwarder,
+// it is answered with 431 for ViolationTooManyHeaders and 400 otherwise
+type MalformedRequestError struct {
+	Violation RequestViolation
+	Reason    string
+}
+
+func (e *MalformedRequestError) Error() string {
+	return fmt.Sprintf("malformed request (%s): %s", e.Violation, e.Reason)
+}
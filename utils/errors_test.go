@@ -0,0 +1,46 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUpstreamTimeoutError(t *testing.T) {
+	err := &UpstreamTimeoutError{Phase: TimeoutPhaseDial, Duration: time.Second}
+
+	assert.Equal(t, "upstream dial timeout after 1s", err.Error())
+	assert.Equal(t, TimeoutPhaseDial, UpstreamTimeoutPhase(err))
+	assert.Equal(t, TimeoutPhaseDial, UpstreamTimeoutPhase(fmt.Errorf("wrapped: %w", err)))
+	assert.Equal(t, TimeoutPhase(""), UpstreamTimeoutPhase(errors.New("other")))
+	assert.Equal(t, TimeoutPhase(""), UpstreamTimeoutPhase(nil))
+
+	w := httptest.NewRecorder()
+	DefaultHandler.ServeHTTP(w, nil, err)
+	assert.Equal(t, http.StatusGatewayTimeout, w.Code)
+}
+
+func TestErrorRecord(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+
+	// no record
+	RecordError(req, errors.New("ignored"))
+
+	outer, outerRecord := WithErrorRecord(req)
+	inner, innerRecord := WithErrorRecord(outer)
+
+	err := errors.New("boom")
+	RecordError(inner, err)
+	assert.Equal(t, err, innerRecord.Err())
+	assert.Equal(t, err, outerRecord.Err())
+
+	other := errors.New("other")
+	RecordError(outer, other)
+	assert.Equal(t, err, innerRecord.Err())
+	assert.Equal(t, other, outerRecord.Err())
+}
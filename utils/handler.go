@@ -2,6 +2,7 @@ package utils
 
 import (
 	"context"
+	"errors"
 	"io"
 	"net"
 	"net/http"
@@ -29,7 +30,29 @@ type StdHandler struct{}
 func (e *StdHandler) ServeHTTP(w http.ResponseWriter, req *http.Request, err error) {
 	statusCode := http.StatusInternalServerError
 
-	if e, ok := err.(net.Error); ok {
+	var badRequestErr *BadRequestError
+	var proxyAuthErr *ProxyAuthError
+	var destinationErr *DestinationNotAllowedError
+	var loopErr *LoopDetectedError
+	var malformedErr *MalformedRequestError
+
+	if errors.As(err, &malformedErr) {
+		statusCode = http.StatusBadRequest
+		if malformedErr.Violation == ViolationTooManyHeaders {
+			statusCode = http.StatusRequestHeaderFieldsTooLarge
+		}
+	} else if errors.As(err, &badRequestErr) {
+		statusCode = http.StatusBadRequest
+	} else if errors.As(err, &proxyAuthErr) {
+		statusCode = http.StatusProxyAuthRequired
+		if proxyAuthErr.Challenge != "" {
+			w.Header().Set("Proxy-Authenticate", proxyAuthErr.Challenge)
+		}
+	} else if errors.As(err, &destinationErr) {
+		statusCode = http.StatusForbidden
+	} else if errors.As(err, &loopErr) {
+		statusCode = http.StatusLoopDetected
+	} else if e, ok := err.(net.Error); ok {
 		if e.Timeout() {
 			statusCode = http.StatusGatewayTimeout
 		} else {
@@ -2,6 +2,7 @@ package utils
 
 import (
 	"bytes"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"strings"
@@ -30,3 +31,59 @@ func TestDefaultHandlerErrors(t *testing.T) {
 
 	assert.Equal(t, http.StatusBadGateway, w.Code)
 }
+
+func TestDefaultHandlerTypedErrors(t *testing.T) {
+	testCases := []struct {
+		desc            string
+		err             error
+		expectedCode    int
+		expectedHeaders http.Header
+	}{
+		{
+			desc:         "bad request",
+			err:          &BadRequestError{Reason: "missing host"},
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			desc:            "proxy authentication",
+			err:             &ProxyAuthError{Challenge: `Basic realm="proxy"`},
+			expectedCode:    http.StatusProxyAuthRequired,
+			expectedHeaders: http.Header{"Proxy-Authenticate": {`Basic realm="proxy"`}},
+		},
+		{
+			desc:         "destination not allowed",
+			err:          fmt.Errorf("egress: %w", &DestinationNotAllowedError{Destination: "example.com:443"}),
+			expectedCode: http.StatusForbidden,
+		},
+		{
+			desc:         "loop detected",
+			err:          &LoopDetectedError{Reason: "too many hops"},
+			expectedCode: http.StatusLoopDetected,
+		},
+		{
+			desc:         "malformed request",
+			err:          &MalformedRequestError{Violation: ViolationTransferEncodingConflict, Reason: "chunked with a Content-Length"},
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			desc:         "too many headers",
+			err:          &MalformedRequestError{Violation: ViolationTooManyHeaders, Reason: "101 header fields"},
+			expectedCode: http.StatusRequestHeaderFieldsTooLarge,
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			w := httptest.NewRecorder()
+			DefaultHandler.ServeHTTP(w, nil, test.err)
+
+			assert.Equal(t, test.expectedCode, w.Code)
+			for name := range test.expectedHeaders {
+				assert.Equal(t, test.expectedHeaders.Get(name), w.Header().Get(name))
+			}
+		})
+	}
+}
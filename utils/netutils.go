@@ -7,7 +7,9 @@ import (
 	"net"
 	"net/http"
 	"net/url"
+	"path"
 	"reflect"
+	"strings"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -165,6 +167,20 @@ func CopyURL(i *url.URL) *url.URL {
 	return &out
 }
 
+// IsUnixSocketURL reports whether the URL targets a unix domain socket,
+// e.g. unix:///run/app.sock or http+unix:///run/app.sock
+func IsUnixSocketURL(u *url.URL) bool {
+	return u != nil && (u.Scheme == "unix" || u.Scheme == "http+unix")
+}
+
+// UnixSocketPath returns the path of the unix domain socket targeted by the URL
+func UnixSocketPath(u *url.URL) string {
+	if u.Opaque != "" {
+		return path.Clean(u.Opaque)
+	}
+	return path.Clean(u.Path)
+}
+
 // CopyHeaders copies http headers from source to destination, it
 // does not overide, but adds multiple headers
 func CopyHeaders(dst http.Header, src http.Header) {
@@ -189,3 +205,26 @@ func RemoveHeaders(headers http.Header, names ...string) {
 		headers.Del(h)
 	}
 }
+
+// RemoveConnectionHeaders removes the hop-by-hop headers listed in the Connection header (RFC 7230 section 6.1),
+// except those with the given names. The Connection header itself is left untouched.
+func RemoveConnectionHeaders(headers http.Header, keep ...string) {
+	for _, value := range headers["Connection"] {
+		for _, name := range strings.Split(value, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			if name == "" || name == "Connection" || containsHeaderName(keep, name) {
+				continue
+			}
+			headers.Del(name)
+		}
+	}
+}
+
+func containsHeaderName(names []string, name string) bool {
+	for _, n := range names {
+		if http.CanonicalHeaderKey(n) == name {
+			return true
+		}
+	}
+	return false
+}
@@ -28,6 +28,34 @@ func TestCopyUrl(t *testing.T) {
 	assert.NotEqual(t, urlA, urlB)
 }
 
+func TestUnixSocketURL(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		url      string
+		isSocket bool
+		path     string
+	}{
+		{desc: "unix", url: "unix:///run/app.sock", isSocket: true, path: "/run/app.sock"},
+		{desc: "http+unix", url: "http+unix:///run/app.sock", isSocket: true, path: "/run/app.sock"},
+		{desc: "relative", url: "unix:run/../app.sock", isSocket: true, path: "app.sock"},
+		{desc: "http", url: "http://localhost:8080/run/app.sock"},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			u, err := url.Parse(test.url)
+			assert.NoError(t, err)
+			assert.Equal(t, test.isSocket, IsUnixSocketURL(u))
+			if test.isSocket {
+				assert.Equal(t, test.path, UnixSocketPath(u))
+			}
+		})
+	}
+}
+
 // Make sure copy headers is not shallow and copies all headers
 func TestCopyHeaders(t *testing.T) {
 	source, destination := make(http.Header), make(http.Header)
@@ -67,6 +95,24 @@ func TestRemoveHeaders(t *testing.T) {
 	assert.Equal(t, "d", source.Get("c"))
 }
 
+func TestRemoveConnectionHeaders(t *testing.T) {
+	source := make(http.Header)
+	source.Add("Connection", "keep-alive, x-secret")
+	source.Add("Connection", " upgrade ,,")
+	source.Add("Keep-Alive", "timeout=5")
+	source.Add("X-Secret", "b")
+	source.Add("Upgrade", "websocket")
+	source.Add("c", "d")
+
+	RemoveConnectionHeaders(source, "upgrade")
+
+	assert.Equal(t, "", source.Get("Keep-Alive"))
+	assert.Equal(t, "", source.Get("X-Secret"))
+	assert.Equal(t, "websocket", source.Get("Upgrade"))
+	assert.Equal(t, "d", source.Get("c"))
+	assert.Len(t, source["Connection"], 2)
+}
+
 func BenchmarkCopyHeaders(b *testing.B) {
 	dstHeaders := make([]http.Header, 0, b.N)
 	sourceHeaders := make([]http.Header, 0, b.N)
@@ -0,0 +1,63 @@
+package utils
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// UpstreamTiming is the breakdown of the time spent forwarding a request to an upstream server
+type UpstreamTiming struct {
+	// DNSLookup resolving the host name of the upstream server, zero for reused connections and IP addresses
+	DNSLookup time.Duration
+	// Connect establishing the connection to the upstream server, zero for reused connections
+	Connect time.Duration
+	// TLSHandshake negotiating TLS with the upstream server, zero for reused connections
+	TLSHandshake time.Duration
+	// Reused tells if the request was sent on a connection reused from a previous request
+	Reused bool
+	// FirstByte from the start of the round trip to the first byte of the response
+	FirstByte time.Duration
+	// BodyTransfer from the first byte of the response to the end of its body
+	BodyTransfer time.Duration
+	// Total from the start of the round trip to the end of the response body
+	Total time.Duration
+}
+
+type timingRecordKey struct{}
+
+// TimingRecord holds the timing of the last request forwarded to an upstream server,
+// it lets middlewares tell the time spent in the proxy from the time spent in the upstream server.
+type TimingRecord struct {
+	mutex    sync.Mutex
+	timing   UpstreamTiming
+	recorded bool
+}
+
+// Timing returns the recorded timing, false if none was recorded
+func (r *TimingRecord) Timing() (UpstreamTiming, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.timing, r.recorded
+}
+
+// Record records the timing
+func (r *TimingRecord) Record(timing UpstreamTiming) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.timing = timing
+	r.recorded = true
+}
+
+// WithTimingRecord returns a shallow copy of the request whose upstream timing is recorded in the returned TimingRecord
+func WithTimingRecord(req *http.Request) (*http.Request, *TimingRecord) {
+	record := &TimingRecord{}
+	return req.WithContext(context.WithValue(req.Context(), timingRecordKey{}, record)), record
+}
+
+// GetTimingRecord returns the TimingRecord of the request, nil if none
+func GetTimingRecord(req *http.Request) *TimingRecord {
+	record, _ := req.Context().Value(timingRecordKey{}).(*TimingRecord)
+	return record
+}
@@ -0,0 +1,121 @@
+package utils
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// UpstreamTLS defines the TLS settings of the connections to an upstream server,
+// the zero values keep the settings of the forwarder
+type UpstreamTLS struct {
+	// Certificates are the client certificates presented to the upstream server
+	Certificates []tls.Certificate
+	// RootCAs are the certificate authorities verifying the upstream server
+	RootCAs *x509.CertPool
+	// ServerName overrides the name sent with SNI and verified against the certificate of the upstream server
+	ServerName string
+	// MinVersion is the minimum TLS version, e.g. tls.VersionTLS12
+	MinVersion uint16
+	// PinnedSPKI are the base64 encoded SHA-256 digests of the public keys (SubjectPublicKeyInfo) accepted
+	// in the certificate chain of the upstream server, any public key is accepted when empty
+	PinnedSPKI []string
+}
+
+// Config returns a copy of base with the settings applied
+func (u *UpstreamTLS) Config(base *tls.Config) (*tls.Config, error) {
+	cfg := base.Clone()
+	if cfg == nil {
+		cfg = &tls.Config{}
+	}
+
+	if len(u.Certificates) > 0 {
+		cfg.Certificates = u.Certificates
+	}
+	if u.RootCAs != nil {
+		cfg.RootCAs = u.RootCAs
+	}
+	if u.ServerName != "" {
+		cfg.ServerName = u.ServerName
+	}
+	if u.MinVersion != 0 {
+		cfg.MinVersion = u.MinVersion
+	}
+
+	if len(u.PinnedSPKI) > 0 {
+		pins := make(map[[sha256.Size]byte]bool, len(u.PinnedSPKI))
+		for _, pin := range u.PinnedSPKI {
+			digest, err := base64.StdEncoding.DecodeString(pin)
+			if err != nil || len(digest) != sha256.Size {
+				return nil, fmt.Errorf("invalid SPKI pin %q: expected a base64 encoded SHA-256 digest", pin)
+			}
+			var key [sha256.Size]byte
+			copy(key[:], digest)
+			pins[key] = true
+		}
+
+		cfg.VerifyPeerCertificate = verifySPKIPins(pins, cfg.VerifyPeerCertificate)
+		// resumed sessions skip the verification of the peer certificates
+		cfg.ClientSessionCache = nil
+	}
+	return cfg, nil
+}
+
+// SPKIPin returns the pin of the public key of a certificate, as used in UpstreamTLS.PinnedSPKI
+func SPKIPin(cert *x509.Certificate) string {
+	digest := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(digest[:])
+}
+
+type verifyPeerCertificateFunc func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error
+
+func verifySPKIPins(pins map[[sha256.Size]byte]bool, next verifyPeerCertificateFunc) verifyPeerCertificateFunc {
+	return func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		if next != nil {
+			if err := next(rawCerts, verifiedChains); err != nil {
+				return err
+			}
+		}
+
+		var certs []*x509.Certificate
+		for _, chain := range verifiedChains {
+			certs = append(certs, chain...)
+		}
+		if len(verifiedChains) == 0 {
+			// the chain is not verified with InsecureSkipVerify, the pins apply to the presented certificates
+			for _, raw := range rawCerts {
+				cert, err := x509.ParseCertificate(raw)
+				if err != nil {
+					return err
+				}
+				certs = append(certs, cert)
+			}
+		}
+
+		for _, cert := range certs {
+			if pins[sha256.Sum256(cert.RawSubjectPublicKeyInfo)] {
+				return nil
+			}
+		}
+		return errors.New("no pinned public key in the certificate chain of the upstream server")
+	}
+}
+
+type upstreamTLSKey struct{}
+
+// WithUpstreamTLS returns a shallow copy of the request forwarded with the TLS settings,
+// they take precedence over the settings of the forwarder for the request URL
+func WithUpstreamTLS(req *http.Request, u *UpstreamTLS) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), upstreamTLSKey{}, u))
+}
+
+// GetUpstreamTLS returns the TLS settings set with WithUpstreamTLS, nil if none
+func GetUpstreamTLS(req *http.Request) *UpstreamTLS {
+	u, _ := req.Context().Value(upstreamTLSKey{}).(*UpstreamTLS)
+	return u
+}
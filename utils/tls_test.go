@@ -0,0 +1,75 @@
+package utils
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpstreamTLSConfig(t *testing.T) {
+	roots := x509.NewCertPool()
+	base := &tls.Config{ServerName: "base", MinVersion: tls.VersionTLS10, InsecureSkipVerify: true}
+
+	cfg, err := (&UpstreamTLS{RootCAs: roots, MinVersion: tls.VersionTLS12}).Config(base)
+	require.NoError(t, err)
+	assert.Equal(t, "base", cfg.ServerName)
+	assert.Equal(t, uint16(tls.VersionTLS12), cfg.MinVersion)
+	assert.Equal(t, roots, cfg.RootCAs)
+	assert.True(t, cfg.InsecureSkipVerify)
+	assert.Nil(t, cfg.VerifyPeerCertificate)
+	assert.Equal(t, uint16(tls.VersionTLS10), base.MinVersion)
+
+	_, err = (&UpstreamTLS{PinnedSPKI: []string{"aGVsbG8="}}).Config(nil)
+	assert.Error(t, err)
+}
+
+func TestUpstreamTLSPinnedSPKI(t *testing.T) {
+	srv := httptest.NewTLSServer(http.NotFoundHandler())
+	defer srv.Close()
+
+	testCases := []struct {
+		desc     string
+		pin      string
+		expected bool
+	}{
+		{
+			desc:     "server public key",
+			pin:      SPKIPin(srv.Certificate()),
+			expected: true,
+		},
+		{
+			desc: "other public key",
+			pin:  "47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU=",
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			cfg, err := (&UpstreamTLS{PinnedSPKI: []string{test.pin}}).Config(&tls.Config{InsecureSkipVerify: true})
+			require.NoError(t, err)
+
+			client := &http.Client{Transport: &http.Transport{TLSClientConfig: cfg}}
+			resp, err := client.Get(srv.URL)
+			if !test.expected {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			resp.Body.Close()
+		})
+	}
+}
+
+func TestWithUpstreamTLS(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	assert.Nil(t, GetUpstreamTLS(req))
+
+	u := &UpstreamTLS{ServerName: "example.com"}
+	assert.Equal(t, u, GetUpstreamTLS(WithUpstreamTLS(req, u)))
+}